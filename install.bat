@@ -1,8 +1,10 @@
 set CURDIR=%cd%
 set GOPATH=%CURDIR%
 
+REM the sql drivers linked in, add sqlite with cgo
+if not defined TAGS set TAGS=mysql postgres
 go version
-go build -x -o gearmand.exe .\\src\\gearman\\main.go
+go build -x -tags "%TAGS%" -o gearmand.exe .\\src\\gearman
 
 DEL /F /A /Q .\\bin\\gearmand.exe
 move .\\gearmand.exe .\\bin\\
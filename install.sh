@@ -3,8 +3,10 @@
 CURDIR=`pwd`
 GOPATH=${CURDIR}
 export GOPATH
+#the sql drivers linked in, sqlite needs cgo, TAGS="" builds without them
+TAGS=${TAGS-"mysql postgres sqlite"}
 go version
-go build -x -o gearmand ./src/gearman/main.go
+go build -x -tags "${TAGS}" -o gearmand ./src/gearman
 rm -rf ${CURDIR}/bin/gearmand
 mv gearmand ./bin
 
@@ -72,4 +72,10 @@ var cmdTable = []cmdinfo{
 	{34, "SUBMIT_JOB_LOW_BG", 3},
 	{35, "SUBMIT_JOB_SCHED", 8},
 	{36, "SUBMIT_JOB_EPOCH", 4},
+	{37, "SUBMIT_REDUCE_JOB", 4},
+	{38, "SUBMIT_REDUCE_JOB_BACKGROUND", 4},
+	{39, "GRAB_JOB_ALL", 0},
+	{40, "JOB_ASSIGN_ALL", 4},
+	{41, "GET_STATUS_UNIQUE", 1},
+	{42, "STATUS_RES_UNIQUE", 6},
 }
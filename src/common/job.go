@@ -7,9 +7,11 @@ import (
 )
 
 const (
-	PRIORITY_LOW  = 0
-	PRIORITY_HIGH = 1
-	JobPrefix     = "H:"
+	PRIORITY_LOW    = 0
+	PRIORITY_NORMAL = 1
+	PRIORITY_HIGH   = 2
+	PRIORITY_LEVELS = 3
+	JobPrefix       = "H:"
 )
 
 type Job struct {
@@ -21,12 +23,18 @@ type Job struct {
 	Denominator  int
 	CreateAt     time.Time
 	ProcessAt    time.Time
+	LeaseAt      time.Time //TimeoutSec counts from here, renewed by WORK_STATUS if enabled
+	WhenToRun    time.Time //scheduled jobs stay in the delay queue until then
+	Schedule     string    `json:",omitempty"` //minute hour mday month wday of a recurring job
 	TimeoutSec   int
-	CreateBy     int64 //client sessionId
+	CreateBy     int64   //client sessionId
+	Attached     []int64 //sessionIds of clients coalesced onto this job
 	ProcessBy    int64 //worker sessionId
 	FuncName     string
 	IsBackGround bool
 	Priority     int
+	Attempts     int    //times the job was handed to a worker
+	LastError    string //why the last attempt failed
 }
 
 func (job *Job) String() string {
@@ -41,13 +49,19 @@ func (job *Job) String() string {
 	m["Denominator"] = job.Denominator
 	m["CreateAt"] = job.CreateAt
 	m["ProcessAt"] = job.ProcessAt
+	m["LeaseAt"] = job.LeaseAt
+	m["WhenToRun"] = job.WhenToRun
+	m["Schedule"] = job.Schedule
 	m["Running"] = job.Running
 	m["TimeoutSec"] = job.TimeoutSec
 	m["CreateBy"] = job.CreateBy
+	m["Attached"] = job.Attached
 	m["ProcessBy"] = job.ProcessBy
 	m["FuncName"] = job.FuncName
 	m["IsBackGround"] = job.IsBackGround
 	m["Priority"] = job.Priority
+	m["Attempts"] = job.Attempts
+	m["LastError"] = job.LastError
 
 	if err := enc.Encode(m); err != nil {
 		return ""
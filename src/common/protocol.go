@@ -53,6 +53,13 @@ header is:
                     34  SUBMIT_JOB_LOW_BG   REQ    Client
                     35  SUBMIT_JOB_SCHED    REQ    Client
                     36  SUBMIT_JOB_EPOCH    REQ    Client
+                    37  SUBMIT_REDUCE_JOB   REQ    Client
+                    38  SUBMIT_REDUCE_JOB_BACKGROUND
+                                            REQ    Client
+                    39  GRAB_JOB_ALL        REQ    Worker
+                    40  JOB_ASSIGN_ALL      RES    Worker
+                    41  GET_STATUS_UNIQUE   REQ    Client
+                    42  STATUS_RES_UNIQUE   RES    Client
 4 byte size       - A big-endian (network-order) integer containing
                     the size of the data being sent after the header.
 Arguments given in the data part are separated by a NULL byte, and
@@ -141,4 +148,12 @@ const (
 	SUBMIT_JOB_LOW_BG  //  REQ    Client
 	SUBMIT_JOB_SCHED   //  REQ    Client
 	SUBMIT_JOB_EPOCH   //   36 REQ    Client
+
+	// gearmand extensions
+	SUBMIT_REDUCE_JOB            //  REQ    Client
+	SUBMIT_REDUCE_JOB_BACKGROUND //  REQ    Client
+	GRAB_JOB_ALL                 //  REQ    Worker
+	JOB_ASSIGN_ALL               //  RES    Worker
+	GET_STATUS_UNIQUE            //  REQ    Client
+	STATUS_RES_UNIQUE            //  42 RES    Client
 )
@@ -0,0 +1,7 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+//links the mysql driver of the sql storage, build with -tags mysql
+import _ "github.com/go-sql-driver/mysql"
@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+//links the postgres driver of the sql storage, build with -tags postgres
+import _ "github.com/lib/pq"
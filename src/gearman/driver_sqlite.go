@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+//links the sqlite driver of the sql storage, build with -tags sqlite
+import _ "github.com/mattn/go-sqlite3"
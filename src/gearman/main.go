@@ -2,8 +2,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
 	gearmand "server"
+	"storage"
+	_ "storage/memory"
+	_ "storage/redis"
+	_ "storage/spill"
+	_ "storage/sql"
+	_ "storage/wal"
+	"syscall"
+	"time"
 	"utils/logger"
 )
 
@@ -20,8 +31,81 @@ var (
 	maxProc  *int    = flag.Int("prosize", runtime.NumCPU(), " process size, if <=0 it is going to CPU num")
 	lockMainProcess *bool = flag.Bool("lock", false, "lock EvtLoop process on specific cpu")
 	protoEvtChSize *int = flag.Int("protochannel", 1024, "protochannel size default 1024")
+	timeoutAction *string = flag.String("timeoutaction", "retry", "what to do with timed out jobs: fail requeue retry")
+	statusLease *bool = flag.Bool("statuslease", false, "WORK_STATUS from the worker restarts the job timeout")
+	maxPacket *int = flag.Int("maxpacket", gearmand.DefaultMaxPacketSize, "max packet size in bytes, larger packets close the connection")
+	funcMaxPacket *string = flag.String("funcmaxpacket", "", "max submitted job data size per func, func:bytes split by comma")
+	readBuffer *int = flag.Int("readbuffer", gearmand.DefaultReadBufferSize, "read buffer size in bytes per connection")
+	nodeId *string = flag.String("nodeid", "", "node id in job handles, hostname if empty")
+	maxQueue *string = flag.String("maxqueue", "", "max queued and running jobs per func, func:max or func:high/normal/low split by comma, func * for all")
+	retry *string = flag.String("retry", "", "retry policies, func:attempts:backoff:fail|exception|timeout|lost split by comma, func * for all, the default is *:5:1s:lost")
+	storageName *string = flag.String("storage", "memory", "job storage backend, such as memory spill wal redis sql")
+	storageOpt *string = flag.String("storageopt", "", "backend options, backend.key=value split by comma, such as wal.dir=/var/lib/gearmand,wal.sync=1s")
+	funcStorage *string = flag.String("funcstorage", "", "storage backend per func, func:backend split by comma")
+	snapshotPath *string = flag.String("snapshot", "", "snapshot file of the background jobs, written on shutdown and read on start up")
+	drainTimeout *time.Duration = flag.Duration("draintimeout", gearmand.DefaultDrainTimeout, "graceful shutdown waits this long for the running jobs, 0 until they finished")
 )
 
+//fatal also prints to stderr, the logger drops what it has not written on Close
+func fatal(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+	logger.Logger().E(format, v...)
+	logger.Close()
+	os.Exit(1)
+}
+
+//openStorage opens every backend named by -storage and -funcstorage once
+func openStorage() (storage.Backend, map[string]storage.Backend) {
+	options, err := storage.ParseOptions(*storageOpt)
+	if err != nil {
+		fatal("storageopt %v: %v", *storageOpt, err)
+	}
+
+	funcNames, err := gearmand.ParseFuncStorage(*funcStorage)
+	if err != nil {
+		fatal("funcstorage %v: %v", *funcStorage, err)
+	}
+
+	opened := make(map[string]storage.Backend)
+	open := func(name string) storage.Backend {
+		if backend, ok := opened[name]; ok {
+			return backend
+		}
+
+		//a redis or sql table shared by several servers keeps the running
+		//jobs of each one under its node id
+		if (name == "redis" || name == "sql") && options[name]["node"] == "" {
+			if options[name] == nil {
+				options[name] = make(map[string]string)
+			}
+			options[name]["node"] = gearmand.NodeId()
+		}
+
+		backend, err := storage.Open(name, options[name])
+		if err == storage.ErrUnknownBackend {
+			fatal("storage %v: %v, backends: %v", name, err, storage.Backends())
+		} else if err != nil {
+			fatal("storage %v: %v", name, err)
+		}
+		opened[name] = backend
+		return backend
+	}
+
+	backend := open(*storageName)
+	funcBackends := make(map[string]storage.Backend)
+	for funcName, name := range funcNames {
+		funcBackends[funcName] = open(name)
+	}
+
+	for name := range options {
+		if _, ok := opened[name]; !ok {
+			fatal("storageopt: backend %v is not used", name)
+		}
+	}
+
+	return backend, funcBackends
+}
+
 func main() {
 	flag.Parse()
 
@@ -39,11 +123,73 @@ func main() {
 	}
 
 	runtime.GOMAXPROCS(procSize)
+	gearmand.Version = version
 	logger.Initialize(*addr, *logLevel, *logPath)
 
-	logger.Logger().I("gm server start up!!!! %v version:%v addr:%v mon:%v verbose:%v trytime:%v logpath:%v process size:%v lock:%v proto size:%v",
+	logger.Logger().I("gm server start up!!!! %v version:%v addr:%v mon:%v verbose:%v trytime:%v logpath:%v process size:%v lock:%v proto size:%v retry:%v timeoutaction:%v statuslease:%v maxpacket:%v funcmaxpacket:%v readbuffer:%v nodeid:%v maxqueue:%v storage:%v storageopt:%v funcstorage:%v snapshot:%v draintimeout:%v",
 		runtime.Version(), version, *addr, *monAddr, *logLevel, *tryTimes, *logPath, procSize,
-		*lockMainProcess, *protoEvtChSize)
+		*lockMainProcess, *protoEvtChSize, *retry, *timeoutAction, *statusLease,
+		*maxPacket, *funcMaxPacket, *readBuffer, *nodeId, *maxQueue, *storageName, *storageOpt, *funcStorage, *snapshotPath, *drainTimeout)
+
+	policies, err := gearmand.ParseRetryPolicies(*retry)
+	if err != nil {
+		fatal("retry %v: %v", *retry, err)
+	}
+
+	action, err := gearmand.ParseTimeoutAction(*timeoutAction)
+	if err != nil {
+		fatal("timeoutaction %v: %v", *timeoutAction, err)
+	}
+
+	funcMax, err := gearmand.ParseFuncLimits(*funcMaxPacket)
+	if err != nil {
+		fatal("funcmaxpacket %v: %v", *funcMaxPacket, err)
+	}
+
+	queueLimits, err := gearmand.ParseQueueLimits(*maxQueue)
+	if err != nil {
+		fatal("maxqueue %v: %v", *maxQueue, err)
+	}
+
+	if *nodeId != "" {
+		gearmand.SetNodeId(*nodeId)
+	}
+
+	server := gearmand.NewServer(*tryTimes, procSize, *lockMainProcess, *protoEvtChSize)
+	for funcName, policy := range policies {
+		server.SetRetryPolicy(funcName, policy)
+	}
+	server.SetTimeoutAction(action, *statusLease)
+	server.SetPacketLimits(*maxPacket, funcMax, *readBuffer)
+	for funcName, limit := range queueLimits {
+		server.SetMaxQueue(funcName, limit)
+	}
+
+	backend, funcBackends := openStorage()
+	server.SetStorage(backend, funcBackends)
+	if err := server.RestoreQueues(); err != nil {
+		fatal("restore queues: %v", err)
+	}
+
+	server.SetDrainTimeout(*drainTimeout)
+	server.SetSnapshotPath(*snapshotPath)
+	if err := server.LoadSnapshot(); err != nil {
+		fatal("snapshot %v: %v", *snapshotPath, err)
+	}
+
+	//the first signal waits for the running jobs, a second one does not,
+	//both write the snapshot
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		graceful := true
+		for sig := range signals {
+			logger.Logger().I("%v, shutdown graceful:%v", sig, graceful)
+			server.Shutdown(graceful)
+			graceful = false
+		}
+	}()
 
-	gearmand.NewServer(*tryTimes, procSize, *lockMainProcess, *protoEvtChSize).Start(*addr, *monAddr)
+	server.Start(*addr, *monAddr)
+	logger.Close()
 }
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	. "common"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"utils/logger"
+)
+
+// Version is reported by the text "version" command
+var Version = "unknown"
+
+// text administrative protocol, answered the same way gearmand does
+const (
+	adminOK  = "OK\n"
+	adminEnd = ".\n"
+)
+
+func adminError(code string, msg string) string {
+	return fmt.Sprintf("ERR %s %s\n", code, strings.Replace(msg, " ", "+", -1))
+}
+
+func isTextCommand(first byte) bool {
+	return first != 0
+}
+
+func (server *Server) handleAdminCommand(e *Event) {
+	fields := e.args.t0.([]string)
+	if len(fields) == 0 {
+		e.result <- adminError("UNKNOWN_COMMAND", "Unknown server command")
+		return
+	}
+
+	logger.Logger().T("admin command %v sessionId %v", fields, e.fromSessionId)
+
+	switch strings.ToLower(fields[0]) {
+	case "status":
+		e.result <- server.adminStatus()
+	case "workers":
+		e.result <- server.adminWorkers()
+	case "version":
+		e.result <- fmt.Sprintf("OK %s\n", Version)
+	case "getpid":
+		e.result <- fmt.Sprintf("OK %d\n", os.Getpid())
+	case "maxqueue":
+		e.result <- server.adminMaxQueue(fields[1:])
+	case "cancel":
+		if len(fields) != 3 || strings.ToLower(fields[1]) != "job" {
+			e.result <- adminError("INCOMPLETE_ARGS", "An incomplete set of arguments was sent to this command")
+			return
+		}
+		e.result <- server.adminCancelJob(fields[2])
+	case "shutdown":
+		graceful := len(fields) > 1 && strings.ToLower(fields[1]) == "graceful"
+		e.result <- adminOK
+		server.shutdown(graceful)
+	default:
+		e.result <- adminError("UNKNOWN_COMMAND", "Unknown server command")
+	}
+}
+
+func (server *Server) funcNames() []string {
+	names := make([]string, 0, len(server.jobStores))
+	for name := range server.jobStores {
+		names = append(names, name)
+	}
+	for name := range server.funcWorker {
+		if _, ok := server.jobStores[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// adminStatus keeps the four columns of gearmand, the submits refused by
+// maxqueue are in /status/job
+func (server *Server) adminStatus() string {
+	var buffer bytes.Buffer
+
+	for _, name := range server.funcNames() {
+		queued := 0
+		if jq, ok := server.jobStores[name]; ok {
+			queued = jq.Length()
+		}
+		workers := 0
+		if jw, ok := server.funcWorker[name]; ok {
+			workers = jw.Workers.Len()
+		}
+		buffer.WriteString(fmt.Sprintf("%s\t%d\t%d\t%d\n", name, queued+server.running[name],
+			server.running[name], workers))
+	}
+	buffer.WriteString(adminEnd)
+
+	return buffer.String()
+}
+
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (server *Server) adminWorkers() string {
+	var buffer bytes.Buffer
+
+	ids := make([]int64, 0, len(server.worker)+len(server.client))
+	for id := range server.worker {
+		ids = append(ids, id)
+	}
+	for id := range server.client {
+		if _, ok := server.worker[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if w, ok := server.worker[id]; ok {
+			workerId := w.workerId
+			if workerId == "" {
+				workerId = "-"
+			}
+			buffer.WriteString(fmt.Sprintf("%d %s %s :", id, remoteHost(w.Conn), workerId))
+			funcs := make([]string, 0, len(w.canDo))
+			for name, cando := range w.canDo {
+				if cando {
+					funcs = append(funcs, name)
+				}
+			}
+			sort.Strings(funcs)
+			for _, name := range funcs {
+				buffer.WriteString(" " + name)
+			}
+			buffer.WriteString("\n")
+		} else {
+			buffer.WriteString(fmt.Sprintf("%d %s - :\n", id, remoteHost(server.client[id].Conn)))
+		}
+	}
+	buffer.WriteString(adminEnd)
+
+	return buffer.String()
+}
+
+func (server *Server) adminMaxQueue(args []string) string {
+	if len(args) == 0 {
+		return adminError("INCOMPLETE_ARGS", "An incomplete set of arguments was sent to this command")
+	}
+
+	var limit QueueLimit
+	if len(args) > 1 {
+		var err error
+		if limit, err = parseQueueLimit(args[1:]); err != nil {
+			return adminError("INVALID_ARGS", "max queue size must be one number or high normal low")
+		}
+	}
+
+	server.SetMaxQueue(args[0], limit)
+
+	logger.Logger().I("maxqueue func:%v max:%v", args[0], limit)
+	return adminOK
+}
+
+func (server *Server) adminCancelJob(handle string) string {
+	var j *Job
+	for _, jq := range server.jobStores {
+		var err error
+		if j, err = jq.RemoveJob(handle); err != nil {
+			return adminError(errStorage, err.Error())
+		}
+		if j != nil {
+			break
+		}
+	}
+	if j == nil {
+		j = server.unscheduleJob(handle)
+	}
+	if j == nil {
+		return adminError("UNKNOWN_JOB", "Job does not exist or is already running")
+	}
+
+	server.removeUniqueJob(j)
+	reply := constructReply(WORK_FAIL, [][]byte{[]byte(j.Handle)})
+	for _, c := range server.jobClients(j) {
+		c.Send(reply)
+	}
+
+	logger.Logger().I("cancel job %v", j)
+	return adminOK
+}
+
+// Shutdown runs a shutdown on the event loop, as the shutdown admin
+// command does, Start returns once it is done.
+func (server *Server) Shutdown(graceful bool) {
+	fields := []string{"shutdown"}
+	if graceful {
+		fields = append(fields, "graceful")
+	}
+	e := &Event{tp: adminCommand, args: &Tuple{t0: fields}, result: createResCh()}
+	server.protoEvtCh <- e
+	<-e.result
+}
+
+// SetDrainTimeout must be called before Start, a graceful shutdown waits
+// that long for the running jobs, timeout <= 0 waits until they finished.
+func (server *Server) SetDrainTimeout(timeout time.Duration) {
+	server.drainTimeout = timeout
+}
+
+// shutdown stops accepting connections, jobs and grabs, a graceful one
+// waits for the running jobs to finish before Start returns, up to the
+// drain timeout. A shutdown that is not graceful stops a graceful one
+// still waiting.
+func (server *Server) shutdown(graceful bool) {
+	if !atomic.CompareAndSwapInt32(&server.shuttingDown, 0, 1) {
+		if !graceful && server.graceful {
+			logger.Logger().I("shutdown no longer waits for %v jobs", len(server.workJobs))
+			server.graceful = false
+			server.checkShutdown()
+		}
+		return
+	}
+
+	logger.Logger().I("shutdown graceful:%v working:%v", graceful, len(server.workJobs))
+	server.listener.Close()
+
+	server.graceful = graceful
+	if graceful && server.drainTimeout > 0 {
+		server.drainUntil = time.Now().Add(server.drainTimeout)
+	}
+	server.checkShutdown()
+}
+
+func (server *Server) checkShutdown() {
+	if atomic.LoadInt32(&server.shuttingDown) == 0 || server.stopped {
+		return
+	}
+
+	if server.graceful && len(server.workJobs) > 0 {
+		if server.drainUntil.IsZero() || time.Now().Before(server.drainUntil) {
+			return
+		}
+		logger.Logger().W("shutdown stops waiting for %v jobs after %v", len(server.workJobs), server.drainTimeout)
+	}
+
+	server.stopped = true
+	server.saveSnapshot()
+	server.closeQueues()
+	close(server.done)
+}
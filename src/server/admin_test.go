@@ -0,0 +1,178 @@
+package server
+
+import (
+	. "common"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminCommands(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	client.submit(SUBMIT_JOB_BG, "resize", "", "a")
+	client.submit(SUBMIT_JOB_BG, "resize", "", "b")
+	client.submit(SUBMIT_JOB_BG, "crop", "", "c")
+
+	worker := dial(t, addr)
+	worker.send(SET_CLIENT_ID, "w1")
+	worker.send(CAN_DO, "resize")
+	worker.send(CAN_DO, "thumb")
+	worker.grab()
+
+	admin := dial(t, addr)
+
+	tests := []struct {
+		cmd  string
+		list bool
+		want []string
+	}{
+		{"status", true, []string{"crop\t1\t0\t0", "resize\t2\t1\t1", "thumb\t0\t0\t1"}},
+		{"version", false, []string{"OK " + Version}},
+		{"getpid", false, []string{fmt.Sprintf("OK %d", os.Getpid())}},
+		{"maxqueue resize", false, []string{"OK"}},
+		{"maxqueue", false, []string{"ERR INCOMPLETE_ARGS An+incomplete+set+of+arguments+was+sent+to+this+command"}},
+		{"cancel job H:none:1", false, []string{"ERR UNKNOWN_JOB Job+does+not+exist+or+is+already+running"}},
+		{"cancel", false, []string{"ERR INCOMPLETE_ARGS An+incomplete+set+of+arguments+was+sent+to+this+command"}},
+		{"bogus", false, []string{"ERR UNKNOWN_COMMAND Unknown+server+command"}},
+	}
+
+	for _, tt := range tests {
+		if got := admin.admin(tt.cmd, tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestAdminWorkers(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	worker := dial(t, addr)
+	worker.send(SET_CLIENT_ID, "w1")
+	worker.send(CAN_DO, "b")
+	worker.send(CAN_DO, "a")
+	worker.sync()
+
+	admin := dial(t, addr)
+	got := admin.admin("workers", true)
+
+	//functions are listed sorted, the admin connection has no worker line yet
+	host, _, _ := net.SplitHostPort(worker.conn.LocalAddr().String())
+	if len(got) == 0 || got[0] != fmt.Sprintf("1 %s w1 : a b", host) {
+		t.Errorf("workers %q", got)
+	}
+}
+
+func TestAdminCancelJob(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	handle := client.submit(SUBMIT_JOB, "resize", "u1", "a")
+
+	admin := dial(t, addr)
+	if got := admin.admin("cancel job "+handle, false); got[0] != "OK" {
+		t.Fatalf("cancel %q", got)
+	}
+	if got := client.expect(WORK_FAIL); got[0] != handle {
+		t.Errorf("WORK_FAIL %q", got)
+	}
+
+	client.send(GET_STATUS_UNIQUE, "u1")
+	if got := client.expect(STATUS_RES_UNIQUE); got[1] != "0" {
+		t.Errorf("cancelled job still indexed: %q", got)
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	server, addr := startServer(t, nil)
+
+	admin := dial(t, addr)
+	if got := admin.admin("shutdown", false); got[0] != "OK" {
+		t.Fatalf("shutdown %q", got)
+	}
+
+	select {
+	case <-server.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("server still accepts connections")
+	}
+}
+
+func TestShutdownSignals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	server, addr := startServer(t, func(server *Server) { server.SetSnapshotPath(path) })
+
+	client := dial(t, addr)
+	handle := client.submit(SUBMIT_JOB_BG, "resize", "", "a")
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "resize")
+	worker.grab()
+
+	//a graceful shutdown waits for the running job, the next one does not
+	server.Shutdown(true)
+	select {
+	case <-server.done:
+		t.Fatal("graceful shutdown did not wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	server.Shutdown(false)
+	select {
+	case <-server.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), handle) {
+		t.Errorf("snapshot %s, %v", data, err)
+	}
+}
+
+func TestShutdownRefusesWork(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	server, addr := startServer(t, func(server *Server) {
+		server.SetSnapshotPath(path)
+		server.SetDrainTimeout(100 * time.Millisecond)
+	})
+
+	client := dial(t, addr)
+	client.submit(SUBMIT_JOB_BG, "resize", "", "a")
+	queued := client.submit(SUBMIT_JOB_BG, "resize", "", "b")
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "resize")
+	worker.grab()
+
+	//the queued job waits in the snapshot for the next start
+	server.Shutdown(true)
+	if job := worker.grab(); job != nil {
+		t.Errorf("grab while shutting down got %q", job)
+	}
+	worker.send(GRAB_JOB_UNIQ)
+	worker.expect(NO_JOB)
+	client.send(SUBMIT_JOB_BG, "resize", "", "c")
+	if got := client.expect(ERROR); got[0] != errShuttingDown {
+		t.Errorf("submit while shutting down %q", got)
+	}
+
+	//the running job is not waited for past the drain timeout
+	select {
+	case <-server.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("drain did not time out")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(data), queued) {
+		t.Errorf("queued job %v not in snapshot %s, %v", queued, data, err)
+	}
+}
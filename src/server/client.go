@@ -30,7 +30,34 @@ func (connector *Connector) Send(data []byte) {
 	connector.locker.Unlock()
 }
 
+const (
+	optionExceptions = "exceptions"
+)
+
+//options a client may turn on by OPTION_REQ
+var supportedOptions = map[string]bool{
+	optionExceptions: true,
+}
+
 type Client struct {
 	Conn net.Conn
 	Connector
+
+	options map[string]bool //only touched in EvtLoop
+}
+
+func (client *Client) setOption(name string) bool {
+	if !supportedOptions[name] {
+		return false
+	}
+
+	if client.options == nil {
+		client.options = make(map[string]bool)
+	}
+	client.options[name] = true
+	return true
+}
+
+func (client *Client) hasOption(name string) bool {
+	return client.options[name]
 }
@@ -42,8 +42,33 @@ type Server struct {
 	worker         map[int64]*Worker
 	client         map[int64]*Client
 	workJobs       map[string]*Job
-	funcTimeout    map[string]int
+	running        map[string]int //running jobs per function, kept with workJobs
+	uniqueJobs     map[string]map[string]*Job //unique id -> func name -> queued or running job
+	delayUniques   map[string]map[string]*Job //unique id -> func name -> scheduled job before its first run
 	jobStores      map[string]storage.JobQueue
+	backend        storage.Backend
+	funcBackends   map[string]storage.Backend
+	delayJobs      *delayQueue
+	maxQueue       map[string]QueueLimit
+	rejected       map[string]int64 //submits refused by maxQueue
+	retryPolicies  map[string]*RetryPolicy
+	deadJobs       map[string]storage.JobQueue
+	schedJobs      map[string]storage.JobQueue
+	timeoutAction  int
+	leaseOnStatus  bool
+	tombstones     map[tombstone]time.Time
+	snapshotPath   string
+	ownerMismatch  int64 //reports from workers not owning the job
+	maxPacketSize  uint32
+	funcMaxPacket  map[string]uint32
+	readBufferSize int
+	listener       net.Listener
+	shuttingDown   int32
+	graceful       bool
+	drainTimeout   time.Duration
+	drainUntil     time.Time //a graceful shutdown stops waiting for the running jobs
+	stopped        bool
+	done           chan bool
 }
 
 func NewServer(tryTimes int, maxProc int, lockMainProcess bool, protoEvtChSize int) *Server {
@@ -53,8 +78,25 @@ func NewServer(tryTimes int, maxProc int, lockMainProcess bool, protoEvtChSize i
 		worker:         make(map[int64]*Worker),
 		client:         make(map[int64]*Client),
 		workJobs:       make(map[string]*Job),
+		running:        make(map[string]int),
+		uniqueJobs:     make(map[string]map[string]*Job),
+		delayUniques:   make(map[string]map[string]*Job),
 		jobStores:      make(map[string]storage.JobQueue),
-		funcTimeout:    make(map[string]int),
+		backend:        &memory.MemStore{},
+		funcBackends:   make(map[string]storage.Backend),
+		delayJobs:      newDelayQueue(),
+		maxQueue:       make(map[string]QueueLimit),
+		rejected:       make(map[string]int64),
+		retryPolicies:  make(map[string]*RetryPolicy),
+		deadJobs:       make(map[string]storage.JobQueue),
+		schedJobs:      make(map[string]storage.JobQueue),
+		timeoutAction:  TimeoutRetry,
+		tombstones:     make(map[tombstone]time.Time),
+		maxPacketSize:  DefaultMaxPacketSize,
+		funcMaxPacket:  make(map[string]uint32),
+		readBufferSize: DefaultReadBufferSize,
+		drainTimeout:   DefaultDrainTimeout,
+		done:           make(chan bool),
 		startSessionId: 0,
 		tryTimes:       tryTimes,
 		maxProc: maxProc,
@@ -62,6 +104,26 @@ func NewServer(tryTimes int, maxProc int, lockMainProcess bool, protoEvtChSize i
 	}
 }
 
+//SetPacketLimits must be called before Start, sizes <= 0 keep the defaults,
+//funcMax limits the job data submitted to single functions
+func (server *Server) SetPacketLimits(maxPacket int, funcMax map[string]int, readBuffer int) {
+	if maxPacket > 0 {
+		server.maxPacketSize = uint32(maxPacket)
+	}
+	for funcName, max := range funcMax {
+		server.funcMaxPacket[funcName] = uint32(max)
+	}
+	if readBuffer > 0 {
+		server.readBufferSize = readBuffer
+	}
+}
+
+//submitTooLarge tells if the job data of a submit is over its function's limit
+func (server *Server) submitTooLarge(funcName string, size int) bool {
+	max, ok := server.funcMaxPacket[funcName]
+	return ok && uint32(size) > max
+}
+
 func (server *Server) getJobStatus(e *Event) {
 	var buffer bytes.Buffer
 	buffer.WriteString("waiting:[")
@@ -70,7 +132,32 @@ func (server *Server) getJobStatus(e *Event) {
 	}
 	buffer.WriteString("]\n")
 
-	buffer.WriteString(fmt.Sprintf("protoEvtCh:%v, working:%v", len(server.protoEvtCh), len(server.workJobs)))
+	buffer.WriteString("stats:[")
+	for key, jq := range server.jobStores {
+		stats := jq.Stats()
+		buffer.WriteString(fmt.Sprintf("%v:%v/%vB/%v,", key, stats.Count, stats.Bytes,
+			stats.OldestAge.Truncate(time.Second)))
+	}
+	buffer.WriteString("]\n")
+
+	buffer.WriteString("spill:[")
+	for key, jq := range server.jobStores {
+		if sq, ok := jq.(storage.SpillStatsReader); ok {
+			stats := sq.SpillStats()
+			buffer.WriteString(fmt.Sprintf("%v:%v/%vB/%vseg out:%v in:%v,", key, stats.Jobs, stats.Bytes,
+				stats.Segments, stats.Spilled, stats.PagedIn))
+		}
+	}
+	buffer.WriteString("]\n")
+
+	buffer.WriteString("rejected:[")
+	for key, n := range server.rejected {
+		buffer.WriteString(fmt.Sprintf("%v:%v,", key, n))
+	}
+	buffer.WriteString("]\n")
+
+	buffer.WriteString(fmt.Sprintf("protoEvtCh:%v, working:%v, delayed:%v, ownerMismatch:%v", len(server.protoEvtCh),
+		len(server.workJobs), server.delayJobs.Length(), server.ownerMismatch))
 
 	for k, j := range server.workJobs {
 		buffer.WriteString(fmt.Sprintf("\n %v:%v,", k, j))
@@ -81,10 +168,15 @@ func (server *Server) getJobStatus(e *Event) {
 
 func (server *Server) removeJobDirect(e *Event) {
 
-	_, ok := server.workJobs[e.args.t0.(string)]
+	j, ok := server.workJobs[e.args.t0.(string)]
 	if ok {
 		logger.Logger().I("remove job %v", e.args.t0.(string))
-		delete(server.workJobs, e.args.t0.(string))
+		server.removeJob(j)
+		e.result <- fmt.Sprintf("deleted %v yet", e.args.t0.(string))
+		return
+	}else if j = server.unscheduleJob(e.args.t0.(string)); j != nil {
+		logger.Logger().I("remove delay job %v", e.args.t0.(string))
+		server.removeUniqueJob(j)
 		e.result <- fmt.Sprintf("deleted %v yet", e.args.t0.(string))
 		return
 	}else{
@@ -96,16 +188,14 @@ func (server *Server) removeJobDirect(e *Event) {
 func (server *Server) getFuncWorkerStatus(e *Event) {
 	var buffer bytes.Buffer
 	for key, jw := range server.funcWorker {
-		to, ok := server.funcTimeout[key]
-		if !ok {
-			to = 0
-		}
-		buffer.WriteString(fmt.Sprintf("func %v to %v[", key, to))
+		buffer.WriteString(fmt.Sprintf("func %v[", key))
 		for it := jw.Workers.Front(); it != nil; it = it.Next() {
-			buffer.WriteString(fmt.Sprintf("id:%v cid:%v ip:%v stats:%v,\n", it.Value.(*Worker).Connector.SessionId,
+			buffer.WriteString(fmt.Sprintf("id:%v cid:%v ip:%v stats:%v exclusive:%v to:%v,\n", it.Value.(*Worker).Connector.SessionId,
 				it.Value.(*Worker).workerId,
 				it.Value.(*Worker).Conn.RemoteAddr(),
-				it.Value.(*Worker).status))
+				it.Value.(*Worker).status,
+				it.Value.(*Worker).exclusive,
+				it.Value.(*Worker).timeout[key]))
 		}
 		buffer.WriteString("]\n")
 	}
@@ -117,8 +207,8 @@ func (server *Server) getWorkerStatus(e *Event) {
 	var buffer bytes.Buffer
 	buffer.WriteString("work[")
 	for key, clt := range server.worker {
-		buffer.WriteString(fmt.Sprintf("id:%v cid:%v ip:%v stats:%v,\n", key, clt.workerId,
-			clt.Conn.RemoteAddr(), clt.status))
+		buffer.WriteString(fmt.Sprintf("id:%v cid:%v ip:%v stats:%v exclusive:%v,\n", key, clt.workerId,
+			clt.Conn.RemoteAddr(), clt.status, clt.exclusive))
 	}
 	buffer.WriteString("]\n")
 
@@ -143,21 +233,16 @@ func (server *Server) allocSessionId() int64 {
 
 func (server *Server) clearTimeoutJob() {
 
-	now := time.Now().Unix()
-	for k, j := range server.workJobs {
+	now := time.Now()
+	for _, j := range server.workJobs {
 		if j.TimeoutSec > 0 {
-			if (j.CreateAt.Unix() + int64(j.TimeoutSec)) <= now {
-				c, ok := server.client[j.CreateBy]
-				if ok {
-					c.Send(constructReply(WORK_FAIL, [][]byte{[]byte(j.Handle)}))
-				} else {
-					logger.Logger().I("client not exist cant send %v", j)
-				}
-				delete(server.workJobs, k)
-				logger.Logger().I("remove time out job %v", j)
+			if (j.LeaseAt.Unix() + int64(j.TimeoutSec)) <= now.Unix() {
+				server.timeoutJob(j)
 			}
 		}
 	}
+
+	server.clearTombstones(now)
 }
 
 func (server *Server) Start(addr string, monAddr string) {
@@ -167,6 +252,7 @@ func (server *Server) Start(addr string, monAddr string) {
 	}
 
 	logger.Logger().I("listening on %v", addr)
+	server.listener = ln
 	go server.EvtLoop()
 
 	go registerWebHandler(server, monAddr)
@@ -174,6 +260,9 @@ func (server *Server) Start(addr string, monAddr string) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil { // handle error
+			if atomic.LoadInt32(&server.shuttingDown) != 0 {
+				break
+			}
 			logger.Logger().E("accept %v", err)
 			continue
 		}
@@ -181,6 +270,9 @@ func (server *Server) Start(addr string, monAddr string) {
 		session := &Session{}
 		go session.handleConnection(server, conn)
 	}
+
+	<-server.done
+	logger.Logger().I("server stopped")
 }
 
 func (server *Server) EvtLoop() {
@@ -199,6 +291,10 @@ func (server *Server) EvtLoop() {
 			}
 		case <-tick.C:
 			server.clearTimeoutJob()
+			server.wakeupQueued()
+			server.checkShutdown()
+		case <-server.delayJobs.timer.C:
+			server.fireDelayJobs()
 		}
 	}
 }
@@ -229,26 +325,29 @@ func (server *Server) handleCanDo(funcName string, w *Worker, timeout int) {
 	jw := server.getJobWorkPair(funcName)
 	server.addWorker(jw.Workers, w)
 	server.worker[w.SessionId] = w
-	server.funcTimeout[funcName] = timeout
+	w.timeout[funcName] = timeout
 	w.canDo[funcName] = true
 
 	logger.Logger().T("can do func:%v sessionId:%v", funcName, w.SessionId)
 }
 
-func (server *Server) addFuncJobStore(funcName string) storage.JobQueue {
+func (server *Server) addFuncJobStore(funcName string) (storage.JobQueue, error) {
 
 	k, ok := server.jobStores[funcName]
 
 	if ok {
-		return k
+		return k, nil
 	}
 
-	queue := &memory.MemJobQueue{}
-	queue.Initial(funcName)
+	queue, err := server.newJobQueue(funcName)
+	if err != nil {
+		logger.Logger().E("addFuncJobStore:%v %v", funcName, err)
+		return nil, err
+	}
 	server.jobStores[funcName] = queue
 
 	logger.Logger().T("addFuncJobStore:%v", funcName)
-	return queue
+	return queue, nil
 }
 
 func (server *Server) removeCanDo(funcName string, sessionId int64) {
@@ -257,8 +356,40 @@ func (server *Server) removeCanDo(funcName string, sessionId int64) {
 		server.removeWorker(jw.Workers, sessionId)
 	}
 
+	w, ok := server.worker[sessionId]
+	if !ok {
+		logger.Logger().W("unregister worker, sessionId %d", sessionId)
+		return
+	}
+
 	logger.Logger().T("removeCanDo:%v sessionId:%v", funcName, sessionId)
-	delete(server.worker[sessionId].canDo, funcName)
+	delete(w.canDo, funcName)
+	delete(w.timeout, funcName)
+}
+
+func (server *Server) resetAbilities(sessionId int64) {
+	w, ok := server.worker[sessionId]
+	if !ok {
+		logger.Logger().W("unregister worker, sessionId %d", sessionId)
+		return
+	}
+
+	for funcName := range w.canDo {
+		if jw, ok := server.funcWorker[funcName]; ok {
+			server.removeWorker(jw.Workers, sessionId)
+		}
+	}
+	w.canDo = make(map[string]bool)
+	w.timeout = make(map[string]int)
+
+	logger.Logger().T("resetAbilities sessionId:%v %v", sessionId, w.workerId)
+}
+
+func (server *Server) setAllYours(w *Worker) {
+	server.worker[w.SessionId] = w
+	w.exclusive = true
+
+	logger.Logger().T("all yours sessionId:%v %v", w.SessionId, w.workerId)
 }
 
 func (server *Server) removeWorkerBySessionId(sessionId int64) {
@@ -290,7 +421,11 @@ func (server *Server) popJob(sessionId int64) *Job {
 				continue
 			}
 
-			jb := queue.PopJob()
+			jb, err := queue.PopJob()
+			if err != nil {
+				logger.Logger().E("pop job func:%v %v", funcName, err)
+				continue
+			}
 			if jb != nil {
 				logger.Logger().T("pop job work:%v job:%v", sessionId, jb)
 				return jb
@@ -326,35 +461,209 @@ func (server *Server) handleSubmitJob(e *Event) {
 
 	funcName := bytes2str(args.t1)
 
-	timeout := 0
-	v, ok := server.funcTimeout[funcName]
-	if ok {
-		timeout = v
+	if atomic.LoadInt32(&server.shuttingDown) != 0 {
+		logger.Logger().W("%v func:%v while shutting down", CmdDescription(e.tp), funcName)
+		sendError(c.in, errShuttingDown, "server is shutting down")
+		return
+	}
+
+	if e.tp != SUBMIT_JOB_EPOCH && e.tp != SUBMIT_JOB_SCHED {
+		j := server.findUniqueJob(funcName, bytes2str(args.t2))
+		if j == nil && isBackGround(e.tp) { //the results of a job another server runs never reach a client here
+			j = server.storedUniqueJob(funcName, bytes2str(args.t2))
+		}
+		if j != nil {
+			if !isBackGround(e.tp) {
+				server.attachClient(j, c.SessionId)
+			}
+			logger.Logger().T("%v func:%v uniq:%v coalesced to %v", CmdDescription(e.tp),
+				funcName, j.Id, j.Handle)
+			sendReply(c.in, JOB_CREATED, [][]byte{[]byte(j.Handle), []byte(j.Id)})
+			return
+		}
+	}
+
+	if full, max := server.queueFull(funcName, cmd2Priority(e.tp)); full {
+		server.rejected[funcName]++
+		logger.Logger().W("%v func:%v queue full, max %v", CmdDescription(e.tp), funcName, max)
+		sendError(c.in, errQueueFull, fmt.Sprintf("queue of %s is full", funcName))
+		return
 	}
 
 	j := &Job{Id: bytes2str(args.t2), Data: args.t3.([]byte),
 		Handle: allocJobId(), CreateAt: time.Now(), CreateBy: c.SessionId,
-		FuncName: funcName, Priority: PRIORITY_LOW, TimeoutSec: timeout}
+		FuncName: funcName, Priority: cmd2Priority(e.tp)}
 
 	j.IsBackGround = isBackGround(e.tp)
 
+	var cron *cronSpec
+	switch e.tp {
+	case SUBMIT_JOB_EPOCH:
+		epoch, err := strconv.ParseInt(bytes2str(args.t4.([][]byte)[0]), 10, 64)
+		if err != nil {
+			logger.Logger().W("invalid epoch func:%v uniq:%v %v", funcName, j.Id, err)
+			sendError(c.in, errInvalidEpoch, err.Error())
+			return
+		}
+		j.WhenToRun = time.Unix(epoch, 0)
+	case SUBMIT_JOB_SCHED:
+		fields := make([]string, 0, 5)
+		for _, f := range args.t4.([][]byte) {
+			fields = append(fields, string(f))
+		}
+		var err error
+		j.Schedule = scheduleOf(fields)
+		if cron, err = parseCronSpec(fields); err == nil {
+			if j.WhenToRun = cron.next(j.CreateAt); j.WhenToRun.IsZero() {
+				err = invalidSchedule
+			}
+		}
+		if err != nil {
+			logger.Logger().W("invalid schedule func:%v uniq:%v %v", funcName, j.Id, fields)
+			sendError(c.in, errInvalidSchedule, err.Error())
+			return
+		}
+	}
+
 	logger.Logger().T("%v func:%v uniq:%v info:%+v", CmdDescription(e.tp),
 		args.t1, args.t2, j)
 
-	j.Priority = cmd2Priority(e.tp)
+	var err error
+	if j.WhenToRun.After(time.Now()) {
+		err = server.scheduleJob(j, cron)
+	} else {
+		err = server.doAddJob(j)
+	}
+	if err == storage.ErrDuplicateUnique {
+		sendError(c.in, errJobExists, fmt.Sprintf("%s job of %s exists in the storage", funcName, j.Id))
+		return
+	} else if err != nil {
+		sendError(c.in, errStorage, err.Error())
+		return
+	}
 
 	//e.result <- j.Handle
 	sendReply(c.in, JOB_CREATED, [][]byte{[]byte(j.Handle), []byte(j.Id)})
 
-	server.doAddJob(j)
+	server.addUniqueJob(j)
 }
 
-func (server *Server) doAddJob(j *Job) {
+//queueSize counts the queued and running jobs of a function
+func (server *Server) queueSize(funcName string) int {
+	size := server.running[funcName]
+	if jq, ok := server.jobStores[funcName]; ok {
+		size += jq.Length()
+	}
+	return size
+}
+
+//addWorkJob and removeWorkJob are the only writers of workJobs, they keep
+//the running count of each function in step
+func (server *Server) addWorkJob(j *Job) {
+	if _, ok := server.workJobs[j.Handle]; !ok {
+		server.running[j.FuncName]++
+	}
+	server.workJobs[j.Handle] = j
+}
+
+func (server *Server) removeWorkJob(j *Job) {
+	if _, ok := server.workJobs[j.Handle]; !ok {
+		return
+	}
+	delete(server.workJobs, j.Handle)
+	if server.running[j.FuncName]--; server.running[j.FuncName] <= 0 {
+		delete(server.running, j.FuncName)
+	}
+}
+
+func (server *Server) fireDelayJobs() {
+
+	for _, item := range server.delayJobs.popDue(time.Now()) {
+		j := item.job
+		if item.cron != nil { //recurring, every run gets its own handle
+			j = &Job{}
+			*j = *item.job
+			j.Handle = allocJobId()
+			j.CreateAt = time.Now()
+			j.WhenToRun = j.CreateAt
+			if server.delayJobs.get(item.job.Handle) == nil { //no run left
+				removeIndexed(server.delayUniques, item.job)
+				server.forgetScheduled(item.job)
+			}
+		} else {
+			removeIndexed(server.delayUniques, j)
+		}
+		server.addUniqueJob(j)
+
+		logger.Logger().T("delay job due %v", j)
+		if err := server.doAddJob(j); err != nil {
+			server.dropJob(j)
+		}
+		if item.cron == nil && j.Attempts == 0 {
+			server.forgetScheduled(j)
+		}
+	}
+}
+
+func (server *Server) doAddJob(j *Job) error {
+
+	queue, err := server.addFuncJobStore(j.FuncName)
+	if err != nil {
+		return err
+	}
+	j.ProcessBy = 0
+	j.Running = false
+	if err := queue.PushJob(j); err != nil {
+		logger.Logger().E("push job %v %v", j.Handle, err)
+		return err
+	}
+	server.wakeupWorkers(j.FuncName)
+	return nil
+}
+
+//requeueJob puts a job taken back from a worker ahead of the new work
+func (server *Server) requeueJob(j *Job) {
 
-	queue := server.addFuncJobStore(j.FuncName)
 	j.ProcessBy = 0
-	queue.PushJob(j)
-	workers, ok := server.funcWorker[j.FuncName]
+	j.Running = false
+	j.Percent = 0
+	j.Denominator = 0
+
+	queue, err := server.addFuncJobStore(j.FuncName)
+	if err == nil {
+		err = queue.PushJobFront(j)
+	}
+	if err != nil {
+		logger.Logger().E("requeue job %v %v", j.Handle, err)
+		server.dropJob(j)
+		return
+	}
+	server.wakeupWorkers(j.FuncName)
+}
+
+//dropJob fails a job the storage could not take
+func (server *Server) dropJob(j *Job) {
+	reply := constructReply(WORK_FAIL, [][]byte{[]byte(j.Handle)})
+	for _, c := range server.jobClients(j) {
+		c.Send(reply)
+	}
+	server.removeWorkJob(j)
+	server.removeUniqueJob(j)
+}
+
+//wakeupQueued wakes the workers of every function with queued jobs, jobs
+//another server pushed to a shared storage woke nobody here
+func (server *Server) wakeupQueued() {
+	for funcName, jq := range server.jobStores {
+		if jq.Length() > 0 {
+			server.wakeupWorkers(funcName)
+		}
+	}
+}
+
+func (server *Server) wakeupWorkers(funcName string) {
+
+	workers, ok := server.funcWorker[funcName]
 	
 	if ok {
 		
@@ -370,7 +679,7 @@ func (server *Server) doAddJob(j *Job) {
 		var index int = 0
 		for it := workers.Workers.Front(); it != nil; it = it.Next() {
 			if index >= workers.WakeIndex{
-				if server.wakeupWorker(j.FuncName, it.Value.(*Worker)){
+				if server.wakeupWorker(funcName, it.Value.(*Worker)){
 					i++
 				}
 				if server.tryTimes > 0 && i >= server.tryTimes {
@@ -392,7 +701,129 @@ func (sever *Server) checkAndRemoveJob(tp uint32, j *Job) {
 }
 
 func (sever *Server) removeJob(j *Job) {
-	delete(sever.workJobs, j.Handle)
+	sever.removeWorkJob(j)
+	sever.removeUniqueJob(j)
+
+	//tells a persistent queue the job is done
+	if queue, ok := sever.jobStores[j.FuncName]; ok {
+		if _, err := queue.RemoveJob(j.Handle); err != nil {
+			logger.Logger().E("remove job %v %v", j.Handle, err)
+		}
+	}
+}
+
+//addUniqueJob indexes j by its unique id, a scheduled job waiting for its
+//first run is kept apart so that submits are not coalesced onto it
+func (server *Server) addUniqueJob(j *Job) {
+	if j.Attempts == 0 && server.delayJobs.get(j.Handle) != nil {
+		addIndexed(server.delayUniques, j)
+		return
+	}
+	addIndexed(server.uniqueJobs, j)
+}
+
+func (server *Server) removeUniqueJob(j *Job) {
+	removeIndexed(server.uniqueJobs, j)
+	removeIndexed(server.delayUniques, j)
+}
+
+func addIndexed(index map[string]map[string]*Job, j *Job) {
+	if len(j.Id) == 0 {
+		return
+	}
+
+	jobs, ok := index[j.Id]
+	if !ok {
+		jobs = make(map[string]*Job)
+		index[j.Id] = jobs
+	}
+	jobs[j.FuncName] = j
+}
+
+//removeIndexed leaves the entry alone when another job of the same
+//unique id took it
+func removeIndexed(index map[string]map[string]*Job, j *Job) {
+	jobs, ok := index[j.Id]
+	if !ok {
+		return
+	}
+
+	if u, ok := jobs[j.FuncName]; ok && u == j {
+		delete(jobs, j.FuncName)
+	}
+	if len(jobs) == 0 {
+		delete(index, j.Id)
+	}
+}
+
+//findUniqueJob returns the queued or running job a submit can be coalesced onto
+func (server *Server) findUniqueJob(funcName string, uniqueId string) *Job {
+	if len(uniqueId) == 0 {
+		return nil
+	}
+
+	//retries waiting for backoff are shared, scheduled jobs that never ran
+	//are not indexed here
+	if j, ok := server.uniqueJobs[uniqueId][funcName]; ok {
+		return j
+	}
+
+	return nil
+}
+
+//storedUniqueJob looks for a job the storage of the function holds but this
+//server has not indexed, such as one another server sharing it pushed
+func (server *Server) storedUniqueJob(funcName string, uniqueId string) *Job {
+	queue, ok := server.jobStores[funcName]
+	if !ok || len(uniqueId) == 0 {
+		return nil
+	}
+
+	j, err := queue.GetJobByUnique(uniqueId)
+	if err != nil {
+		logger.Logger().E("get job func:%v uniq:%v %v", funcName, uniqueId, err)
+		return nil
+	}
+	return j
+}
+
+func (server *Server) attachClient(j *Job, sessionId int64) {
+	if !j.IsBackGround && j.CreateBy == sessionId {
+		return
+	}
+
+	for _, id := range j.Attached {
+		if id == sessionId {
+			return
+		}
+	}
+
+	j.Attached = append(j.Attached, sessionId)
+}
+
+//jobClients returns the connected clients waiting for the results of j
+func (server *Server) jobClients(j *Job) []*Client {
+	clients := make([]*Client, 0, len(j.Attached)+1)
+
+	if !j.IsBackGround {
+		if c, ok := server.client[j.CreateBy]; ok {
+			clients = append(clients, c)
+		} else {
+			logger.Logger().W("sessionId missing %v %v", j.Handle, j.CreateBy)
+		}
+	}
+
+	for _, id := range j.Attached {
+		if c, ok := server.client[id]; ok {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+func (server *Server) waitingClients(j *Job) int {
+	return len(server.jobClients(j))
 }
 
 func (server *Server) handleWorkReport(e *Event) {
@@ -403,6 +834,15 @@ func (server *Server) handleWorkReport(e *Event) {
 
 	logger.Logger().T("%v job handle %v", CmdDescription(e.tp), jobhandle)
 
+	if server.isTombstoned(jobhandle, e.fromSessionId) {
+		logger.Logger().W("late %v of timed out job %v sessionId %v", CmdDescription(e.tp),
+			jobhandle, e.fromSessionId)
+		if w, ok := server.worker[e.fromSessionId]; ok {
+			w.Send(constructError(errJobTimedOut, "job "+jobhandle+" timed out"))
+		}
+		return
+	}
+
 	j, ok := server.workJobs[jobhandle]
 	if !ok {
 		logger.Logger().W("job lost:%v  handle %v", CmdDescription(e.tp), jobhandle)
@@ -413,25 +853,140 @@ func (server *Server) handleWorkReport(e *Event) {
 		logger.Logger().E("job handle not match")
 	}
 
+	if j.ProcessBy != e.fromSessionId {
+		server.ownerMismatch++
+		logger.Logger().W("%v job %v from sessionId %v, owner is %v", CmdDescription(e.tp),
+			jobhandle, e.fromSessionId, j.ProcessBy)
+		if w, ok := server.worker[e.fromSessionId]; ok {
+			w.Send(constructError(errJobNotOwned, "job "+jobhandle+" is not assigned to this worker"))
+		}
+		return
+	}
+
+	switch e.tp {
+	case WORK_FAIL:
+		if server.retryJob(j, RetryOnFail, "fail") {
+			return
+		}
+	case WORK_EXCEPTION:
+		if server.retryJob(j, RetryOnException, string(slice[1])) {
+			return
+		}
+	}
+
 	server.checkAndRemoveJob(e.tp, j)
 
 	if WORK_STATUS == e.tp {
 		j.Percent, _ = strconv.Atoi(string(slice[1]))
 		j.Denominator, _ = strconv.Atoi(string(slice[2]))
+		if server.leaseOnStatus {
+			j.LeaseAt = time.Now()
+		}
 	}
 
-	if j.IsBackGround {
+	clients := server.jobClients(j)
+	if len(clients) == 0 {
 		return
 	}
 
-	c, ok := server.client[j.CreateBy]
-	if !ok {
-		logger.Logger().W("sessionId missing %v %v", j.Handle, j.CreateBy)
+	reply := constructReply(e.tp, slice)
+	if WORK_EXCEPTION == e.tp {
+		//only clients asked for exceptions get them, the others see a failure
+		failReply := constructReply(WORK_FAIL, [][]byte{slice[0]})
+		for _, c := range clients {
+			if c.hasOption(optionExceptions) {
+				c.Send(reply)
+			} else {
+				c.Send(failReply)
+			}
+		}
 		return
 	}
 
-	reply := constructReply(e.tp, slice)
-	c.Send(reply)
+	for _, c := range clients {
+		c.Send(reply)
+	}
+}
+
+func (server *Server) handleOptionReq(e *Event) {
+	c := e.args.t0.(*Client)
+	option := e.args.t1.(string)
+
+	if !c.setOption(option) {
+		logger.Logger().W("unknown option %v sessionId %v", option, c.SessionId)
+		c.Send(constructError(errUnknownOption, "Server does not recognize given option"))
+		return
+	}
+
+	logger.Logger().T("option %v sessionId %v", option, c.SessionId)
+	c.Send(constructReply(OPTION_RES, [][]byte{[]byte(option)}))
+}
+
+func (server *Server) findJob(handle string) *Job {
+
+	if j, ok := server.workJobs[handle]; ok {
+		return j
+	}
+
+	if j := server.delayJobs.get(handle); j != nil {
+		return j
+	}
+
+	for funcName, jq := range server.jobStores {
+		j, err := jq.GetJob(handle)
+		if err != nil {
+			logger.Logger().E("get job %v func:%v %v", handle, funcName, err)
+		} else if j != nil {
+			return j
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) handleGetStatusUnique(e *Event) {
+	uniqueId := e.args.t0.(string)
+
+	//the unique id does not name the function, the oldest job sharing it answers
+	var j *Job
+	for _, index := range []map[string]map[string]*Job{server.uniqueJobs, server.delayUniques} {
+		for _, u := range index[uniqueId] {
+			if j == nil || u.CreateAt.Before(j.CreateAt) {
+				j = u
+			}
+		}
+	}
+	if j == nil {
+		for funcName := range server.jobStores {
+			if u := server.storedUniqueJob(funcName, uniqueId); u != nil && (j == nil || u.CreateAt.Before(j.CreateAt)) {
+				j = u
+			}
+		}
+	}
+	if j == nil {
+		logger.Logger().T("get status unknown unique id %v", uniqueId)
+		e.result <- [][]byte{[]byte(uniqueId), bool2bytes(false), bool2bytes(false),
+			int2bytes(0), int2bytes(0), int2bytes(0)}
+		return
+	}
+
+	e.result <- [][]byte{[]byte(uniqueId), bool2bytes(true), bool2bytes(j.Running),
+		int2bytes(j.Percent), int2bytes(j.Denominator), int2bytes(server.waitingClients(j))}
+}
+
+func (server *Server) handleGetStatus(e *Event) {
+	handle := e.args.t0.(string)
+
+	j := server.findJob(handle)
+	if j == nil {
+		logger.Logger().T("get status unknown job %v", handle)
+		e.result <- [][]byte{[]byte(handle), bool2bytes(false), bool2bytes(false),
+			int2bytes(0), int2bytes(0)}
+		return
+	}
+
+	e.result <- [][]byte{[]byte(handle), bool2bytes(true), bool2bytes(j.Running),
+		int2bytes(j.Percent), int2bytes(j.Denominator)}
 }
 
 func (server *Server) handleCloseSession(e *Event) {
@@ -441,6 +996,8 @@ func (server *Server) handleCloseSession(e *Event) {
 			logger.Logger().E("sessionId not match %d-%d, bug found", sessionId, w.SessionId)
 		}
 		server.removeWorkerBySessionId(w.SessionId)
+		server.requeueWorkerJobs(w.SessionId)
+		server.clearWorkerTombstones(w.SessionId)
 	} else if c, ok := server.client[sessionId]; ok {
 		logger.Logger().T("removeClient sessionId %v", sessionId)
 		delete(server.client, c.SessionId)
@@ -448,6 +1005,25 @@ func (server *Server) handleCloseSession(e *Event) {
 	e.result <- true
 }
 
+func (server *Server) requeueWorkerJobs(sessionId int64) {
+	for _, j := range server.workJobs {
+		if j.ProcessBy != sessionId {
+			continue
+		}
+
+		logger.Logger().I("job %v of lost worker %v attempts %v", j.Handle, sessionId, j.Attempts)
+		if server.retryJob(j, RetryOnWorkerLost, "worker lost") {
+			continue
+		}
+
+		reply := constructReply(WORK_FAIL, [][]byte{[]byte(j.Handle)})
+		for _, c := range server.jobClients(j) {
+			c.Send(reply)
+		}
+		server.removeJob(j)
+	}
+}
+
 func (server *Server) setClientId(clientId string, w *Worker) {
 	logger.Logger().T("setClientId sid:%v cid:%v", w.SessionId, clientId)
 	w.workerId = clientId
@@ -474,6 +1050,24 @@ func (server *Server) handleCtrlEvt(e *Event) {
 	case removeJob:
 		server.removeJobDirect(e)
 		return
+	case adminCommand:
+		server.handleAdminCommand(e)
+		return
+	case getDeadJobs:
+		server.getDeadJobs(e)
+		return
+	case replayDeadJobs:
+		server.replayDeadJobs(e)
+		return
+	case purgeDeadJobs:
+		server.purgeDeadJobs(e)
+		return
+	case takeSnapshot:
+		server.takeSnapshot(e)
+		return
+	case wakeupFunc:
+		server.wakeupWorkers(e.args.t0.(string))
+		return
 	default:
 		logger.Logger().W("%s, %d", CmdDescription(e.tp), e.tp)
 	}
@@ -526,13 +1120,25 @@ func (server *Server) handleProtoEvt(e *Event) {
 			break
 		}
 
+		//the jobs left are written to the snapshot
+		if atomic.LoadInt32(&server.shuttingDown) != 0 {
+			w.status = wsPrepareForSleep
+			e.result <- nil
+			break
+		}
+
 		w.status = wsRunning
 
 		j := server.popJob(sessionId)
 		if j != nil {
 			j.ProcessAt = time.Now()
+			j.LeaseAt = j.ProcessAt
 			j.ProcessBy = sessionId
-			server.workJobs[j.Handle] = j
+			delete(server.tombstones, tombstone{j.Handle, sessionId})
+			j.TimeoutSec = w.timeout[j.FuncName]
+			j.Running = true
+			j.Attempts++
+			server.addWorkJob(j)
 			e.result <- j
 		} else { //no job
 			w.status = wsPrepareForSleep
@@ -558,14 +1164,28 @@ func (server *Server) handleProtoEvt(e *Event) {
 			}
 		}
 		break
-	case SUBMIT_JOB, SUBMIT_JOB_LOW_BG, SUBMIT_JOB_LOW:
+	case SUBMIT_JOB, SUBMIT_JOB_BG, SUBMIT_JOB_HIGH, SUBMIT_JOB_HIGH_BG,
+		SUBMIT_JOB_LOW, SUBMIT_JOB_LOW_BG, SUBMIT_JOB_EPOCH, SUBMIT_JOB_SCHED:
 		server.handleSubmitJob(e)
 		break
 	case WORK_DATA, WORK_WARNING, WORK_STATUS, WORK_COMPLETE,
 		WORK_FAIL, WORK_EXCEPTION:
 		server.handleWorkReport(e)
 		break
+	case GET_STATUS:
+		server.handleGetStatus(e)
+		break
+	case GET_STATUS_UNIQUE:
+		server.handleGetStatusUnique(e)
+		break
+	case OPTION_REQ:
+		server.handleOptionReq(e)
+		break
 	case RESET_ABILITIES:
+		server.resetAbilities(e.fromSessionId)
+		break
+	case ALL_YOURS:
+		server.setAllYours(args.t0.(*Worker))
 		break
 	default:
 		logger.Logger().W("not support command:%s, %d", CmdDescription(e.tp), e.tp)
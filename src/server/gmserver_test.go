@@ -0,0 +1,276 @@
+package server
+
+import (
+	. "common"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetStatus(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	running := client.submit(SUBMIT_JOB_BG, "resize", "", "a")
+	queued := client.submit(SUBMIT_JOB_BG, "resize", "", "b")
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "resize")
+	worker.grab()
+	worker.send(WORK_STATUS, running, "3", "10")
+	worker.sync()
+
+	tests := []struct {
+		name   string
+		handle string
+		want   []string
+	}{
+		{"unknown", "H:nowhere:1", []string{"H:nowhere:1", "0", "0", "0", "0"}},
+		{"running with status", running, []string{running, "1", "1", "3", "10"}},
+		{"queued", queued, []string{queued, "1", "0", "0", "0"}},
+	}
+
+	for _, tt := range tests {
+		client.send(GET_STATUS, tt.handle)
+		if got := client.expect(STATUS_RES); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: STATUS_RES %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	worker.send(WORK_COMPLETE, running, "")
+	worker.sync()
+	client.send(GET_STATUS, running)
+	if got := client.expect(STATUS_RES); got[1] != "0" {
+		t.Errorf("completed job still known: %q", got)
+	}
+}
+
+func TestGetStatusUnique(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	running := client.submit(SUBMIT_JOB, "resize", "u-running", "a")
+	client.submit(SUBMIT_JOB_BG, "resize", "u-queued", "b")
+	other := dial(t, addr)
+	if handle := other.submit(SUBMIT_JOB, "resize", "u-running", "a"); handle != running {
+		t.Fatalf("coalesced handle %v, want %v", handle, running)
+	}
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "resize")
+	worker.grab()
+	worker.send(WORK_STATUS, running, "1", "2")
+	worker.sync()
+	client.expect(WORK_STATUS)
+	other.expect(WORK_STATUS)
+
+	tests := []struct {
+		name     string
+		uniqueId string
+		want     []string
+	}{
+		{"unknown", "u-none", []string{"u-none", "0", "0", "0", "0", "0"}},
+		{"running with two clients", "u-running", []string{"u-running", "1", "1", "1", "2", "2"}},
+		{"queued background", "u-queued", []string{"u-queued", "1", "0", "0", "0", "0"}},
+	}
+
+	for _, tt := range tests {
+		client.send(GET_STATUS_UNIQUE, tt.uniqueId)
+		if got := client.expect(STATUS_RES_UNIQUE); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: STATUS_RES_UNIQUE %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	worker.send(WORK_COMPLETE, running, "")
+	worker.sync()
+	client.expect(WORK_COMPLETE)
+	client.send(GET_STATUS_UNIQUE, "u-running")
+	if got := client.expect(STATUS_RES_UNIQUE); got[1] != "0" {
+		t.Errorf("completed job still indexed: %q", got)
+	}
+}
+
+func TestResponsePacketsRejected(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := dial(t, addr)
+
+	for _, tp := range []uint32{NOOP, JOB_CREATED, JOB_ASSIGN, STATUS_RES, ERROR, JOB_ASSIGN_ALL, STATUS_RES_UNIQUE} {
+		c.send(tp, "x")
+		if got := c.expect(ERROR); got[0] != errUnknownCommand {
+			t.Errorf("%v: ERROR %q", CmdDescription(tp), got)
+		}
+	}
+
+	//the connection stays usable
+	c.send(ECHO_REQ, "ping")
+	if got := c.expect(ECHO_RES); got[0] != "ping" {
+		t.Errorf("ECHO_RES %q", got)
+	}
+}
+
+func TestUnsupportedRequestsRejected(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := dial(t, addr)
+
+	tests := []struct {
+		tp   uint32
+		args []string
+	}{
+		{SUBMIT_REDUCE_JOB, []string{"f", "", "r", "x"}},
+		{SUBMIT_REDUCE_JOB_BACKGROUND, []string{"f", "", "r", "x"}},
+		{GRAB_JOB_ALL, nil},
+	}
+
+	for _, tt := range tests {
+		c.send(tt.tp, tt.args...)
+		if got := c.expect(ERROR); got[0] != errUnsupported || got[1] != CmdDescription(tt.tp)+" is not supported" {
+			t.Errorf("%v: ERROR %q", CmdDescription(tt.tp), got)
+		}
+	}
+
+	c.send(ECHO_REQ, "ping")
+	if got := c.expect(ECHO_RES); got[0] != "ping" {
+		t.Errorf("ECHO_RES %q", got)
+	}
+}
+
+func TestCoalesceSubmits(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	first := dial(t, addr)
+	handle := first.submit(SUBMIT_JOB, "thumb", "img-1", "a")
+
+	tests := []struct {
+		name     string
+		cmd      uint32
+		funcName string
+		uniqueId string
+		same     bool
+	}{
+		{"same function and unique id", SUBMIT_JOB, "thumb", "img-1", true},
+		{"background duplicate", SUBMIT_JOB_BG, "thumb", "img-1", true},
+		{"high priority duplicate", SUBMIT_JOB_HIGH, "thumb", "img-1", true},
+		{"other function", SUBMIT_JOB, "crop", "img-1", false},
+		{"other unique id", SUBMIT_JOB, "thumb", "img-2", false},
+		{"no unique id", SUBMIT_JOB, "thumb", "", false},
+	}
+
+	var attached []*testConn
+	for _, tt := range tests {
+		c := dial(t, addr)
+		got := c.submit(tt.cmd, tt.funcName, tt.uniqueId, "b")
+		if (got == handle) != tt.same {
+			t.Errorf("%v: handle %v, first %v", tt.name, got, handle)
+		}
+		if tt.same && !isBackGround(tt.cmd) {
+			attached = append(attached, c)
+		}
+	}
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "thumb")
+	if job := worker.grab(); job == nil || job[0] != handle {
+		t.Fatalf("assigned %q, want %v", job, handle)
+	}
+	worker.send(WORK_DATA, handle, "part")
+	worker.send(WORK_COMPLETE, handle, "done")
+	worker.sync()
+
+	for i, c := range append([]*testConn{first}, attached...) {
+		if got := c.expect(WORK_DATA); got[1] != "part" {
+			t.Errorf("client %v: WORK_DATA %q", i, got)
+		}
+		if got := c.expect(WORK_COMPLETE); got[1] != "done" {
+			t.Errorf("client %v: WORK_COMPLETE %q", i, got)
+		}
+	}
+
+	if again := first.submit(SUBMIT_JOB, "thumb", "img-1", "c"); again == handle {
+		t.Errorf("submit after completion reused %v", handle)
+	}
+}
+
+func TestOptionReq(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	tests := []struct {
+		option string
+		reply  uint32
+		want   string
+	}{
+		{"exceptions", OPTION_RES, "exceptions"},
+		{"unknown", ERROR, errUnknownOption},
+	}
+	for _, tt := range tests {
+		c := dial(t, addr)
+		c.send(OPTION_REQ, tt.option)
+		if got := c.expect(tt.reply); got[0] != tt.want {
+			t.Errorf("%v: %v %q", tt.option, CmdDescription(tt.reply), got)
+		}
+	}
+}
+
+func TestWorkExceptionNeedsOption(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	withOption := dial(t, addr)
+	withOption.send(OPTION_REQ, "exceptions")
+	withOption.expect(OPTION_RES)
+	handle := withOption.submit(SUBMIT_JOB, "parse", "doc", "x")
+
+	without := dial(t, addr)
+	without.submit(SUBMIT_JOB, "parse", "doc", "x")
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "parse")
+	worker.grab()
+	worker.send(WORK_EXCEPTION, handle, "bad input")
+	worker.sync()
+
+	if got := withOption.expect(WORK_EXCEPTION); got[0] != handle || got[1] != "bad input" {
+		t.Errorf("WORK_EXCEPTION %q", got)
+	}
+	if got := without.expect(WORK_FAIL); got[0] != handle || len(got) != 1 {
+		t.Errorf("WORK_FAIL %q", got)
+	}
+}
+
+func TestReportsFromNonOwners(t *testing.T) {
+	server, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	handle := client.submit(SUBMIT_JOB, "resize", "", "a")
+
+	owner := dial(t, addr)
+	owner.send(CAN_DO, "resize")
+	owner.grab()
+
+	other := dial(t, addr)
+	other.send(CAN_DO, "resize")
+
+	tests := []struct {
+		tp   uint32
+		args []string
+	}{
+		{WORK_DATA, []string{handle, "x"}},
+		{WORK_STATUS, []string{handle, "1", "2"}},
+		{WORK_FAIL, []string{handle}},
+		{WORK_COMPLETE, []string{handle, "stolen"}},
+	}
+	for _, tt := range tests {
+		other.send(tt.tp, tt.args...)
+		if got := other.expect(ERROR); got[0] != errJobNotOwned {
+			t.Errorf("%v: ERROR %q", CmdDescription(tt.tp), got)
+		}
+	}
+
+	if status := ctrl(server, getJobStatus, nil).(string); !strings.Contains(status, "ownerMismatch:4") {
+		t.Errorf("status %v", status)
+	}
+
+	owner.send(WORK_COMPLETE, handle, "done")
+	owner.sync()
+	if got := client.expect(WORK_COMPLETE); got[1] != "done" {
+		t.Errorf("WORK_COMPLETE %q", got)
+	}
+}
@@ -69,5 +69,41 @@ func registerWebHandler(s *Server, addr string) {
 		close(e.result);
 		return (ret).(string)
 	})
+	m.Get("/status/dead", func(params martini.Params) string {
+		e := &Event{tp: getDeadJobs, result: createResCh()}
+		s.protoEvtCh <- e
+		ret := <-e.result;
+		close(e.result);
+		return (ret).(string)
+	})
+	m.Post("/dead/replay/:func", func(params martini.Params) string {
+		e := &Event{tp: replayDeadJobs, result: createResCh(), args: &Tuple{t0: params["func"], t1: ""}}
+		s.protoEvtCh <- e
+		ret := <-e.result;
+		close(e.result);
+		return (ret).(string)
+	})
+	m.Post("/dead/replay/:func/:handle", func(params martini.Params) string {
+		e := &Event{tp: replayDeadJobs, result: createResCh(),
+			args: &Tuple{t0: params["func"], t1: params["handle"]}}
+		s.protoEvtCh <- e
+		ret := <-e.result;
+		close(e.result);
+		return (ret).(string)
+	})
+	m.Post("/dead/purge/:func", func(params martini.Params) string {
+		e := &Event{tp: purgeDeadJobs, result: createResCh(), args: &Tuple{t0: params["func"]}}
+		s.protoEvtCh <- e
+		ret := <-e.result;
+		close(e.result);
+		return (ret).(string)
+	})
+	m.Post("/snapshot", func(params martini.Params) string {
+		e := &Event{tp: takeSnapshot, result: createResCh()}
+		s.protoEvtCh <- e
+		ret := <-e.result;
+		close(e.result);
+		return (ret).(string)
+	})
 	logger.Logger().E("%v", http.ListenAndServe(addr, m))
 }
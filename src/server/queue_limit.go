@@ -0,0 +1,108 @@
+package server
+
+import (
+	. "common"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	invalidQueueLimit = errors.New("invalid queue limit")
+)
+
+// QueueLimit is the max number of queued and running jobs of a function
+// accepted from a submit of each priority, 0 means no limit
+type QueueLimit [PRIORITY_LEVELS]int
+
+func (limit QueueLimit) empty() bool {
+	for _, max := range limit {
+		if max > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseQueueLimit takes one size for all priorities, or high normal low
+func parseQueueLimit(values []string) (QueueLimit, error) {
+	var limit QueueLimit
+
+	sizes := make([]int, 0, len(values))
+	for _, v := range values {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return limit, invalidQueueLimit
+		}
+		sizes = append(sizes, n)
+	}
+
+	switch len(sizes) {
+	case 1:
+		for p := range limit {
+			limit[p] = sizes[0]
+		}
+	case 3:
+		limit[PRIORITY_HIGH] = sizes[0]
+		limit[PRIORITY_NORMAL] = sizes[1]
+		limit[PRIORITY_LOW] = sizes[2]
+	default:
+		return limit, invalidQueueLimit
+	}
+
+	return limit, nil
+}
+
+// ParseQueueLimits reads "func:max,func:high/normal/low", func "*" limits
+// every function without a limit of its own
+func ParseQueueLimits(spec string) (map[string]QueueLimit, error) {
+	limits := make(map[string]QueueLimit)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pos := strings.LastIndexByte(entry, ':')
+		if pos <= 0 {
+			return nil, invalidQueueLimit
+		}
+
+		limit, err := parseQueueLimit(strings.Split(entry[pos+1:], "/"))
+		if err != nil {
+			return nil, err
+		}
+		limits[entry[:pos]] = limit
+	}
+
+	return limits, nil
+}
+
+// SetMaxQueue sets or, with an empty limit, clears the limit of a function,
+// it must be called before Start or from EvtLoop
+func (server *Server) SetMaxQueue(funcName string, limit QueueLimit) {
+	if limit.empty() {
+		delete(server.maxQueue, funcName)
+		return
+	}
+	server.maxQueue[funcName] = limit
+}
+
+func (server *Server) maxQueueOf(funcName string) (QueueLimit, bool) {
+	if limit, ok := server.maxQueue[funcName]; ok {
+		return limit, true
+	}
+	limit, ok := server.maxQueue[anyFuncName]
+	return limit, ok
+}
+
+// queueFull tells if a submit of the priority is over the function's limit
+func (server *Server) queueFull(funcName string, priority int) (bool, int) {
+	limit, ok := server.maxQueueOf(funcName)
+	if !ok || limit[priority] <= 0 {
+		return false, 0
+	}
+
+	return server.queueSize(funcName) >= limit[priority], limit[priority]
+}
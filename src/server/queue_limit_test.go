@@ -0,0 +1,140 @@
+package server
+
+import (
+	. "common"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQueueLimits(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]QueueLimit
+		ok   bool
+	}{
+		{"", map[string]QueueLimit{}, true},
+		{"resize:10", map[string]QueueLimit{"resize": {10, 10, 10}}, true},
+		{"resize:3/2/1, *:100", map[string]QueueLimit{
+			"resize": {PRIORITY_LOW: 1, PRIORITY_NORMAL: 2, PRIORITY_HIGH: 3},
+			"*":      {100, 100, 100},
+		}, true},
+		{"resize", nil, false},
+		{"resize:1/2", nil, false},
+		{"resize:-1", nil, false},
+		{"resize:x", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseQueueLimits(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.spec, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	server, addr := startServer(t, func(server *Server) {
+		server.SetMaxQueue("resize", QueueLimit{PRIORITY_LOW: 1, PRIORITY_NORMAL: 2, PRIORITY_HIGH: 3})
+	})
+	client := dial(t, addr)
+
+	tests := []struct {
+		cmd  uint32
+		full bool
+	}{
+		{SUBMIT_JOB_BG, false},
+		{SUBMIT_JOB_LOW_BG, true},
+		{SUBMIT_JOB_BG, false},
+		{SUBMIT_JOB_BG, true},
+		{SUBMIT_JOB_HIGH_BG, false},
+		{SUBMIT_JOB_HIGH_BG, true},
+	}
+	for i, tt := range tests {
+		client.send(tt.cmd, "resize", "", "x")
+		if !tt.full {
+			client.expect(JOB_CREATED)
+			continue
+		}
+		if got := client.expect(ERROR); got[0] != errQueueFull {
+			t.Errorf("submit %v %v: ERROR %q", i, CmdDescription(tt.cmd), got)
+		}
+	}
+
+	//a running job still counts, a finished one frees its slot
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "resize")
+	job := worker.grab()
+	client.send(SUBMIT_JOB_HIGH_BG, "resize", "", "x")
+	client.expect(ERROR)
+	worker.send(WORK_COMPLETE, job[0], "")
+	worker.sync()
+	client.submit(SUBMIT_JOB_HIGH_BG, "resize", "", "x")
+
+	if status := client.admin("status", true); !reflect.DeepEqual(status, []string{"resize\t3\t0\t1"}) {
+		t.Errorf("admin status %q", status)
+	}
+	if status := ctrl(server, getJobStatus, nil).(string); !strings.Contains(status, "rejected:[resize:4,]") {
+		t.Errorf("job status %v", status)
+	}
+}
+
+func TestAdminMaxQueue(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := dial(t, addr)
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"maxqueue resize 1", "OK"},
+		{"maxqueue resize 1 2", "ERR INVALID_ARGS max+queue+size+must+be+one+number+or+high+normal+low"},
+		{"maxqueue resize x", "ERR INVALID_ARGS max+queue+size+must+be+one+number+or+high+normal+low"},
+	}
+	for _, tt := range tests {
+		if got := c.admin(tt.cmd, false); got[0] != tt.want {
+			t.Errorf("%q: %q", tt.cmd, got)
+		}
+	}
+
+	c.submit(SUBMIT_JOB_BG, "resize", "", "x")
+	c.send(SUBMIT_JOB_BG, "resize", "", "x")
+	c.expect(ERROR)
+
+	//without sizes the limit is cleared
+	c.admin("maxqueue resize", false)
+	c.submit(SUBMIT_JOB_BG, "resize", "", "x")
+}
+
+func TestRunningCount(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	server.SetTimeoutAction(TimeoutRequeue, false)
+	server.SetRetryPolicy("resize", &RetryPolicy{Outcomes: RetryOnWorkerLost})
+	c := testClient(server, 1)
+	w := testWorker(server, 2, "resize", 5)
+
+	handles := []string{submitJob(server, c, "resize"), submitJob(server, c, "resize")}
+	grabJob(server, w)
+	expireJob(server, grabJob(server, w))
+	if n := server.running["resize"]; n != 1 {
+		t.Errorf("running %v after a timeout", n)
+	}
+
+	server.handleCloseSession(&Event{fromSessionId: w.SessionId, result: createResCh()})
+	if n := server.running["resize"]; n != 0 || len(server.running) != 0 {
+		t.Errorf("running %v after the worker left", server.running)
+	}
+
+	w = testWorker(server, 3, "resize", 0)
+	for range handles {
+		j := grabJob(server, w)
+		report(server, w, WORK_COMPLETE, j.Handle, "")
+	}
+	if len(server.running) != 0 || len(server.workJobs) != 0 || server.queueSize("resize") != 0 {
+		t.Errorf("running %v, working %v, queued %v", server.running, len(server.workJobs), server.queueSize("resize"))
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	. "common"
+	"errors"
+	"fmt"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+	"utils/logger"
+)
+
+// outcomes a RetryPolicy may retry
+const (
+	RetryOnFail = 1 << iota
+	RetryOnException
+	RetryOnTimeout
+	RetryOnWorkerLost
+)
+
+const (
+	maxRetryBackoff = time.Hour
+	deadQueuePrefix = storage.DeadQueuePrefix //dead letter queue names in a storage backend
+)
+
+var (
+	invalidRetryPolicy = errors.New("invalid retry policy")
+
+	retryOutcomeNames = map[string]int{
+		"fail":      RetryOnFail,
+		"exception": RetryOnException,
+		"timeout":   RetryOnTimeout,
+		"lost":      RetryOnWorkerLost,
+	}
+
+	//without a policy only jobs of lost workers are retried, a job that
+	//keeps taking its workers down goes to the dead letter queue
+	defaultRetryPolicy = &RetryPolicy{MaxAttempts: 5, Backoff: time.Second, Outcomes: RetryOnWorkerLost}
+)
+
+type RetryPolicy struct {
+	MaxAttempts int           //0 means no limit
+	Backoff     time.Duration //delay before the first retry, doubled on every attempt
+	Outcomes    int
+}
+
+func (policy *RetryPolicy) retries(outcome int) bool {
+	return policy.Outcomes&outcome != 0
+}
+
+func (policy *RetryPolicy) exhausted(j *Job) bool {
+	return policy.MaxAttempts > 0 && j.Attempts >= policy.MaxAttempts
+}
+
+func (policy *RetryPolicy) delay(j *Job) time.Duration {
+	if policy.Backoff <= 0 {
+		return 0
+	}
+
+	delay := policy.Backoff
+	for i := 1; i < j.Attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// ParseRetryPolicies reads "func:attempts:backoff:outcome|outcome,..." where
+// outcome is one of fail, exception, timeout and lost, and func "*" sets the
+// policy of all functions without one, e.g. "billing:5:2s:fail|timeout|lost"
+func ParseRetryPolicies(spec string) (map[string]*RetryPolicy, error) {
+	policies := make(map[string]*RetryPolicy)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 4 || parts[0] == "" {
+			return nil, invalidRetryPolicy
+		}
+
+		attempts, err := strconv.Atoi(parts[1])
+		if err != nil || attempts < 0 {
+			return nil, invalidRetryPolicy
+		}
+
+		backoff, err := time.ParseDuration(parts[2])
+		if err != nil || backoff < 0 {
+			return nil, invalidRetryPolicy
+		}
+
+		policy := &RetryPolicy{MaxAttempts: attempts, Backoff: backoff}
+		for _, name := range strings.Split(parts[3], "|") {
+			outcome, ok := retryOutcomeNames[name]
+			if !ok {
+				return nil, invalidRetryPolicy
+			}
+			policy.Outcomes |= outcome
+		}
+
+		policies[parts[0]] = policy
+	}
+
+	return policies, nil
+}
+
+// SetRetryPolicy must be called before Start
+func (server *Server) SetRetryPolicy(funcName string, policy *RetryPolicy) {
+	server.retryPolicies[funcName] = policy
+}
+
+func (server *Server) retryPolicy(funcName string) *RetryPolicy {
+	if policy, ok := server.retryPolicies[funcName]; ok {
+		return policy
+	}
+	if policy, ok := server.retryPolicies[anyFuncName]; ok {
+		return policy
+	}
+	return defaultRetryPolicy
+}
+
+// retryJob takes a running job back from its worker and queues it again if
+// the policy allows, a job out of attempts goes to the dead letter queue and
+// false is returned so the caller finishes it as usual
+func (server *Server) retryJob(j *Job, outcome int, lastError string) bool {
+	policy := server.retryPolicy(j.FuncName)
+	if !policy.retries(outcome) {
+		return false
+	}
+
+	j.LastError = lastError
+	if policy.exhausted(j) {
+		server.deadLetter(j)
+		return false
+	}
+
+	server.removeWorkJob(j)
+
+	delay := policy.delay(j)
+	logger.Logger().I("retry job %v attempts %v delay %v error %v", j.Handle, j.Attempts, delay, lastError)
+	if delay == 0 {
+		server.requeueJob(j)
+		return true
+	}
+
+	j.ProcessBy = 0
+	j.Running = false
+	j.WhenToRun = time.Now().Add(delay)
+	server.delayJobs.add(j, nil)
+	return true
+}
+
+func (server *Server) deadLetter(j *Job) {
+	queue, ok := server.deadJobs[j.FuncName]
+	if !ok {
+		var err error
+		if queue, err = server.newDeadQueue(j.FuncName); err != nil {
+			logger.Logger().E("dead letter job %v lost: %v", j.Handle, err)
+			return
+		}
+		server.deadJobs[j.FuncName] = queue
+	}
+
+	logger.Logger().W("dead letter job %v attempts %v error %v", j.Handle, j.Attempts, j.LastError)
+	j.Running = false
+	j.ProcessBy = 0
+	//its clients get WORK_FAIL now, it is kept as a background job so that
+	//a durable backend keeps it over a restart
+	dead := *j
+	dead.IsBackGround = true
+	dead.Attached = nil
+	if err := queue.PushJob(&dead); err != nil {
+		logger.Logger().E("dead letter job %v lost: %v", j.Handle, err)
+	}
+}
+
+func (server *Server) getDeadJobs(e *Event) {
+	var buffer bytes.Buffer
+	for funcName, queue := range server.deadJobs {
+		buffer.WriteString(showQueue(funcName, queue))
+	}
+
+	e.result <- buffer.String()
+}
+
+// replayDeadJobs queues dead jobs of a function again, all of them or the
+// one named by handle, they run in background. A job that could not be
+// queued stays dead.
+func (server *Server) replayDeadJobs(e *Event) {
+	funcName := e.args.t0.(string)
+	handle := e.args.t1.(string)
+
+	queue, ok := server.deadJobs[funcName]
+	if !ok {
+		e.result <- fmt.Sprintf("no dead jobs of %v", funcName)
+		return
+	}
+
+	replayed := 0
+	var err error
+	for {
+		var j *Job
+		if handle != "" {
+			j, err = queue.RemoveJob(handle)
+		} else if j, err = queue.PopJob(); j != nil && err == nil {
+			_, err = queue.RemoveJob(j.Handle)
+		}
+		if j == nil || err != nil {
+			break
+		}
+
+		replay := *j
+		replay.Attempts = 0
+		replay.LastError = ""
+		replay.IsBackGround = true
+		replay.Attached = nil
+		if err = server.doAddJob(&replay); err != nil {
+			if perr := queue.PushJobFront(j); perr != nil {
+				logger.Logger().E("dead job %v lost: %v", j.Handle, perr)
+				err = fmt.Errorf("%v, dead job %v lost: %v", err, j.Handle, perr)
+			}
+			break
+		}
+		server.addUniqueJob(&replay)
+		replayed++
+
+		if handle != "" {
+			break
+		}
+	}
+
+	logger.Logger().I("replay %v dead jobs of %v", replayed, funcName)
+	if err != nil {
+		logger.Logger().E("replay dead jobs of %v %v", funcName, err)
+		e.result <- fmt.Sprintf("replayed %v, error %v", replayed, err)
+		return
+	}
+	e.result <- fmt.Sprintf("replayed %v", replayed)
+}
+
+func (server *Server) purgeDeadJobs(e *Event) {
+	funcName := e.args.t0.(string)
+
+	purged := 0
+	var err error
+	if queue, ok := server.deadJobs[funcName]; ok {
+		var j *Job
+		for j, err = queue.PopJob(); j != nil && err == nil; j, err = queue.PopJob() {
+			if _, err = queue.RemoveJob(j.Handle); err != nil {
+				break
+			}
+			purged++
+		}
+		if err == nil {
+			err = queue.Close()
+			delete(server.deadJobs, funcName)
+		}
+	}
+
+	logger.Logger().I("purge %v dead jobs of %v", purged, funcName)
+	if err != nil {
+		logger.Logger().E("purge dead jobs of %v %v", funcName, err)
+		e.result <- fmt.Sprintf("purged %v, error %v", purged, err)
+		return
+	}
+	e.result <- fmt.Sprintf("purged %v", purged)
+}
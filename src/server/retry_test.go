@@ -0,0 +1,156 @@
+package server
+
+import (
+	. "common"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetryPolicies(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]*RetryPolicy
+		ok   bool
+	}{
+		{"", map[string]*RetryPolicy{}, true},
+		{"billing:5:2s:fail|timeout|lost", map[string]*RetryPolicy{
+			"billing": {MaxAttempts: 5, Backoff: 2 * time.Second, Outcomes: RetryOnFail | RetryOnTimeout | RetryOnWorkerLost},
+		}, true},
+		{"a:0:0s:exception, *:3:100ms:fail", map[string]*RetryPolicy{
+			"a": {Outcomes: RetryOnException},
+			"*": {MaxAttempts: 3, Backoff: 100 * time.Millisecond, Outcomes: RetryOnFail},
+		}, true},
+		{"a:1:1s", nil, false},
+		{":1:1s:fail", nil, false},
+		{"a:-1:1s:fail", nil, false},
+		{"a:x:1s:fail", nil, false},
+		{"a:1:soon:fail", nil, false},
+		{"a:1:-1s:fail", nil, false},
+		{"a:1:1s:crash", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRetryPolicies(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v, want ok %v", tt.spec, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{Backoff: time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{40, maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := policy.delay(&Job{Attempts: tt.attempts}); got != tt.want {
+			t.Errorf("attempts %v: delay %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	if got := (&RetryPolicy{}).delay(&Job{Attempts: 3}); got != 0 {
+		t.Errorf("no backoff: delay %v", got)
+	}
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	j := &Job{Handle: "H:1", FuncName: "resize", IsBackGround: true, Attempts: 1}
+
+	//a job of a lost worker waits before it runs again
+	if !server.retryJob(j, RetryOnWorkerLost, "worker lost") || server.delayJobs.get(j.Handle) == nil {
+		t.Errorf("lost job not retried later")
+	}
+	server.delayJobs.remove(j.Handle)
+
+	j.Attempts = defaultRetryPolicy.MaxAttempts
+	if server.retryJob(j, RetryOnWorkerLost, "worker lost") {
+		t.Errorf("lost job retried after %v attempts", j.Attempts)
+	}
+	if dead, _ := server.deadJobs["resize"].GetJob(j.Handle); dead == nil {
+		t.Errorf("lost job not dead")
+	}
+
+	if server.retryJob(j, RetryOnFail, "fail") {
+		t.Errorf("failed job retried")
+	}
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	server, addr := startServer(t, func(server *Server) {
+		server.SetRetryPolicy("billing", &RetryPolicy{MaxAttempts: 2, Outcomes: RetryOnFail | RetryOnException})
+	})
+
+	client := dial(t, addr)
+	handle := client.submit(SUBMIT_JOB, "billing", "", "invoice")
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "billing")
+
+	tests := []struct {
+		report []string
+		dead   bool
+	}{
+		{[]string{"fail"}, false},
+		{[]string{"exception", "card declined"}, true},
+	}
+	for i, tt := range tests {
+		if job := worker.grab(); job == nil || job[0] != handle {
+			t.Fatalf("attempt %v: assigned %q", i+1, job)
+		}
+		if tt.report[0] == "fail" {
+			worker.send(WORK_FAIL, handle)
+		} else {
+			worker.send(WORK_EXCEPTION, handle, tt.report[1])
+		}
+		worker.sync()
+
+		dead := ctrl(server, getDeadJobs, nil).(string)
+		if strings.Contains(dead, handle) != tt.dead {
+			t.Errorf("attempt %v: dead jobs %v", i+1, dead)
+		}
+	}
+
+	//the client hears of the job once, when it is dead
+	if got := client.expect(WORK_FAIL); got[0] != handle {
+		t.Errorf("WORK_FAIL %q", got)
+	}
+	if dead := ctrl(server, getDeadJobs, nil).(string); !strings.Contains(dead, `"LastError":"card declined"`) {
+		t.Errorf("dead jobs %v", dead)
+	}
+	if job := worker.grab(); job != nil {
+		t.Errorf("dead job assigned %q", job)
+	}
+
+	if got := ctrl(server, replayDeadJobs, &Tuple{t0: "billing", t1: handle}); got != "replayed 1" {
+		t.Errorf("replay: %v", got)
+	}
+	//a replayed job starts over with its attempts
+	for attempt := 1; attempt <= 2; attempt++ {
+		if job := worker.grab(); job == nil || job[0] != handle {
+			t.Fatalf("replayed attempt %v: assigned %q", attempt, job)
+		}
+		worker.send(WORK_FAIL, handle)
+		worker.sync()
+	}
+
+	if got := ctrl(server, purgeDeadJobs, &Tuple{t0: "billing"}); got != "purged 1" {
+		t.Errorf("purge: %v", got)
+	}
+	if dead := ctrl(server, getDeadJobs, nil).(string); dead != "" {
+		t.Errorf("dead jobs after purge %v", dead)
+	}
+}
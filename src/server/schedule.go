@@ -0,0 +1,370 @@
+package server
+
+import (
+	. "common"
+	"container/heap"
+	"errors"
+	"storage"
+	"strconv"
+	"strings"
+	"time"
+	"utils/logger"
+)
+
+var (
+	invalidSchedule = errors.New("invalid schedule")
+)
+
+const (
+	schedQueuePrefix = storage.SchedQueuePrefix //scheduled job queue names in a storage backend
+)
+
+// cronSpec is the minute, hour, day of month, month and day of week
+// part of SUBMIT_JOB_SCHED, each field holds a bit per allowed value.
+type cronSpec struct {
+	minute uint64
+	hour   uint64
+	mday   uint64
+	month  uint64
+	wday   uint64
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	field = strings.TrimSpace(field)
+	if field == "" || field == "*" {
+		return cronRange(min, max, 1), nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if pos := strings.IndexByte(part, '/'); pos != -1 {
+			n, err := strconv.Atoi(part[pos+1:])
+			if err != nil || n <= 0 {
+				return 0, invalidSchedule
+			}
+			step = n
+			part = part[:pos]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, invalidSchedule
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, invalidSchedule
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, invalidSchedule
+		}
+		bits |= cronRange(lo, hi, step)
+	}
+
+	return bits, nil
+}
+
+func cronRange(lo int, hi int, step int) uint64 {
+	var bits uint64
+	for i := lo; i <= hi; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits
+}
+
+func parseCronSpec(fields []string) (*cronSpec, error) {
+	if len(fields) != 5 {
+		return nil, invalidSchedule
+	}
+
+	spec := &cronSpec{}
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.mday, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.wday, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if spec.wday&(1<<7) != 0 { //7 is sunday as well
+		spec.wday = spec.wday&^(1<<7) | 1
+	}
+
+	return spec, nil
+}
+
+// scheduleOf keeps the fields of a spec in one string, an empty field is "*"
+func scheduleOf(fields []string) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		if parts[i] = strings.TrimSpace(f); parts[i] == "" {
+			parts[i] = "*"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// matchDay follows cron: when both day of month and day of week are
+// restricted, either of them may match.
+func (spec *cronSpec) matchDay(t time.Time) bool {
+	mday := spec.mday&(1<<uint(t.Day())) != 0
+	wday := spec.wday&(1<<uint(t.Weekday())) != 0
+	if spec.mday != cronRange(1, 31, 1) && spec.wday != cronRange(0, 6, 1) {
+		return mday || wday
+	}
+	return mday && wday
+}
+
+// next returns the first minute after t matching the spec, or the zero
+// time if nothing matches within the next five years.
+func (spec *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if spec.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !spec.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if spec.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+type delayItem struct {
+	job   *Job
+	cron  *cronSpec //nil for one shot SUBMIT_JOB_EPOCH jobs
+	index int
+}
+
+type delayHeap []*delayItem
+
+func (h delayHeap) Len() int { return len(h) }
+
+func (h delayHeap) Less(i, j int) bool {
+	return h[i].job.WhenToRun.Before(h[j].job.WhenToRun)
+}
+
+func (h delayHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *delayHeap) Push(x interface{}) {
+	item := x.(*delayItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// delayQueue holds scheduled jobs ordered by WhenToRun until they are due,
+// its timer always fires at the earliest WhenToRun.
+type delayQueue struct {
+	items   delayHeap
+	handles map[string]*delayItem
+	timer   *time.Timer
+}
+
+func newDelayQueue() *delayQueue {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &delayQueue{handles: make(map[string]*delayItem), timer: timer}
+}
+
+func (dq *delayQueue) add(j *Job, cron *cronSpec) {
+	item := &delayItem{job: j, cron: cron}
+	heap.Push(&dq.items, item)
+	dq.handles[j.Handle] = item
+	if item.index == 0 {
+		dq.resetTimer()
+	}
+}
+
+func (dq *delayQueue) get(handle string) *Job {
+	if item, ok := dq.handles[handle]; ok {
+		return item.job
+	}
+	return nil
+}
+
+func (dq *delayQueue) remove(handle string) *Job {
+	item, ok := dq.handles[handle]
+	if !ok {
+		return nil
+	}
+
+	delete(dq.handles, handle)
+	heap.Remove(&dq.items, item.index)
+	dq.resetTimer()
+	return item.job
+}
+
+func (dq *delayQueue) Length() int {
+	return len(dq.items)
+}
+
+// popDue removes every item whose time has come, recurring items are
+// pushed back with their next run time and returned as well.
+func (dq *delayQueue) popDue(now time.Time) []*delayItem {
+	var due []*delayItem
+	for len(dq.items) > 0 && !dq.items[0].job.WhenToRun.After(now) {
+		item := dq.items[0]
+		due = append(due, item)
+		if item.cron != nil {
+			if next := item.cron.next(now); !next.IsZero() {
+				item.job.WhenToRun = next
+				heap.Fix(&dq.items, 0)
+				continue
+			}
+		}
+		heap.Pop(&dq.items)
+		delete(dq.handles, item.job.Handle)
+	}
+
+	dq.resetTimer()
+	return due
+}
+
+func (dq *delayQueue) resetTimer() {
+	if !dq.timer.Stop() {
+		select {
+		case <-dq.timer.C:
+		default:
+		}
+	}
+
+	if len(dq.items) > 0 {
+		dq.timer.Reset(dq.items[0].job.WhenToRun.Sub(time.Now()))
+	}
+}
+
+//addSchedStore opens the queue keeping the scheduled jobs of a function in
+//its storage backend
+func (server *Server) addSchedStore(funcName string) (storage.JobQueue, error) {
+	if queue, ok := server.schedJobs[funcName]; ok {
+		return queue, nil
+	}
+
+	queue, err := server.newSchedQueue(funcName)
+	if err != nil {
+		logger.Logger().E("addSchedStore:%v %v", funcName, err)
+		return nil, err
+	}
+	server.schedJobs[funcName] = queue
+	return queue, nil
+}
+
+//scheduleJob keeps j in delayJobs until it is due. A background job that
+//never ran is pushed to the storage as well so that it survives a restart,
+//retries waiting for their backoff are still in the queue of their function.
+func (server *Server) scheduleJob(j *Job, cron *cronSpec) error {
+	if j.IsBackGround && j.Attempts == 0 {
+		queue, err := server.addSchedStore(j.FuncName)
+		if err != nil {
+			return err
+		}
+		if err := queue.PushJob(j); err != nil {
+			logger.Logger().E("schedule job %v %v", j.Handle, err)
+			return err
+		}
+	}
+
+	server.delayJobs.add(j, cron)
+	return nil
+}
+
+//unscheduleJob takes a job out of delayJobs and the storage, nil if it is
+//not delayed
+func (server *Server) unscheduleJob(handle string) *Job {
+	j := server.delayJobs.remove(handle)
+	if j != nil && j.Attempts == 0 {
+		server.forgetScheduled(j)
+	}
+	return j
+}
+
+//forgetScheduled removes a scheduled job from the storage once it is queued
+//or cancelled
+func (server *Server) forgetScheduled(j *Job) {
+	queue, ok := server.schedJobs[j.FuncName]
+	if !ok {
+		return
+	}
+	if _, err := queue.RemoveJob(j.Handle); err != nil {
+		logger.Logger().E("remove scheduled job %v %v", j.Handle, err)
+	}
+}
+
+//armQueue puts the scheduled jobs a backend kept from the last run back in
+//delayJobs, the ones due meanwhile fire at once and a recurring job goes on
+//with its next run
+func (server *Server) armQueue(queue storage.JobQueue) error {
+	jobs, err := queue.Jobs(0, -1)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, j := range jobs {
+		if server.delayJobs.get(j.Handle) != nil {
+			continue
+		}
+
+		var spec *cronSpec
+		if j.Schedule != "" {
+			if spec, err = parseCronSpec(strings.Fields(j.Schedule)); err != nil {
+				logger.Logger().W("scheduled job %v: schedule %v %v", j.Handle, j.Schedule, err)
+				continue
+			}
+			if j.WhenToRun.Before(now) {
+				if j.WhenToRun = spec.next(now); j.WhenToRun.IsZero() {
+					continue
+				}
+			}
+		}
+
+		j.Attached = nil
+		server.delayJobs.add(j, spec)
+		server.addUniqueJob(j)
+	}
+	return nil
+}
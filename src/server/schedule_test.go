@@ -0,0 +1,266 @@
+package server
+
+import (
+	. "common"
+	"container/heap"
+	"strconv"
+	"storage/wal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 0-6 1,15 * 1-5", true},
+		{"0 0 * * 7", true},
+		{"0 0 * * 0-7", true},
+		{"5/10 * * * *", true},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"* * * * 5-1", false},
+		{"*/0 * * * *", false},
+		{"x * * * *", false},
+		{"* * * *", false},
+	}
+
+	for _, tt := range tests {
+		_, err := parseCronSpec(strings.Split(tt.spec, " "))
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v, want ok %v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	//a wednesday
+	from := time.Date(2026, 10, 14, 10, 30, 20, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 14, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 14, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2026, 10, 15, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)}, //either day field matches
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseCronSpec(strings.Split(tt.spec, " "))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := spec.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestDelayQueuePopDue(t *testing.T) {
+	now := time.Now()
+	dq := newDelayQueue()
+	every, _ := parseCronSpec([]string{"*", "*", "*", "*", "*"})
+
+	dq.add(&Job{Handle: "later", WhenToRun: now.Add(time.Hour)}, nil)
+	dq.add(&Job{Handle: "second", WhenToRun: now.Add(-time.Second)}, nil)
+	dq.add(&Job{Handle: "first", WhenToRun: now.Add(-time.Minute)}, nil)
+	dq.add(&Job{Handle: "cron", WhenToRun: now.Add(-time.Millisecond)}, every)
+
+	var got []string
+	for _, item := range dq.popDue(now) {
+		got = append(got, item.job.Handle)
+	}
+	if strings.Join(got, ",") != "first,second,cron" {
+		t.Errorf("due %v", got)
+	}
+
+	if dq.Length() != 2 || dq.get("cron") == nil || dq.get("first") != nil {
+		t.Errorf("left %v jobs", dq.Length())
+	}
+	if when := dq.get("cron").WhenToRun; !when.After(now) {
+		t.Errorf("cron job not rescheduled: %v", when)
+	}
+
+	if j := dq.remove("later"); j == nil || dq.Length() != 1 {
+		t.Errorf("remove later: %v", j)
+	}
+}
+
+// testClient is a client whose replies are read from its inbox
+func testClient(server *Server, sessionId int64) *Client {
+	c := &Client{Connector: Connector{SessionId: sessionId, in: make(chan []byte, 16), isConnect: true}}
+	server.client[sessionId] = c
+	return c
+}
+
+// replyArgs splits the arguments of a reply packet
+func replyArgs(reply []byte) []string {
+	return strings.Split(string(reply[12:]), "\x00")
+}
+
+func TestCronJobStaysIndexed(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	c := testClient(server, 1)
+
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_SCHED, args: &Tuple{t0: c, t1: []byte("report"),
+		t2: []byte("daily"), t3: []byte{}, t4: [][]byte{[]byte("0"), []byte("0"), []byte("*"), []byte("*"), []byte("*")}}})
+	template := replyArgs(<-c.in)[0]
+
+	for run := 0; run < 2; run++ {
+		item := server.delayJobs.handles[template]
+		item.job.WhenToRun = time.Now().Add(-time.Second)
+		heap.Fix(&server.delayJobs.items, item.index)
+		server.fireDelayJobs()
+
+		j := server.uniqueJobs["daily"]["report"]
+		if j == nil || j.Handle == template {
+			t.Fatalf("run %v: unique id indexes %v", run, j)
+		}
+		if found := server.findUniqueJob("report", "daily"); found != j {
+			t.Errorf("run %v: submits not coalesced onto the run", run)
+		}
+
+		server.removeJob(j)
+		if u := server.delayUniques["daily"]["report"]; u == nil || u.Handle != template {
+			t.Fatalf("run %v: unique id after the run indexes %v", run, u)
+		}
+
+		e := &Event{args: &Tuple{t0: "daily"}, result: createResCh()}
+		server.handleGetStatusUnique(e)
+		if status := (<-e.result).([][]byte); string(status[1]) != "1" {
+			t.Errorf("run %v: GET_STATUS_UNIQUE misses the scheduled job", run)
+		}
+	}
+
+	server.removeUniqueJob(server.delayJobs.remove(template))
+	if len(server.uniqueJobs) != 0 || len(server.delayUniques) != 0 {
+		t.Errorf("left %v unique ids, %v scheduled", len(server.uniqueJobs), len(server.delayUniques))
+	}
+}
+
+func TestDelayedJobKeepsUniqueId(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	c := testClient(server, 1)
+
+	epoch := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_EPOCH, args: &Tuple{t0: c, t1: []byte("report"),
+		t2: []byte("u1"), t3: []byte{}, t4: [][]byte{[]byte(epoch)}}})
+	delayed := replyArgs(<-c.in)[0]
+
+	//a submit of the same unique id is not coalesced onto the scheduled job
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_BG, args: &Tuple{t0: c, t1: []byte("report"),
+		t2: []byte("u1"), t3: []byte{}}})
+	now := replyArgs(<-c.in)[0]
+	if now == delayed {
+		t.Fatalf("coalesced onto the scheduled job")
+	}
+
+	queued, _ := server.jobStores["report"].PopJob()
+	server.removeJob(queued)
+	if u := server.delayUniques["u1"]["report"]; u == nil || u.Handle != delayed {
+		t.Fatalf("scheduled job lost its unique id: %v", u)
+	}
+
+	item := server.delayJobs.handles[delayed]
+	item.job.WhenToRun = time.Now().Add(-time.Second)
+	heap.Fix(&server.delayJobs.items, item.index)
+	server.fireDelayJobs()
+
+	if j := server.findUniqueJob("report", "u1"); j == nil || j.Handle != delayed {
+		t.Errorf("submits not coalesced onto the fired job: %v", j)
+	}
+	if len(server.delayUniques) != 0 {
+		t.Errorf("fired job still indexed as scheduled")
+	}
+	e := &Event{args: &Tuple{t0: "u1"}, result: createResCh()}
+	server.handleGetStatusUnique(e)
+	if status := (<-e.result).([][]byte); string(status[1]) != "1" {
+		t.Errorf("GET_STATUS_UNIQUE misses the fired job")
+	}
+}
+
+// restartWal runs a server on the wal store in dir as a restarted one would
+func restartWal(t *testing.T, dir string) *Server {
+	t.Helper()
+	store, err := wal.Open(dir, wal.Options{Sync: wal.SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(0, 1, false, 16)
+	server.SetStorage(store, nil)
+	if err := server.RestoreQueues(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestScheduledJobsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	server := restartWal(t, dir)
+	c := testClient(server, 1)
+
+	when := time.Now().Add(time.Hour).Truncate(time.Second)
+	submit := func(tp uint32, uniqueId string, when []byte, spec ...string) string {
+		t4 := [][]byte{when}
+		if tp == SUBMIT_JOB_SCHED {
+			t4 = nil
+			for _, f := range spec {
+				t4 = append(t4, []byte(f))
+			}
+		}
+		server.handleSubmitJob(&Event{tp: tp, args: &Tuple{t0: c, t1: []byte("report"),
+			t2: []byte(uniqueId), t3: []byte("data of " + uniqueId), t4: t4}})
+		return replyArgs(<-c.in)[0]
+	}
+	epoch := submit(SUBMIT_JOB_EPOCH, "u-epoch", []byte(strconv.FormatInt(when.Unix(), 10)))
+	cron := submit(SUBMIT_JOB_SCHED, "u-cron", nil, "0", "3", "", "*", "*")
+	cancelled := submit(SUBMIT_JOB_EPOCH, "u-cancelled", []byte(strconv.FormatInt(when.Unix(), 10)))
+	if got := server.adminCancelJob(cancelled); got != adminOK {
+		t.Fatalf("cancel %q", got)
+	}
+
+	//killed, nothing is closed
+	server = restartWal(t, dir)
+	if j := server.delayJobs.get(epoch); j == nil || !j.WhenToRun.Equal(when) || string(j.Data) != "data of u-epoch" {
+		t.Errorf("epoch job restored as %v", j)
+	}
+	if item := server.delayJobs.handles[cron]; item == nil || item.cron == nil || item.job.Schedule != "0 3 * * *" {
+		t.Errorf("recurring job restored as %+v", item)
+	}
+	if j := server.delayJobs.get(cancelled); j != nil {
+		t.Errorf("cancelled job restored %v", j)
+	}
+	if server.delayUniques["u-epoch"]["report"] == nil {
+		t.Errorf("restored epoch job not indexed")
+	}
+
+	//once due it moves to the queue of its function
+	item := server.delayJobs.handles[epoch]
+	item.job.WhenToRun = time.Now().Add(-time.Second)
+	heap.Fix(&server.delayJobs.items, item.index)
+	server.fireDelayJobs()
+
+	server = restartWal(t, dir)
+	if j := server.delayJobs.get(epoch); j != nil {
+		t.Errorf("fired job still scheduled")
+	}
+	if j, _ := server.jobStores["report"].GetJob(epoch); j == nil {
+		t.Errorf("fired job not queued after restart")
+	}
+	if server.delayJobs.get(cron) == nil {
+		t.Errorf("recurring job lost")
+	}
+}
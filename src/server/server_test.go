@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	. "common"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "gearmand-test")
+	if err != nil {
+		panic(err)
+	}
+	logger.Initialize("test", "error", dir+"/")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// startServer runs a server on a free local port, setup configures it
+// before it accepts connections
+func startServer(t *testing.T, setup func(server *Server)) (*Server, string) {
+	server := NewServer(0, 1, false, 1024)
+	if setup != nil {
+		setup(server)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listener = ln
+	go server.EvtLoop()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			session := &Session{}
+			go session.handleConnection(server, conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	return server, ln.Addr().String()
+}
+
+// ctrl runs a ctrl event on the event loop and returns its result
+func ctrl(server *Server, tp uint32, args *Tuple) interface{} {
+	e := &Event{tp: tp, args: args, result: createResCh()}
+	server.protoEvtCh <- e
+	return <-e.result
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func encodePacket(tp uint32, args ...string) []byte {
+	data := strings.Join(args, "\x00")
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, uint32(Req))
+	binary.Write(b, binary.BigEndian, tp)
+	binary.Write(b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(data)
+	return b.Bytes()
+}
+
+func (c *testConn) send(tp uint32, args ...string) {
+	if _, err := c.conn.Write(encodePacket(tp, args...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv returns the next packet, tp 0 when the server closed the connection
+func (c *testConn) recv() (uint32, []string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(c.r, header); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		c.t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(header) != Res {
+		c.t.Fatalf("magic 0x%x", header[:4])
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(header[4:8]), strings.Split(string(data), "\x00")
+}
+
+// expect returns the arguments of the next packet but NOOPs, which must be
+// of type tp
+func (c *testConn) expect(tp uint32) []string {
+	c.t.Helper()
+	for {
+		got, args := c.recv()
+		if got == NOOP && tp != NOOP {
+			continue
+		}
+		if got != tp {
+			c.t.Fatalf("got %v %q, want %v", CmdDescription(got), args, CmdDescription(tp))
+		}
+		return args
+	}
+}
+
+// sync makes sure the event loop handled what was sent before, and that
+// no other packet is waiting on the connection
+func (c *testConn) sync() {
+	c.t.Helper()
+	c.send(GET_STATUS, "sync")
+	c.expect(STATUS_RES)
+}
+
+// submit sends a submit packet and returns the handle of JOB_CREATED
+func (c *testConn) submit(tp uint32, funcName, uniqueId, data string) string {
+	c.t.Helper()
+	c.send(tp, funcName, uniqueId, data)
+	return c.expect(JOB_CREATED)[0]
+}
+
+// grab returns handle, function and data of the next job, nil for NO_JOB
+func (c *testConn) grab() []string {
+	c.t.Helper()
+	c.send(GRAB_JOB)
+	for {
+		tp, args := c.recv()
+		switch tp {
+		case NOOP:
+			continue
+		case NO_JOB:
+			return nil
+		case JOB_ASSIGN:
+			return args
+		}
+		c.t.Fatalf("grab got %v %q", CmdDescription(tp), args)
+	}
+}
+
+// admin sends a text command and returns the reply lines, up to the "."
+// line of a list reply
+func (c *testConn) admin(cmd string, list bool) []string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(cmd + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var lines []string
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if list && line == "." {
+			return lines
+		}
+		lines = append(lines, line)
+		if !list {
+			return lines
+		}
+	}
+}
+
+func TestSubmitVariants(t *testing.T) {
+	tests := []struct {
+		cmd        uint32
+		priority   int
+		background bool
+	}{
+		{SUBMIT_JOB, PRIORITY_NORMAL, false},
+		{SUBMIT_JOB_BG, PRIORITY_NORMAL, true},
+		{SUBMIT_JOB_HIGH, PRIORITY_HIGH, false},
+		{SUBMIT_JOB_HIGH_BG, PRIORITY_HIGH, true},
+		{SUBMIT_JOB_LOW, PRIORITY_LOW, false},
+		{SUBMIT_JOB_LOW_BG, PRIORITY_LOW, true},
+	}
+
+	_, addr := startServer(t, nil)
+	for _, tt := range tests {
+		if p := cmd2Priority(tt.cmd); p != tt.priority {
+			t.Errorf("%v priority %v, want %v", CmdDescription(tt.cmd), p, tt.priority)
+		}
+		if bg := isBackGround(tt.cmd); bg != tt.background {
+			t.Errorf("%v background %v, want %v", CmdDescription(tt.cmd), bg, tt.background)
+		}
+
+		client := dial(t, addr)
+		handle := client.submit(tt.cmd, "reverse", "", "payload")
+
+		worker := dial(t, addr)
+		worker.send(CAN_DO, "reverse")
+		job := worker.grab()
+		if job == nil || job[0] != handle || job[1] != "reverse" || job[2] != "payload" {
+			t.Fatalf("%v assigned %q, want %v", CmdDescription(tt.cmd), job, handle)
+		}
+		worker.send(WORK_COMPLETE, handle, "daolyap")
+		worker.sync()
+
+		if !tt.background {
+			if got := client.expect(WORK_COMPLETE); got[0] != handle || got[1] != "daolyap" {
+				t.Errorf("%v result %q", CmdDescription(tt.cmd), got)
+			}
+		}
+		client.sync()
+	}
+}
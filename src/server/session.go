@@ -3,7 +3,9 @@ package server
 import (
 	"bufio"
 	. "common"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 	"utils/logger"
 )
@@ -21,11 +23,23 @@ func (session *Session) getWorker(sessionId int64, inbox chan []byte, conn net.C
 
 	session.w = &Worker{
 		Conn: conn, status: wsSleep, Connector: Connector{SessionId: sessionId,
-			in: inbox, ConnectAt: time.Now(), isConnect: true}, canDo: make(map[string]bool)}
+			in: inbox, ConnectAt: time.Now(), isConnect: true}, canDo: make(map[string]bool),
+		timeout: make(map[string]int)}
 
 	return session.w
 }
 
+func (session *Session) getClient(sessionId int64, inbox chan []byte, conn net.Conn) *Client {
+	if session.c != nil {
+		return session.c
+	}
+
+	session.c = &Client{Conn: conn, Connector: Connector{SessionId: sessionId, in: inbox,
+		ConnectAt: time.Now(), isConnect: true}}
+
+	return session.c
+}
+
 func (session *Session) handleConnection(server *Server, conn net.Conn) {
 
 	conn.(*net.TCPConn).SetNoDelay(true)
@@ -37,6 +51,7 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 
 	sessionId := server.allocSessionId()
 	inbox := make(chan []byte, 2048)
+	flushed := make(chan bool)
 
 	defer func() {
 		
@@ -57,11 +72,6 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 			cw.SetIsConnect(false)
 		}
 
-		err := conn.Close()
-		if err != nil{
-			logger.Logger().W("close connection error %v, %v", conn, err)
-		}
-
 		close(inbox)
 		
 		if session.w != nil{
@@ -74,25 +84,82 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 			cw1.SetIsConnect(false)
 		}
 
+		//the replies still in the inbox, a last ERROR among them, go out first
+		<-flushed
+		err := conn.Close()
+		if err != nil{
+			logger.Logger().W("close connection error %v, %v", conn, err)
+		}
+
 	}()
 
-	go writer(conn, inbox)
-	r := bufio.NewReaderSize(conn, 1024 * 1024 * 20)
+	go writer(conn, inbox, flushed)
+	r := bufio.NewReaderSize(conn, server.readBufferSize)
 
 	for {
-		tp, buf, err := ReadMessage(r)
+		first, err := r.Peek(1)
 		if err != nil {
 			logger.Logger().W("ReadMessage error sessionId: %v %v", sessionId, err)
 			return
 		}
+		if isTextCommand(first[0]) {
+			line, err := r.ReadSlice('\n')
+			if err != nil {
+				logger.Logger().W("read admin command error sessionId: %v %v", sessionId, err)
+				if err == bufio.ErrBufferFull {
+					sendReplyResult(inbox, []byte(adminError(errLineTooLong, "command line is too long")))
+				}
+				return
+			}
+			e := &Event{tp: adminCommand, fromSessionId: sessionId,
+				args: &Tuple{t0: strings.Fields(string(line))}, result: createResCh()}
+			server.protoEvtCh <- e
+			reply := <-e.result
+			close(e.result)
+			sendReplyResult(inbox, []byte(reply.(string)))
+			continue
+		}
+
+		tp, buf, err := ReadMessage(r, server.maxPacketSize)
+		if err == invalidArg {
+			logger.Logger().W("unknown command sessionId: %v %v", sessionId, tp)
+			sendError(inbox, errUnknownCommand, CmdDescription(tp))
+			continue
+		}
+		if err == unsupportedCmd {
+			logger.Logger().W("unsupported command sessionId: %v %v", sessionId, CmdDescription(tp))
+			sendError(inbox, errUnsupported, CmdDescription(tp)+" is not supported")
+			continue
+		}
+		if err != nil {
+			logger.Logger().W("ReadMessage error sessionId: %v %v", sessionId, err)
+			if err == invalidMagic { //the stream is out of sync, reply before dropping it
+				sendError(inbox, errInvalidMagic, "packet magic must be \\0REQ")
+			} else if err == packetTooLarge {
+				sendError(inbox, errPacketTooLarge, fmt.Sprintf("%s is over %d bytes",
+					CmdDescription(tp), server.maxPacketSize))
+			}
+			return
+		}
 		args, ok := decodeArgs(tp, buf)
 		if !ok {
 			logger.Logger().W("tp:%v argc not match details:%v", CmdDescription(tp), string(buf))
-			return
+			sendError(inbox, errInvalidArgs, fmt.Sprintf("%s expects %d arguments",
+				CmdDescription(tp), ArgCount(tp)))
+			continue
 		}
 
 		logger.Logger().T("sessionId:%v tp:%v", sessionId, CmdDescription(tp))
 
+		//the job data is the last argument of every submit
+		if isSubmitCmd(tp) && server.submitTooLarge(string(args[0]), len(args[len(args)-1])) {
+			logger.Logger().W("sessionId:%v %v of %s data size %v over limit", sessionId, CmdDescription(tp),
+				args[0], len(args[len(args)-1]))
+			sendError(inbox, errPacketTooLarge, fmt.Sprintf("%s data of %s is over %d bytes",
+				CmdDescription(tp), args[0], server.funcMaxPacket[string(args[0])]))
+			return
+		}
+
 		switch tp {
 		case CAN_DO:
 			session.w = session.getWorker(sessionId, inbox, conn)
@@ -105,6 +172,11 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 				t0: session.w, t1: string(args[0]), t2: string(args[1])}}
 			break
 		case CANT_DO:
+			if session.w == nil {
+				logger.Logger().W("can't perform %s, need send CAN_DO first", CmdDescription(tp))
+				sendError(inbox, errUnexpectedCommand, CmdDescription(tp)+" before CAN_DO")
+				break
+			}
 			server.protoEvtCh <- &Event{tp: tp, fromSessionId: sessionId,
 				args: &Tuple{t0: string(args[0])}}
 			break
@@ -115,6 +187,16 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 			session.w = session.getWorker(sessionId, inbox, conn)
 			server.protoEvtCh <- &Event{tp: tp, args: &Tuple{t0: session.w}, fromSessionId: sessionId}
 			break
+		case RESET_ABILITIES:
+			if session.w == nil {
+				break
+			}
+			server.protoEvtCh <- &Event{tp: tp, fromSessionId: sessionId}
+			break
+		case ALL_YOURS:
+			session.w = session.getWorker(sessionId, inbox, conn)
+			server.protoEvtCh <- &Event{tp: tp, args: &Tuple{t0: session.w}, fromSessionId: sessionId}
+			break
 		case SET_CLIENT_ID:
 			session.w = session.getWorker(sessionId, inbox, conn)
 			server.protoEvtCh <- &Event{tp: tp, args: &Tuple{t0: session.w, t1: string(args[0])}}
@@ -122,7 +204,8 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 		case GRAB_JOB, GRAB_JOB_UNIQ:
 			if session.w == nil {
 				logger.Logger().W("can't perform %s, need send CAN_DO first", CmdDescription(tp))
-				return
+				sendError(inbox, errUnexpectedCommand, CmdDescription(tp)+" before CAN_DO")
+				break
 			}
 			e := &Event{tp: tp, fromSessionId: sessionId,
 				result: createResCh()}
@@ -148,28 +231,58 @@ func (session *Session) handleConnection(server *Server, conn net.Conn) {
 					job.(*Job).Data})
 			}
 			break
-		case SUBMIT_JOB, SUBMIT_JOB_LOW_BG, SUBMIT_JOB_LOW:
-			if session.c == nil {
-				session.c = &Client{Conn: conn, Connector: Connector{SessionId: sessionId, in: inbox,
-					ConnectAt: time.Now(), isConnect:true}}
-			}
+		case SUBMIT_JOB, SUBMIT_JOB_BG, SUBMIT_JOB_HIGH, SUBMIT_JOB_HIGH_BG,
+			SUBMIT_JOB_LOW, SUBMIT_JOB_LOW_BG:
+			session.c = session.getClient(sessionId, inbox, conn)
 			e := &Event{tp: tp,
 				args:   &Tuple{t0: session.c, t1: args[0], t2: args[1], t3: args[2]},
 			}
 
 			server.protoEvtCh <- e
 			break
+		case GET_STATUS, GET_STATUS_UNIQUE:
+			session.c = session.getClient(sessionId, inbox, conn)
+			e := &Event{tp: tp, fromSessionId: sessionId,
+				args: &Tuple{t0: string(args[0])}, result: createResCh()}
+			server.protoEvtCh <- e
+			status := <-e.result
+			close(e.result)
+			if tp == GET_STATUS {
+				sendReply(inbox, STATUS_RES, status.([][]byte))
+			} else {
+				sendReply(inbox, STATUS_RES_UNIQUE, status.([][]byte))
+			}
+			break
+		case OPTION_REQ:
+			session.c = session.getClient(sessionId, inbox, conn)
+			server.protoEvtCh <- &Event{tp: tp, fromSessionId: sessionId,
+				args: &Tuple{t0: session.c, t1: string(args[0])}}
+			break
+		case SUBMIT_JOB_EPOCH:
+			session.c = session.getClient(sessionId, inbox, conn)
+			server.protoEvtCh <- &Event{tp: tp,
+				args: &Tuple{t0: session.c, t1: args[0], t2: args[1], t3: args[3], t4: args[2:3]},
+			}
+			break
+		case SUBMIT_JOB_SCHED:
+			session.c = session.getClient(sessionId, inbox, conn)
+			server.protoEvtCh <- &Event{tp: tp,
+				args: &Tuple{t0: session.c, t1: args[0], t2: args[1], t3: args[7], t4: args[2:7]},
+			}
+			break
 		case WORK_DATA, WORK_WARNING, WORK_COMPLETE,
 			WORK_FAIL, WORK_EXCEPTION, WORK_STATUS:
 			if session.w == nil {
 				logger.Logger().W("can't perform %s, need send CAN_DO first", CmdDescription(tp))
-				return
+				sendError(inbox, errUnexpectedCommand, CmdDescription(tp)+" before CAN_DO")
+				break
 			}
 			server.protoEvtCh <- &Event{tp: tp, args: &Tuple{t0: args},
 				fromSessionId: sessionId}
 			break
 		default:
 			logger.Logger().W("not support type %s", CmdDescription(tp))
+			sendError(inbox, errUnknownCommand, "not support "+CmdDescription(tp))
 		}
 	}
 }
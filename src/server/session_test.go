@@ -0,0 +1,118 @@
+package server
+
+import (
+	. "common"
+	"strings"
+	"testing"
+)
+
+func TestErrorReplies(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := dial(t, addr)
+
+	tests := []struct {
+		name string
+		tp   uint32
+		args []string
+		code string
+	}{
+		{"unknown command", 99, []string{"x"}, errUnknownCommand},
+		{"missing arguments", SUBMIT_JOB, []string{"f"}, errInvalidArgs},
+		{"grab before CAN_DO", GRAB_JOB, nil, errUnexpectedCommand},
+		{"CANT_DO before CAN_DO", CANT_DO, []string{"foo"}, errUnexpectedCommand},
+		{"report before CAN_DO", WORK_COMPLETE, []string{"H:x:1", ""}, errUnexpectedCommand},
+		{"bad epoch", SUBMIT_JOB_EPOCH, []string{"f", "", "soon", "x"}, errInvalidEpoch},
+		{"bad schedule", SUBMIT_JOB_SCHED, []string{"f", "", "61", "*", "*", "*", "*", "x"}, errInvalidSchedule},
+	}
+
+	for _, tt := range tests {
+		c.send(tt.tp, tt.args...)
+		if got := c.expect(ERROR); got[0] != tt.code {
+			t.Errorf("%v: ERROR %q, want %v", tt.name, got, tt.code)
+		}
+	}
+
+	//all of them are recoverable
+	c.send(ECHO_REQ, "still there")
+	if got := c.expect(ECHO_RES); got[0] != "still there" {
+		t.Errorf("ECHO_RES %q", got)
+	}
+}
+
+func TestInvalidMagicCloses(t *testing.T) {
+	_, addr := startServer(t, nil)
+	c := dial(t, addr)
+
+	packet := encodePacket(ECHO_REQ, "x")
+	packet[1] = 'X'
+	c.conn.Write(packet)
+
+	if got := c.expect(ERROR); got[0] != errInvalidMagic {
+		t.Errorf("ERROR %q", got)
+	}
+	if tp, _ := c.recv(); tp != 0 {
+		t.Errorf("connection still open, got %v", CmdDescription(tp))
+	}
+}
+
+func TestPacketLimits(t *testing.T) {
+	_, addr := startServer(t, func(server *Server) {
+		server.SetPacketLimits(64, map[string]int{"small": 4}, 0)
+	})
+
+	tests := []struct {
+		name    string
+		tp      uint32
+		args    []string
+		refused bool
+	}{
+		{"data at the function limit", SUBMIT_JOB, []string{"small", "a-long-unique-id", "1234"}, false},
+		{"data over the function limit", SUBMIT_JOB, []string{"small", "", "12345"}, true},
+		{"scheduled data over the function limit", SUBMIT_JOB_EPOCH, []string{"small", "", "1", "12345"}, true},
+		{"function without limit", SUBMIT_JOB_BG, []string{"big", "", "12345"}, false},
+		{"packet over the server limit", SUBMIT_JOB_BG, []string{"big", "", strings.Repeat("x", 64)}, true},
+	}
+
+	for _, tt := range tests {
+		c := dial(t, addr)
+		c.send(tt.tp, tt.args...)
+		if !tt.refused {
+			c.expect(JOB_CREATED)
+			continue
+		}
+
+		if got := c.expect(ERROR); got[0] != errPacketTooLarge {
+			t.Errorf("%v: ERROR %q", tt.name, got)
+		}
+		if tp, _ := c.recv(); tp != 0 {
+			t.Errorf("%v: connection still open, got %v", tt.name, CmdDescription(tp))
+		}
+	}
+}
+
+func TestFatalErrorAfterQueuedReplies(t *testing.T) {
+	_, addr := startServer(t, func(server *Server) {
+		server.SetPacketLimits(64, nil, 0)
+	})
+	c := dial(t, addr)
+
+	//the replies read ahead of the bad packet go out before its ERROR
+	var stream []byte
+	for i := 0; i < 100; i++ {
+		stream = append(stream, encodePacket(ECHO_REQ, "ping")...)
+	}
+	stream = append(stream, encodePacket(SUBMIT_JOB_BG, "big", "", strings.Repeat("x", 64))...)
+	c.conn.Write(stream)
+
+	for i := 0; i < 100; i++ {
+		if got := c.expect(ECHO_RES); got[0] != "ping" {
+			t.Fatalf("ECHO_RES %v %q", i, got)
+		}
+	}
+	if got := c.expect(ERROR); got[0] != errPacketTooLarge {
+		t.Errorf("ERROR %q", got)
+	}
+	if tp, _ := c.recv(); tp != 0 {
+		t.Errorf("connection still open, got %v", CmdDescription(tp))
+	}
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	. "common"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"storage"
+	"time"
+	"utils/logger"
+)
+
+const (
+	snapshotVersion = 1
+)
+
+var (
+	unsupportedSnapshot = errors.New("unsupported snapshot version")
+)
+
+// snapshot holds the background jobs, queued, running and delayed ones.
+// Foreground jobs are left out whether queued or running: their clients
+// are connected to this server and lose the connection with it, nobody
+// would get the result of a foreground job run after the restart, and the
+// clients that submit it again would get it run twice. The dead letter
+// queues are left to their storage backend.
+type snapshot struct {
+	snapshotHead
+	Queues map[string][]*Job //in pop order
+}
+
+// snapshotHead is all of a snapshot but the queues, which are streamed
+type snapshotHead struct {
+	Version   int
+	CreatedAt time.Time
+	Running   []*Job        //jobs workers had, queued again first on load
+	Delayed   []*delayedJob //scheduled jobs and retries waiting for their backoff
+}
+
+// delayedJob is a job of delayJobs, Cron holds the minute, hour, mday,
+// month and wday bits of a recurring one
+type delayedJob struct {
+	Job  *Job
+	Cron []uint64
+}
+
+//SetSnapshotPath must be called before Start, the snapshot is written there
+//on shutdown and on demand, and LoadSnapshot reads it
+func (server *Server) SetSnapshotPath(path string) {
+	server.snapshotPath = path
+}
+
+func (server *Server) buildSnapshotHead() (*snapshotHead, int) {
+	head := &snapshotHead{Version: snapshotVersion, CreatedAt: time.Now()}
+	total := 0
+
+	for _, j := range server.workJobs {
+		if j.IsBackGround {
+			head.Running = append(head.Running, j)
+			total++
+		}
+	}
+
+	for _, item := range server.delayJobs.items {
+		if !item.job.IsBackGround {
+			continue
+		}
+		delayed := &delayedJob{Job: item.job}
+		if spec := item.cron; spec != nil {
+			delayed.Cron = []uint64{spec.minute, spec.hour, spec.mday, spec.month, spec.wday}
+		}
+		head.Delayed = append(head.Delayed, delayed)
+		total++
+	}
+
+	return head, total
+}
+
+// encodeSnapshot writes the queues one job at a time, the data a queue
+// leaves out of its listing is read job by job
+func (server *Server) encodeSnapshot(w *bufio.Writer) (int, error) {
+	head, total := server.buildSnapshotHead()
+	data, err := json.Marshal(head)
+	if err != nil {
+		return 0, err
+	}
+	w.Write(data[:len(data)-1])
+	w.WriteString(`,"Queues":{`)
+
+	queues := 0
+	for funcName, queue := range server.jobStores {
+		jobs, err := queue.Jobs(0, -1)
+		if err != nil {
+			return 0, err
+		}
+		reader, _ := queue.(storage.JobDataReader)
+
+		n := 0
+		for _, j := range jobs {
+			if !j.IsBackGround {
+				continue
+			}
+			if reader != nil && len(j.Data) == 0 {
+				data, err := reader.JobData(j.Handle)
+				if err != nil {
+					return 0, err
+				}
+				withData := *j
+				withData.Data = data
+				j = &withData
+			}
+			body, err := json.Marshal(j)
+			if err != nil {
+				return 0, err
+			}
+
+			if n == 0 {
+				if queues > 0 {
+					w.WriteByte(',')
+				}
+				name, _ := json.Marshal(funcName)
+				w.Write(name)
+				w.WriteString(":[")
+				queues++
+			} else {
+				w.WriteByte(',')
+			}
+			w.Write(body)
+			n++
+		}
+		if n > 0 {
+			w.WriteByte(']')
+		}
+		total += n
+	}
+
+	w.WriteString("}}")
+	return total, nil
+}
+
+// writeSnapshot replaces the snapshot file atomically
+func (server *Server) writeSnapshot() (int, error) {
+	dir := filepath.Dir(server.snapshotPath)
+	f, err := ioutil.TempFile(dir, filepath.Base(server.snapshotPath)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	total, err := server.encodeSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), server.snapshotPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return total, nil
+}
+
+//saveSnapshot writes the snapshot on shutdown, the foreground jobs are not
+//in it, see snapshot
+func (server *Server) saveSnapshot() {
+	if server.snapshotPath == "" {
+		return
+	}
+
+	total, err := server.writeSnapshot()
+	if err != nil {
+		logger.Logger().E("snapshot %v: %v", server.snapshotPath, err)
+		return
+	}
+	logger.Logger().I("snapshot %v: %v jobs", server.snapshotPath, total)
+}
+
+func (server *Server) takeSnapshot(e *Event) {
+	if server.snapshotPath == "" {
+		e.result <- "snapshot disabled"
+		return
+	}
+
+	total, err := server.writeSnapshot()
+	if err != nil {
+		logger.Logger().E("snapshot %v: %v", server.snapshotPath, err)
+		e.result <- fmt.Sprintf("snapshot error %v", err)
+		return
+	}
+
+	logger.Logger().I("snapshot %v: %v jobs", server.snapshotPath, total)
+	e.result <- fmt.Sprintf("snapshot %v jobs", total)
+}
+
+//LoadSnapshot queues the jobs of the snapshot again, must be called before
+//Start and after RestoreQueues, jobs a persistent storage kept are skipped.
+//The file is renamed to .loaded so it is read once.
+func (server *Server) LoadSnapshot() error {
+	if server.snapshotPath == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(server.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	snap := &snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return unsupportedSnapshot
+	}
+
+	loaded := 0
+	for _, jobs := range snap.Queues {
+		for _, j := range jobs {
+			if server.findJob(j.Handle) != nil {
+				continue
+			}
+			j.Attached = nil
+			if err := server.doAddJob(j); err != nil {
+				return err
+			}
+			server.addUniqueJob(j)
+			loaded++
+		}
+	}
+
+	//in reverse, the first one ends up in front
+	for i := len(snap.Running) - 1; i >= 0; i-- {
+		j := snap.Running[i]
+		if server.findJob(j.Handle) != nil {
+			continue
+		}
+		j.Attached = nil
+		j.ProcessBy = 0
+		j.Running = false
+		queue, err := server.addFuncJobStore(j.FuncName)
+		if err != nil {
+			return err
+		}
+		if err := queue.PushJobFront(j); err != nil {
+			return err
+		}
+		server.addUniqueJob(j)
+		loaded++
+	}
+
+	//the ones due meanwhile fire with the first tick of the timer
+	for _, delayed := range snap.Delayed {
+		j := delayed.Job
+		if j == nil || server.findJob(j.Handle) != nil {
+			continue
+		}
+		var spec *cronSpec
+		if c := delayed.Cron; len(c) == 5 {
+			spec = &cronSpec{minute: c[0], hour: c[1], mday: c[2], month: c[3], wday: c[4]}
+		}
+		j.Attached = nil
+		if j.Attempts == 0 {
+			if err := server.scheduleJob(j, spec); err != nil {
+				return err
+			}
+		} else {
+			server.delayJobs.add(j, spec)
+		}
+		server.addUniqueJob(j)
+		loaded++
+	}
+
+	logger.Logger().I("snapshot %v of %v: loaded %v jobs", server.snapshotPath, snap.CreatedAt, loaded)
+	return os.Rename(server.snapshotPath, server.snapshotPath+".loaded")
+}
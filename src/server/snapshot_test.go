@@ -0,0 +1,133 @@
+package server
+
+import (
+	. "common"
+	"os"
+	"path/filepath"
+	"reflect"
+	"storage/spill"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// submit sends a submit of tp with its extra arguments and returns the handle
+func submit(server *Server, c *Client, tp uint32, funcName, uniqueId string, extra ...string) string {
+	var t4 [][]byte
+	for _, arg := range extra {
+		t4 = append(t4, []byte(arg))
+	}
+	server.handleSubmitJob(&Event{tp: tp, args: &Tuple{t0: c, t1: []byte(funcName),
+		t2: []byte(uniqueId), t3: []byte("data"), t4: t4}})
+	return replyArgs(<-c.in)[0]
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	server := NewServer(0, 1, false, 16)
+	server.SetSnapshotPath(path)
+	c := testClient(server, 1)
+
+	running := submitJob(server, c, "resize")
+	normal := submit(server, c, SUBMIT_JOB_BG, "resize", "")
+	high := submit(server, c, SUBMIT_JOB_HIGH_BG, "resize", "u-high")
+	submit(server, c, SUBMIT_JOB, "resize", "")
+	epoch := submit(server, c, SUBMIT_JOB_EPOCH, "resize", "u-epoch", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	sched := submit(server, c, SUBMIT_JOB_SCHED, "report", "", "0", "9", "*", "*", "1-5")
+
+	w := testWorker(server, 2, "resize", 0)
+	if j := grabJob(server, w); j == nil || j.Handle != high {
+		t.Fatalf("grabbed %v, want %v", j, high)
+	}
+	if j := grabJob(server, w); j == nil || j.Handle != running {
+		t.Fatalf("grabbed %v, want %v", j, running)
+	}
+	//a retry waiting for its backoff
+	server.SetRetryPolicy("resize", &RetryPolicy{MaxAttempts: 3, Backoff: time.Hour, Outcomes: RetryOnFail})
+	report(server, w, WORK_FAIL, high)
+
+	if total, err := server.writeSnapshot(); err != nil || total != 5 {
+		t.Fatalf("snapshot of %v jobs, %v", total, err)
+	}
+
+	loaded := NewServer(0, 1, false, 16)
+	loaded.SetSnapshotPath(path)
+	if err := loaded.LoadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".loaded"); err != nil {
+		t.Errorf("snapshot not renamed: %v", err)
+	}
+
+	jobs, _ := loaded.jobStores["resize"].Jobs(0, -1)
+	var queued []string
+	for _, j := range jobs {
+		queued = append(queued, j.Handle)
+	}
+	if want := []string{running, normal}; !reflect.DeepEqual(queued, want) {
+		t.Errorf("queued %v, want %v", queued, want)
+	}
+
+	tests := []struct {
+		name   string
+		handle string
+		cron   bool
+	}{
+		{"epoch", epoch, false},
+		{"sched", sched, true},
+		{"retry", high, false},
+	}
+	for _, tt := range tests {
+		item := loaded.delayJobs.handles[tt.handle]
+		if item == nil {
+			t.Errorf("%v: %v not delayed", tt.name, tt.handle)
+			continue
+		}
+		before := server.delayJobs.handles[tt.handle]
+		if !item.job.WhenToRun.Equal(before.job.WhenToRun) || item.job.Attempts != before.job.Attempts {
+			t.Errorf("%v: loaded %v, saved %v", tt.name, item.job, before.job)
+		}
+		if (item.cron != nil) != tt.cron || tt.cron && !reflect.DeepEqual(item.cron, before.cron) {
+			t.Errorf("%v: cron %+v, saved %+v", tt.name, item.cron, before.cron)
+		}
+	}
+
+	if loaded.delayUniques["u-epoch"]["resize"] == nil || loaded.findUniqueJob("resize", "u-high") == nil {
+		t.Errorf("delayed jobs not indexed by unique id")
+	}
+}
+
+func TestSnapshotSpilledData(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := spill.Open(filepath.Join(dir, "spill"), spill.Options{Threshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(0, 1, false, 16)
+	server.SetStorage(backend, nil)
+	server.SetSnapshotPath(filepath.Join(dir, "snapshot"))
+	c := testClient(server, 1)
+
+	var handles []string
+	for i := 0; i < 3; i++ {
+		handles = append(handles, submitJob(server, c, "resize"))
+	}
+	if stats := server.jobStores["resize"].(*spill.SpillJobQueue).SpillStats(); stats.Jobs != 2 {
+		t.Fatalf("spill stats %+v", stats)
+	}
+	if total, err := server.writeSnapshot(); err != nil || total != 3 {
+		t.Fatalf("snapshot of %v jobs, %v", total, err)
+	}
+
+	loaded := NewServer(0, 1, false, 16)
+	loaded.SetSnapshotPath(filepath.Join(dir, "snapshot"))
+	if err := loaded.LoadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	for _, handle := range handles {
+		j, _ := loaded.jobStores["resize"].PopJob()
+		if j == nil || j.Handle != handle || string(j.Data) != "data" {
+			t.Errorf("loaded %v, want %v with its data", j, handle)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"storage"
+	"strings"
+	"time"
+	"utils/logger"
+)
+
+var (
+	invalidFuncStorage = errors.New("invalid func storage")
+)
+
+// ParseFuncStorage reads "func:backend,func:backend" into a map
+func ParseFuncStorage(spec string) (map[string]string, error) {
+	backends := make(map[string]string)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pos := strings.LastIndexByte(entry, ':')
+		if pos <= 0 || pos == len(entry)-1 {
+			return nil, invalidFuncStorage
+		}
+		backends[entry[:pos]] = entry[pos+1:]
+	}
+
+	return backends, nil
+}
+
+//SetStorage must be called before Start, backend keeps the jobs of all
+//functions but those of funcBackends, the default is memory
+func (server *Server) SetStorage(backend storage.Backend, funcBackends map[string]storage.Backend) {
+	server.backend = backend
+	for funcName, b := range funcBackends {
+		server.funcBackends[funcName] = b
+	}
+}
+
+func (server *Server) backendOf(funcName string) storage.Backend {
+	if b, ok := server.funcBackends[funcName]; ok {
+		return b
+	}
+	return server.backend
+}
+
+func (server *Server) newJobQueue(funcName string) (storage.JobQueue, error) {
+	queue, err := server.backendOf(funcName).Queue(funcName)
+	if err != nil {
+		return nil, err
+	}
+	server.wakeOn(funcName, queue)
+	return queue, nil
+}
+
+//wakeOn lets a queue fetching jobs in the background wake the workers of
+//its function
+func (server *Server) wakeOn(funcName string, queue storage.JobQueue) {
+	if w, ok := queue.(storage.Waker); ok {
+		w.SetWaker(func() {
+			e := &Event{tp: wakeupFunc, args: &Tuple{t0: funcName}}
+			//the event loop may be waiting for the caller
+			go func() { server.protoEvtCh <- e }()
+		})
+	}
+}
+
+func (server *Server) newDeadQueue(funcName string) (storage.JobQueue, error) {
+	return server.backendOf(funcName).Queue(deadQueuePrefix + funcName)
+}
+
+func (server *Server) newSchedQueue(funcName string) (storage.JobQueue, error) {
+	return server.backendOf(funcName).Queue(schedQueuePrefix + funcName)
+}
+
+//RestoreQueues opens the queues the backends kept from the last run, must
+//be called before Start. A queue stays in the backend it was found in even
+//if its function is now configured to another one.
+func (server *Server) RestoreQueues() error {
+	restored := make(map[storage.Backend]bool)
+	backends := append([]storage.Backend{server.backend}, server.funcBackendList()...)
+
+	for _, backend := range backends {
+		if restored[backend] {
+			continue
+		}
+		restored[backend] = true
+
+		names, err := backend.Names()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			funcName, stores := name, server.jobStores
+			if strings.HasPrefix(name, deadQueuePrefix) {
+				funcName, stores = strings.TrimPrefix(name, deadQueuePrefix), server.deadJobs
+			} else if strings.HasPrefix(name, schedQueuePrefix) {
+				funcName, stores = strings.TrimPrefix(name, schedQueuePrefix), server.schedJobs
+			}
+			if server.backendOf(funcName) != backend {
+				logger.Logger().W("queue %v restored from a backend it is not configured to", name)
+			}
+			if _, ok := stores[funcName]; ok {
+				continue
+			}
+
+			queue, err := backend.Queue(name)
+			if err != nil {
+				return err
+			}
+			stores[funcName] = queue
+
+			switch name {
+			case funcName:
+				server.wakeOn(funcName, queue)
+				err = server.indexQueue(queue)
+			case schedQueuePrefix + funcName:
+				err = server.armQueue(queue)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//indexQueue adds the unique ids of restored jobs so submits coalesce to them
+func (server *Server) indexQueue(queue storage.JobQueue) error {
+	jobs, err := queue.Jobs(0, -1)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		server.addUniqueJob(j)
+	}
+	return nil
+}
+
+func (server *Server) funcBackendList() []storage.Backend {
+	backends := make([]storage.Backend, 0, len(server.funcBackends))
+	for _, b := range server.funcBackends {
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+//showQueue prints the stats and the jobs of a queue
+func showQueue(name string, queue storage.JobQueue) string {
+	var buffer bytes.Buffer
+
+	stats := queue.Stats()
+	buffer.WriteString(fmt.Sprintf("%v:%v bytes:%v oldest:%v\n", name, stats.Count, stats.Bytes,
+		stats.OldestAge.Truncate(time.Second)))
+
+	jobs, err := queue.Jobs(0, -1)
+	if err != nil {
+		buffer.WriteString(fmt.Sprintf("error: %v\n", err))
+	}
+	for _, j := range jobs {
+		buffer.WriteString(fmt.Sprintf("%v\n", j))
+	}
+
+	return buffer.String()
+}
+
+//closeQueues releases the storage of all queues when the server stops
+func (server *Server) closeQueues() {
+	for _, stores := range []map[string]storage.JobQueue{server.jobStores, server.deadJobs, server.schedJobs} {
+		for funcName, queue := range stores {
+			if err := queue.Close(); err != nil {
+				logger.Logger().E("close queue %v %v", funcName, err)
+			}
+		}
+	}
+}
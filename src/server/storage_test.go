@@ -0,0 +1,283 @@
+package server
+
+import (
+	. "common"
+	"errors"
+	"reflect"
+	"sort"
+	"storage"
+	"storage/memory"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errTestStorage = errors.New("disk on fire")
+
+// testQueue is a memory queue whose operations can be made to fail
+type testQueue struct {
+	*memory.MemJobQueue
+	pushErr, popErr, removeErr error
+	wake                       func()
+}
+
+func (q *testQueue) SetWaker(wake func()) {
+	q.wake = wake
+}
+
+func (q *testQueue) PushJob(j *Job) error {
+	if q.pushErr != nil {
+		return q.pushErr
+	}
+	return q.MemJobQueue.PushJob(j)
+}
+
+func (q *testQueue) PushJobFront(j *Job) error {
+	if q.pushErr != nil {
+		return q.pushErr
+	}
+	return q.MemJobQueue.PushJobFront(j)
+}
+
+func (q *testQueue) PopJob() (*Job, error) {
+	if q.popErr != nil {
+		return nil, q.popErr
+	}
+	return q.MemJobQueue.PopJob()
+}
+
+func (q *testQueue) RemoveJob(handle string) (*Job, error) {
+	if q.removeErr != nil {
+		return nil, q.removeErr
+	}
+	return q.MemJobQueue.RemoveJob(handle)
+}
+
+// testBackend records the queues it opened, names are the queues it kept
+// from a previous run
+type testBackend struct {
+	queues map[string]*testQueue
+	names  []string
+}
+
+func newTestBackend(names ...string) *testBackend {
+	return &testBackend{queues: make(map[string]*testQueue), names: names}
+}
+
+func (b *testBackend) Queue(name string) (storage.JobQueue, error) {
+	if q, ok := b.queues[name]; ok {
+		return q, nil
+	}
+	q := &testQueue{MemJobQueue: &memory.MemJobQueue{}}
+	q.Initial(name)
+	b.queues[name] = q
+	return q, nil
+}
+
+func (b *testBackend) Names() ([]string, error) {
+	return b.names, nil
+}
+
+func (b *testBackend) opened() []string {
+	names := []string{}
+	for name := range b.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestParseFuncStorage(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{"billing:wal, cache:memory", map[string]string{"billing": "wal", "cache": "memory"}, true},
+		{"ns:billing:sql", map[string]string{"ns:billing": "sql"}, true},
+		{"billing", nil, false},
+		{"billing:", nil, false},
+		{":wal", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseFuncStorage(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.spec, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestFuncBackends(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	defaultBackend, durable := newTestBackend(), newTestBackend()
+	server.SetStorage(defaultBackend, map[string]storage.Backend{"billing": durable})
+	server.SetRetryPolicy("billing", &RetryPolicy{MaxAttempts: 1, Outcomes: RetryOnFail})
+	c := testClient(server, 1)
+
+	submitJob(server, c, "billing")
+	submitJob(server, c, "cache")
+	w := testWorker(server, 2, "billing", 0)
+	report(server, w, WORK_FAIL, grabJob(server, w).Handle)
+
+	if got := defaultBackend.opened(); !reflect.DeepEqual(got, []string{"cache"}) {
+		t.Errorf("default backend queues %v", got)
+	}
+	if got := durable.opened(); !reflect.DeepEqual(got, []string{"billing", deadQueuePrefix + "billing"}) {
+		t.Errorf("billing backend queues %v", got)
+	}
+}
+
+func TestRestoreQueues(t *testing.T) {
+	kept := newTestBackend("resize", deadQueuePrefix+"resize")
+	q, _ := kept.Queue("resize")
+	q.PushJob(&Job{Handle: "H:old:1", Id: "img-1", FuncName: "resize", IsBackGround: true})
+	dead, _ := kept.Queue(deadQueuePrefix + "resize")
+	dead.PushJob(&Job{Handle: "H:old:2", FuncName: "resize", IsBackGround: true})
+
+	server := NewServer(0, 1, false, 16)
+	server.SetStorage(kept, nil)
+	if err := server.RestoreQueues(); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.jobStores["resize"] != q || server.deadJobs["resize"] != dead {
+		t.Errorf("restored %v and dead %v", server.jobStores, server.deadJobs)
+	}
+	//a submit of a restored unique id coalesces onto the old job
+	c := testClient(server, 1)
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_BG, args: &Tuple{t0: c, t1: []byte("resize"),
+		t2: []byte("img-1"), t3: []byte("data")}})
+	if handle := replyArgs(<-c.in)[0]; handle != "H:old:1" {
+		t.Errorf("submit of a restored unique id got %v", handle)
+	}
+}
+
+func TestStorageErrors(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	backend := newTestBackend()
+	server.SetStorage(backend, nil)
+	c := testClient(server, 1)
+	handle := submitJob(server, c, "resize")
+	queue := backend.queues["resize"]
+
+	//a failed push is reported to the submitter and not indexed
+	queue.pushErr = errTestStorage
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_BG, args: &Tuple{t0: c, t1: []byte("resize"),
+		t2: []byte("img-2"), t3: []byte("data")}})
+	if reply := <-c.in; replyType(reply) != ERROR || replyArgs(reply)[0] != errStorage {
+		t.Errorf("failed push replied %q", replyArgs(reply))
+	}
+	if server.findUniqueJob("resize", "img-2") != nil {
+		t.Errorf("failed job indexed")
+	}
+
+	//a unique id the storage holds for a job this server does not know of
+	queue.pushErr = storage.ErrDuplicateUnique
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB, args: &Tuple{t0: c, t1: []byte("resize"),
+		t2: []byte("img-3"), t3: []byte("data")}})
+	if reply := <-c.in; replyType(reply) != ERROR || replyArgs(reply)[0] != errJobExists {
+		t.Errorf("duplicate push replied %q", replyArgs(reply))
+	}
+	queue.pushErr = nil
+
+	//a failed pop leaves the job queued
+	queue.popErr = errTestStorage
+	w := testWorker(server, 2, "resize", 0)
+	if j := grabJob(server, w); j != nil {
+		t.Errorf("grab with a failing queue got %v", j)
+	}
+	if j, _ := queue.GetJob(handle); j == nil {
+		t.Errorf("job lost by a failed pop")
+	}
+
+	queue.removeErr = errTestStorage
+	if got := server.adminCancelJob(handle); got != adminError(errStorage, errTestStorage.Error()) {
+		t.Errorf("cancel with a failing queue: %q", got)
+	}
+}
+
+func TestDeadJobsKept(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	backend := newTestBackend()
+	server.SetStorage(backend, nil)
+	queue, _ := server.addFuncJobStore("resize")
+
+	//a foreground job is kept as a background one, so it is persisted
+	server.deadLetter(&Job{Handle: "H:1", FuncName: "resize", Attempts: 3, LastError: "boom", CreateBy: 1})
+	dead := backend.queues[deadQueuePrefix+"resize"]
+	if j, _ := dead.GetJob("H:1"); j == nil || !j.IsBackGround {
+		t.Fatalf("dead job %+v", j)
+	}
+
+	replay := func() string {
+		e := &Event{args: &Tuple{t0: "resize", t1: ""}, result: createResCh()}
+		server.replayDeadJobs(e)
+		return (<-e.result).(string)
+	}
+
+	queue.(*testQueue).pushErr = errTestStorage
+	if got := replay(); got != "replayed 0, error "+errTestStorage.Error() {
+		t.Errorf("failed replay: %v", got)
+	}
+	if j, _ := dead.GetJob("H:1"); j == nil || j.Attempts != 3 || j.LastError != "boom" {
+		t.Errorf("dead job after a failed replay %+v", j)
+	}
+
+	//the job cannot be put back either
+	dead.pushErr = errTestStorage
+	if got := replay(); !strings.Contains(got, "dead job H:1 lost") {
+		t.Errorf("lost replay: %v", got)
+	}
+}
+
+func TestUniqueJobsOfOtherServers(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	backend := newTestBackend()
+	server.SetStorage(backend, nil)
+	queue, _ := server.addFuncJobStore("resize")
+
+	//pushed to the shared storage by another server
+	queue.PushJob(&Job{Handle: "H:other:1", Id: "img-9", FuncName: "resize", IsBackGround: true,
+		CreateAt: time.Now()})
+
+	c := testClient(server, 1)
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_BG, args: &Tuple{t0: c, t1: []byte("resize"),
+		t2: []byte("img-9"), t3: []byte("data")}})
+	if handle := replyArgs(<-c.in)[0]; handle != "H:other:1" {
+		t.Errorf("background submit not coalesced, got %v", handle)
+	}
+	if n := queue.Length(); n != 1 {
+		t.Errorf("%v jobs queued", n)
+	}
+
+	e := &Event{args: &Tuple{t0: "img-9"}, result: createResCh()}
+	server.handleGetStatusUnique(e)
+	if status := (<-e.result).([][]byte); string(status[1]) != "1" || string(status[2]) != "0" {
+		t.Errorf("GET_STATUS_UNIQUE %q", status)
+	}
+}
+
+func TestQueueWakesWorkers(t *testing.T) {
+	backend := newTestBackend()
+	_, addr := startServer(t, func(server *Server) { server.SetStorage(backend, nil) })
+	w := dial(t, addr)
+	w.send(CAN_DO, "resize")
+	w.send(PRE_SLEEP)
+	w.sync()
+
+	//a job the queue fetched in the background
+	queue := backend.queues["resize"]
+	queue.MemJobQueue.PushJob(&Job{Handle: "H:other:1", FuncName: "resize", IsBackGround: true,
+		CreateAt: time.Now()})
+	queue.wake()
+	w.expect(NOOP)
+	if job := w.grab(); job == nil || job[0] != "H:other:1" {
+		t.Errorf("grab after the wakeup got %q", job)
+	}
+}
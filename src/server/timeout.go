@@ -0,0 +1,96 @@
+package server
+
+import (
+	. "common"
+	"errors"
+	"time"
+	"utils/logger"
+)
+
+// what happens to a job its worker did not finish within CAN_DO_TIMEOUT
+const (
+	TimeoutFail    = iota //clients get WORK_FAIL
+	TimeoutRequeue        //queued again ahead of new work, without limit
+	TimeoutRetry          //retried as the function's RetryPolicy says, failed otherwise
+)
+
+const (
+	//how long a late report of a timed out job is answered with ERROR
+	tombstoneTTL = 10 * time.Minute
+)
+
+var (
+	invalidTimeoutAction = errors.New("invalid timeout action")
+
+	timeoutActionNames = map[string]int{
+		"fail":    TimeoutFail,
+		"requeue": TimeoutRequeue,
+		"retry":   TimeoutRetry,
+	}
+)
+
+func ParseTimeoutAction(name string) (int, error) {
+	action, ok := timeoutActionNames[name]
+	if !ok {
+		return 0, invalidTimeoutAction
+	}
+	return action, nil
+}
+
+// a handle the worker lost by timing out
+type tombstone struct {
+	handle    string
+	sessionId int64
+}
+
+// SetTimeoutAction must be called before Start, leaseOnStatus lets a
+// WORK_STATUS from the worker restart the job's timeout
+func (server *Server) SetTimeoutAction(action int, leaseOnStatus bool) {
+	server.timeoutAction = action
+	server.leaseOnStatus = leaseOnStatus
+}
+
+func (server *Server) timeoutJob(j *Job) {
+	logger.Logger().I("time out job %v action %v", j, server.timeoutAction)
+
+	server.tombstones[tombstone{j.Handle, j.ProcessBy}] = time.Now().Add(tombstoneTTL)
+
+	switch server.timeoutAction {
+	case TimeoutRequeue:
+		server.removeWorkJob(j)
+		server.requeueJob(j)
+		return
+	case TimeoutRetry:
+		if server.retryJob(j, RetryOnTimeout, "timeout") {
+			return
+		}
+	}
+
+	reply := constructReply(WORK_FAIL, [][]byte{[]byte(j.Handle)})
+	for _, c := range server.jobClients(j) {
+		c.Send(reply)
+	}
+	server.removeJob(j)
+}
+
+// isTombstoned tells if a report comes from a worker that timed out on the job
+func (server *Server) isTombstoned(handle string, sessionId int64) bool {
+	_, ok := server.tombstones[tombstone{handle, sessionId}]
+	return ok
+}
+
+func (server *Server) clearTombstones(now time.Time) {
+	for t, expire := range server.tombstones {
+		if now.After(expire) {
+			delete(server.tombstones, t)
+		}
+	}
+}
+
+func (server *Server) clearWorkerTombstones(sessionId int64) {
+	for t := range server.tombstones {
+		if t.sessionId == sessionId {
+			delete(server.tombstones, t)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	. "common"
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testWorker registers a worker for funcName, timeout 0 sends a plain CAN_DO
+func testWorker(server *Server, sessionId int64, funcName string, timeout int) *Worker {
+	w := &Worker{Connector: Connector{SessionId: sessionId, in: make(chan []byte, 16), isConnect: true},
+		status: wsSleep, canDo: make(map[string]bool), timeout: make(map[string]int)}
+	canDo(server, w, funcName, timeout)
+	return w
+}
+
+func canDo(server *Server, w *Worker, funcName string, timeout int) {
+	if timeout == 0 {
+		server.handleProtoEvt(&Event{tp: CAN_DO, args: &Tuple{t0: w, t1: funcName}})
+		return
+	}
+	server.handleProtoEvt(&Event{tp: CAN_DO_TIMEOUT, args: &Tuple{t0: w, t1: funcName, t2: strconv.Itoa(timeout)}})
+}
+
+// submitJob queues a background job and returns its handle
+func submitJob(server *Server, c *Client, funcName string) string {
+	server.handleSubmitJob(&Event{tp: SUBMIT_JOB_BG, args: &Tuple{t0: c, t1: []byte(funcName),
+		t2: []byte{}, t3: []byte("data")}})
+	return replyArgs(<-c.in)[0]
+}
+
+func grabJob(server *Server, w *Worker) *Job {
+	e := &Event{tp: GRAB_JOB, fromSessionId: w.SessionId, result: createResCh()}
+	server.handleProtoEvt(e)
+	j, _ := (<-e.result).(*Job)
+	return j
+}
+
+// report sends a work report of w
+func report(server *Server, w *Worker, tp uint32, args ...string) {
+	var slice [][]byte
+	for _, arg := range args {
+		slice = append(slice, []byte(arg))
+	}
+	server.handleProtoEvt(&Event{tp: tp, fromSessionId: w.SessionId, args: &Tuple{t0: slice}})
+}
+
+// replyType returns the packet type of a reply
+func replyType(reply []byte) uint32 {
+	return binary.BigEndian.Uint32(reply[4:8])
+}
+
+// nextReply returns the next reply in the inbox but NOOPs, nil if none
+func nextReply(in chan []byte) []byte {
+	for len(in) > 0 {
+		if reply := <-in; replyType(reply) != NOOP {
+			return reply
+		}
+	}
+	return nil
+}
+
+func TestCanDoTimeoutPerWorker(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	c := testClient(server, 1)
+	limited := testWorker(server, 2, "resize", 5)
+	plain := testWorker(server, 3, "resize", 0)
+	//a later plain CAN_DO of another worker keeps the timeout of the first
+	canDo(server, plain, "resize", 0)
+
+	tests := []struct {
+		w    *Worker
+		want int
+	}{
+		{limited, 5},
+		{plain, 0},
+	}
+	for _, tt := range tests {
+		submitJob(server, c, "resize")
+		if j := grabJob(server, tt.w); j == nil || j.TimeoutSec != tt.want {
+			t.Errorf("worker %v: job %v, want timeout %v", tt.w.SessionId, j, tt.want)
+		}
+	}
+}
+
+func TestTimeoutCountsFromProcessAt(t *testing.T) {
+	server := NewServer(0, 1, false, 16)
+	c := testClient(server, 1)
+	w := testWorker(server, 2, "resize", 5)
+
+	handle := submitJob(server, c, "resize")
+	j := grabJob(server, w)
+
+	//time spent queued does not count
+	j.CreateAt = time.Now().Add(-time.Hour)
+	server.clearTimeoutJob()
+	if _, ok := server.workJobs[handle]; !ok {
+		t.Fatalf("job timed out by its queue wait")
+	}
+
+	j.ProcessAt = time.Now().Add(-6 * time.Second)
+	j.LeaseAt = j.ProcessAt
+	server.clearTimeoutJob()
+	if _, ok := server.workJobs[handle]; ok {
+		t.Errorf("job still running after its timeout")
+	}
+}
+
+func TestParseTimeoutAction(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+		ok   bool
+	}{
+		{"fail", TimeoutFail, true},
+		{"requeue", TimeoutRequeue, true},
+		{"retry", TimeoutRetry, true},
+		{"ignore", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeoutAction(tt.name)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: %v %v", tt.name, got, err)
+		}
+	}
+}
+
+// expireJob makes the running job j time out on the next sweep
+func expireJob(server *Server, j *Job) {
+	j.LeaseAt = time.Now().Add(-time.Duration(j.TimeoutSec+1) * time.Second)
+	server.clearTimeoutJob()
+}
+
+func TestTimeoutActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  int
+		policy  *RetryPolicy
+		requeue bool
+	}{
+		{"fail", TimeoutFail, nil, false},
+		{"requeue", TimeoutRequeue, nil, true},
+		{"retry", TimeoutRetry, &RetryPolicy{MaxAttempts: 2, Outcomes: RetryOnTimeout}, true},
+		{"retry without policy", TimeoutRetry, nil, false},
+		{"retry out of attempts", TimeoutRetry, &RetryPolicy{MaxAttempts: 1, Outcomes: RetryOnTimeout}, false},
+	}
+
+	for _, tt := range tests {
+		server := NewServer(0, 1, false, 16)
+		server.SetTimeoutAction(tt.action, false)
+		if tt.policy != nil {
+			server.SetRetryPolicy("resize", tt.policy)
+		}
+		c := testClient(server, 1)
+		slow := testWorker(server, 2, "resize", 5)
+		other := testWorker(server, 3, "resize", 0)
+
+		server.handleSubmitJob(&Event{tp: SUBMIT_JOB, args: &Tuple{t0: c, t1: []byte("resize"),
+			t2: []byte{}, t3: []byte("data")}})
+		handle := replyArgs(<-c.in)[0]
+		expireJob(server, grabJob(server, slow))
+
+		j := grabJob(server, other)
+		if (j != nil && j.Handle == handle) != tt.requeue {
+			t.Errorf("%v: job after timeout %v", tt.name, j)
+		}
+		if reply := nextReply(c.in); (reply != nil && replyType(reply) == WORK_FAIL) == tt.requeue {
+			t.Errorf("%v: client got %q", tt.name, reply)
+		}
+
+		//the late result of the timed out worker is refused
+		report(server, slow, WORK_COMPLETE, handle, "late")
+		if reply := nextReply(slow.in); reply == nil || replyType(reply) != ERROR || replyArgs(reply)[0] != errJobTimedOut {
+			t.Errorf("%v: late report got %q", tt.name, reply)
+		}
+		if tt.requeue {
+			if _, ok := server.workJobs[handle]; !ok {
+				t.Errorf("%v: late report ended the requeued job", tt.name)
+			}
+		}
+	}
+}
+
+func TestStatusExtendsLease(t *testing.T) {
+	tests := []struct {
+		leaseOnStatus bool
+		running       bool
+	}{
+		{true, true},
+		{false, false},
+	}
+
+	for _, tt := range tests {
+		server := NewServer(0, 1, false, 16)
+		server.SetTimeoutAction(TimeoutFail, tt.leaseOnStatus)
+		c := testClient(server, 1)
+		w := testWorker(server, 2, "resize", 5)
+
+		handle := submitJob(server, c, "resize")
+		j := grabJob(server, w)
+		j.LeaseAt = time.Now().Add(-6 * time.Second)
+		report(server, w, WORK_STATUS, handle, "1", "2")
+		server.clearTimeoutJob()
+
+		if _, ok := server.workJobs[handle]; ok != tt.running {
+			t.Errorf("lease on status %v: running %v", tt.leaseOnStatus, ok)
+		}
+	}
+}
@@ -3,20 +3,56 @@ package server
 import (
 	"bytes"
 	"common"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 	"utils/logger"
 )
 
 var (
-	invalidMagic = errors.New("invalid magic")
-	invalidArg   = errors.New("invalid argument")
+	invalidMagic   = errors.New("invalid magic")
+	invalidArg     = errors.New("invalid argument")
+	unsupportedCmd = errors.New("unsupported command")
+	packetTooLarge = errors.New("packet too large")
+	invalidLimits  = errors.New("invalid func limits")
+)
+
+const (
+	DefaultMaxPacketSize  = 1024 * 1024 * 20
+	DefaultReadBufferSize = 1024 * 64
+	DefaultDrainTimeout   = time.Minute
+
+	//per function settings under this name apply to all other functions
+	anyFuncName = "*"
+)
+
+//error codes sent back in ERROR packets
+const (
+	errInvalidMagic      = "INVALID_MAGIC"
+	errUnknownCommand    = "UNKNOWN_COMMAND"
+	errUnsupported       = "UNSUPPORTED_COMMAND"
+	errInvalidArgs       = "INVALID_ARGUMENTS"
+	errUnexpectedCommand = "UNEXPECTED_COMMAND"
+	errUnknownOption     = "UNKNOWN_OPTION"
+	errInvalidEpoch      = "INVALID_EPOCH"
+	errInvalidSchedule   = "INVALID_SCHEDULE"
+	errQueueFull         = "QUEUE_FULL"
+	errJobTimedOut       = "JOB_TIMED_OUT"
+	errJobNotOwned       = "JOB_NOT_OWNED"
+	errPacketTooLarge    = "PACKET_TOO_LARGE"
+	errLineTooLong       = "LINE_TOO_LONG"
+	errStorage           = "STORAGE_ERROR"
+	errJobExists         = "JOB_EXISTS"
+	errShuttingDown      = "SHUTTING_DOWN"
 )
 
 const (
@@ -26,28 +62,66 @@ const (
 	getWorkerStatus
 	getClientStatus
 	removeJob
+	adminCommand
+	getDeadJobs
+	replayDeadJobs
+	purgeDeadJobs
+	takeSnapshot
+	wakeupFunc
 )
 
 var (
-	startJid  int64 = 0
-	respMagic       = []byte(common.ResStr)
+	respMagic = []byte(common.ResStr)
+
+	//handles are H:<node>:<boot nonce>-<counter>
+	jidCounter uint64 = 0
+	jidPrefix  string
+	jidNode    string
+)
+
+const (
+	//keeps handles within the 64 bytes the protocol allows
+	maxNodeIdLength = 31
 )
 
 func validProtocolDef() {
-	if common.CAN_DO != 1 || common.SUBMIT_JOB_EPOCH != 36 { //protocol check
+	if common.CAN_DO != 1 || common.SUBMIT_JOB_EPOCH != 36 ||
+		common.STATUS_RES_UNIQUE != 42 { //protocol check
 		panic("protocol define not match")
 	}
 }
 
-func genJid() string {
+//SetNodeId names this server in job handles, it must be called before Start
+func SetNodeId(nodeId string) {
+	nodeId = strings.Replace(nodeId, ":", "_", -1)
+	if len(nodeId) > maxNodeIdLength {
+		nodeId = nodeId[:maxNodeIdLength]
+	}
 
-	if startJid >= 4294967296 {
-		startJid = 1
-	} else {
-		startJid++
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		binary.BigEndian.PutUint32(nonce, uint32(time.Now().UnixNano()))
 	}
 
-	return strconv.FormatInt(startJid, 10)
+	jidNode = nodeId
+	jidPrefix = fmt.Sprintf("%s%s:%x-", common.JobPrefix, nodeId, nonce)
+}
+
+//NodeId returns the node id of the job handles
+func NodeId() string {
+	return jidNode
+}
+
+func defaultNodeId() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "gearmand"
+	}
+	return hostname
+}
+
+func genJid() string {
+	return jidPrefix + strconv.FormatUint(atomic.AddUint64(&jidCounter, 1), 10)
 }
 
 func allocJobId() string {
@@ -129,12 +203,40 @@ func sendReply(out chan []byte, tp uint32, data [][]byte) {
 	out <- constructReply(tp, data)
 }
 
+func constructError(code string, msg string) []byte {
+	return constructReply(common.ERROR, [][]byte{[]byte(code), []byte(msg)})
+}
+
+func sendError(out chan []byte, code string, msg string) {
+	out <- constructError(code, msg)
+}
+
 func sendReplyResult(out chan []byte, data []byte) {
 	out <- data
 }
 
+//requestCmds are the packets clients and workers may send
+var requestCmds = map[uint32]bool{
+	common.CAN_DO: true, common.CANT_DO: true, common.RESET_ABILITIES: true,
+	common.PRE_SLEEP: true, common.SUBMIT_JOB: true, common.GRAB_JOB: true,
+	common.WORK_STATUS: true, common.WORK_COMPLETE: true, common.WORK_FAIL: true,
+	common.GET_STATUS: true, common.ECHO_REQ: true, common.SUBMIT_JOB_BG: true,
+	common.SUBMIT_JOB_HIGH: true, common.SET_CLIENT_ID: true, common.CAN_DO_TIMEOUT: true,
+	common.ALL_YOURS: true, common.WORK_EXCEPTION: true, common.OPTION_REQ: true,
+	common.WORK_DATA: true, common.WORK_WARNING: true, common.GRAB_JOB_UNIQ: true,
+	common.SUBMIT_JOB_HIGH_BG: true, common.SUBMIT_JOB_LOW: true, common.SUBMIT_JOB_LOW_BG: true,
+	common.SUBMIT_JOB_SCHED: true, common.SUBMIT_JOB_EPOCH: true, common.GET_STATUS_UNIQUE: true,
+}
+
+//unsupportedCmds are the gearmand extension requests this server does not
+//implement, they are answered apart from unknown packets
+var unsupportedCmds = map[uint32]bool{
+	common.SUBMIT_REDUCE_JOB: true, common.SUBMIT_REDUCE_JOB_BACKGROUND: true,
+	common.GRAB_JOB_ALL: true,
+}
+
 func validCmd(cmd uint32) bool {
-	if cmd >= common.CAN_DO && cmd <= common.SUBMIT_JOB_EPOCH {
+	if requestCmds[cmd] {
 		return true
 	}
 
@@ -143,6 +245,31 @@ func validCmd(cmd uint32) bool {
 	return false
 }
 
+//ParseFuncLimits reads "func:n,func:n" into a map
+func ParseFuncLimits(spec string) (map[string]int, error) {
+	limits := make(map[string]int)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pos := strings.LastIndexByte(entry, ':')
+		if pos <= 0 {
+			return nil, invalidLimits
+		}
+
+		n, err := strconv.Atoi(entry[pos+1:])
+		if err != nil || n < 0 {
+			return nil, invalidLimits
+		}
+		limits[entry[:pos]] = n
+	}
+
+	return limits, nil
+}
+
 func bytes2str(o interface{}) string {
 	return string(o.([]byte))
 }
@@ -159,8 +286,17 @@ func int2bytes(n interface{}) []byte {
 	return []byte(strconv.Itoa(n.(int)))
 }
 
-func ReadMessage(r io.Reader) (uint32, []byte, error) {
+//ReadMessage reads one binary packet, a body larger than maxSize is left
+//unread and packetTooLarge returned
+func ReadMessage(r io.Reader, maxSize uint32) (uint32, []byte, error) {
 	_, tp, size, err := readHeader(r)
+	if err == invalidArg || err == unsupportedCmd { //skip the body so the stream stays usable
+		logger.Logger().I("%v %d", err, tp)
+		if _, skipErr := io.CopyN(ioutil.Discard, r, int64(size)); skipErr != nil {
+			return tp, nil, skipErr
+		}
+		return tp, nil, err
+	}
 	if err != nil {
 		logger.Logger().I("%v", err)
 		return 0, nil, err
@@ -170,6 +306,11 @@ func ReadMessage(r io.Reader) (uint32, []byte, error) {
 		return tp, nil, nil
 	}
 
+	if size > maxSize {
+		logger.Logger().W("%v size %v over max %v", common.CmdDescription(tp), size, maxSize)
+		return tp, nil, packetTooLarge
+	}
+
 	buf := make([]byte, size)
 	_, err = io.ReadFull(r, buf)
 
@@ -193,18 +334,24 @@ func readHeader(r io.Reader) (magic uint32, tp uint32, size uint32, err error) {
 		return
 	}
 
-	if !validCmd(tp) {
-		err = invalidArg
+	size, err = readUint32(r)
+	if err != nil {
 		return
 	}
 
-	size, err = readUint32(r)
+	if unsupportedCmds[tp] {
+		err = unsupportedCmd
+	} else if !validCmd(tp) {
+		err = invalidArg
+	}
 
 	return
 }
 
-func writer(conn net.Conn, outbox chan []byte) {
+//writer sends what is put in outbox until it is closed, then closes flushed
+func writer(conn net.Conn, outbox chan []byte, flushed chan bool) {
 	defer func() {
+		close(flushed)
 		//fmt.Printf("writer: %v close over1\n", conn)
 		logger.Logger().I("writer goroute close %v", conn)
 		/*err := conn.Close()
@@ -264,14 +411,27 @@ func cmd2Priority(cmd uint32) int {
 	switch cmd {
 	case common.SUBMIT_JOB_HIGH, common.SUBMIT_JOB_HIGH_BG:
 		return common.PRIORITY_HIGH
+	case common.SUBMIT_JOB_LOW, common.SUBMIT_JOB_LOW_BG:
+		return common.PRIORITY_LOW
 	}
 
-	return common.PRIORITY_LOW
+	return common.PRIORITY_NORMAL
+}
+
+func isSubmitCmd(cmd uint32) bool {
+	switch cmd {
+	case common.SUBMIT_JOB, common.SUBMIT_JOB_BG, common.SUBMIT_JOB_HIGH, common.SUBMIT_JOB_HIGH_BG,
+		common.SUBMIT_JOB_LOW, common.SUBMIT_JOB_LOW_BG, common.SUBMIT_JOB_EPOCH, common.SUBMIT_JOB_SCHED:
+		return true
+	}
+
+	return false
 }
 
 func isBackGround(cmd uint32) bool {
 	switch cmd {
-	case common.SUBMIT_JOB_LOW_BG, common.SUBMIT_JOB_HIGH_BG:
+	case common.SUBMIT_JOB_BG, common.SUBMIT_JOB_LOW_BG, common.SUBMIT_JOB_HIGH_BG,
+		common.SUBMIT_JOB_EPOCH, common.SUBMIT_JOB_SCHED:
 		return true
 	}
 
@@ -280,4 +440,5 @@ func isBackGround(cmd uint32) bool {
 
 func init() {
 	validProtocolDef()
+	SetNodeId(defaultNodeId())
 }
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	. "common"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	badMagic := encodePacket(ECHO_REQ, "x")
+	badMagic[1] = 'X'
+
+	tests := []struct {
+		name   string
+		stream []byte
+		tp     uint32
+		body   string
+		err    error
+	}{
+		{"packet", encodePacket(SUBMIT_JOB, "f", "", "data"), SUBMIT_JOB, "f\x00\x00data", nil},
+		{"empty body", encodePacket(GRAB_JOB), GRAB_JOB, "", nil},
+		{"at max size", encodePacket(ECHO_REQ, "0123456789"), ECHO_REQ, "0123456789", nil},
+		{"over max size", encodePacket(ECHO_REQ, "0123456789a"), ECHO_REQ, "", packetTooLarge},
+		{"bad magic", badMagic, 0, "", invalidMagic},
+		{"response type", encodePacket(JOB_CREATED, "H:x:1"), JOB_CREATED, "", invalidArg},
+		{"unsupported type", encodePacket(GRAB_JOB_ALL, "x"), GRAB_JOB_ALL, "", unsupportedCmd},
+		{"truncated body", encodePacket(ECHO_REQ, "0123")[:14], ECHO_REQ, "", io.ErrUnexpectedEOF},
+		{"truncated header", encodePacket(ECHO_REQ)[:6], 0, "", io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		tp, buf, err := ReadMessage(bytes.NewReader(tt.stream), 10)
+		if tp != tt.tp || err != tt.err || (err == nil && string(buf) != tt.body) {
+			t.Errorf("%v: %v %q %v, want %v %q %v", tt.name, tp, buf, err, tt.tp, tt.body, tt.err)
+		}
+	}
+}
+
+func TestReadMessageSkipsUnknownBody(t *testing.T) {
+	stream := append(encodePacket(99, "ignored"), encodePacket(ECHO_REQ, "next")...)
+	r := bytes.NewReader(stream)
+
+	if tp, _, err := ReadMessage(r, 100); tp != 99 || err != invalidArg {
+		t.Fatalf("unknown packet: %v %v", tp, err)
+	}
+	if tp, buf, err := ReadMessage(r, 100); tp != ECHO_REQ || string(buf) != "next" || err != nil {
+		t.Errorf("next packet: %v %q %v", tp, buf, err)
+	}
+}
+
+func TestParseFuncLimits(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]int
+		ok   bool
+	}{
+		{"", map[string]int{}, true},
+		{"a:10, b:20", map[string]int{"a": 10, "b": 20}, true},
+		{"a", nil, false},
+		{"a:x", nil, false},
+		{":10", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseFuncLimits(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.spec, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestSetNodeId(t *testing.T) {
+	defer SetNodeId(defaultNodeId())
+
+	tests := []struct {
+		nodeId string
+		node   string
+	}{
+		{"node-1", "node-1"},
+		{"host:4730", "host_4730"},
+		{strings.Repeat("n", 40), strings.Repeat("n", maxNodeIdLength)},
+	}
+
+	for _, tt := range tests {
+		SetNodeId(tt.nodeId)
+		handle := genJid()
+		if !regexp.MustCompile(`^H:` + tt.node + `:[0-9a-f]{8}-[0-9]+$`).MatchString(handle) {
+			t.Errorf("%q: handle %v", tt.nodeId, handle)
+		}
+		if len(handle) > 64 {
+			t.Errorf("%q: handle %v over 64 bytes", tt.nodeId, handle)
+		}
+	}
+
+	//a restart gets another nonce, so handles clients still hold are not reused
+	SetNodeId("node")
+	before := jidPrefix
+	SetNodeId("node")
+	if jidPrefix == before {
+		t.Errorf("nonce kept across restarts: %v", jidPrefix)
+	}
+}
+
+func TestGenJidUnique(t *testing.T) {
+	const workers, perWorker = 8, 1000
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handles := make([]string, perWorker)
+			for n := range handles {
+				handles[n] = genJid()
+			}
+
+			mu.Lock()
+			for _, h := range handles {
+				seen[h] = true
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != workers*perWorker {
+		t.Errorf("%v unique handles of %v", len(seen), workers*perWorker)
+	}
+}
@@ -27,7 +27,9 @@ type Worker struct {
 	Conn net.Conn
 	Connector
 
-	workerId string
-	status   int
-	canDo    map[string]bool
+	workerId  string
+	status    int
+	canDo     map[string]bool
+	timeout   map[string]int //CAN_DO_TIMEOUT seconds per func, 0 for none
+	exclusive bool //sent ALL_YOURS, it works for this server only
 }
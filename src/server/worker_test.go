@@ -0,0 +1,153 @@
+package server
+
+import (
+	. "common"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResetAbilities(t *testing.T) {
+	server, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	client.submit(SUBMIT_JOB_BG, "a", "", "1")
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "a")
+	worker.send(CAN_DO_TIMEOUT, "b", "10")
+	worker.send(RESET_ABILITIES)
+	if job := worker.grab(); job != nil {
+		t.Fatalf("assigned %q after RESET_ABILITIES", job)
+	}
+
+	status := ctrl(server, getFuncWorkerStatus, nil).(string)
+	if strings.Contains(status, "id:") {
+		t.Errorf("workers still registered: %v", status)
+	}
+
+	worker.send(CAN_DO, "a")
+	if job := worker.grab(); job == nil {
+		t.Errorf("no job after registering again")
+	}
+}
+
+func TestCantDoUnregistered(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	//SET_CLIENT_ID makes a worker of the session without registering it
+	worker := dial(t, addr)
+	worker.send(SET_CLIENT_ID, "w1")
+	worker.send(CANT_DO, "foo")
+	worker.sync()
+
+	worker.send(CAN_DO, "foo")
+	worker.send(CANT_DO, "foo")
+	if job := worker.grab(); job != nil {
+		t.Errorf("assigned %q after CANT_DO", job)
+	}
+}
+
+func TestAllYours(t *testing.T) {
+	server, addr := startServer(t, nil)
+
+	tests := []struct {
+		allYours bool
+		want     string
+	}{
+		{false, "exclusive:false"},
+		{true, "exclusive:true"},
+	}
+	for _, tt := range tests {
+		worker := dial(t, addr)
+		worker.send(SET_CLIENT_ID, "w")
+		if tt.allYours {
+			worker.send(ALL_YOURS)
+		}
+		worker.send(CAN_DO, "f")
+		worker.sync()
+
+		status := ctrl(server, getWorkerStatus, nil).(string)
+		if !strings.Contains(status, tt.want) {
+			t.Errorf("all yours %v: %v", tt.allYours, status)
+		}
+	}
+}
+
+// waitStatus polls the job status until it contains want
+func waitStatus(t *testing.T, server *Server, want string) string {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		status := ctrl(server, getJobStatus, nil).(string)
+		if strings.Contains(status, want) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status without %q: %v", want, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLostWorkerJobsRequeued(t *testing.T) {
+	server, addr := startServer(t, func(server *Server) {
+		server.SetRetryPolicy("resize", &RetryPolicy{Outcomes: RetryOnWorkerLost})
+	})
+
+	client := dial(t, addr)
+	lostJob := client.submit(SUBMIT_JOB, "resize", "", "a")
+
+	lost := dial(t, addr)
+	lost.send(CAN_DO, "resize")
+	lost.grab()
+	newJob := client.submit(SUBMIT_JOB_BG, "resize", "", "b")
+
+	lost.conn.Close()
+	waitStatus(t, server, "working:0")
+
+	worker := dial(t, addr)
+	worker.send(CAN_DO, "resize")
+	tests := []struct {
+		handle   string
+		attempts string
+	}{
+		{lostJob, `"Attempts":2`},
+		{newJob, `"Attempts":1`},
+	}
+	for _, tt := range tests {
+		if job := worker.grab(); job == nil || job[0] != tt.handle {
+			t.Fatalf("assigned %q, want %v", job, tt.handle)
+		}
+		if status := ctrl(server, getJobStatus, nil).(string); !strings.Contains(status, tt.attempts) {
+			t.Errorf("%v: %v", tt.handle, status)
+		}
+		worker.send(WORK_COMPLETE, tt.handle, "done")
+		worker.sync()
+	}
+
+	if got := client.expect(WORK_COMPLETE); got[0] != lostJob {
+		t.Errorf("WORK_COMPLETE %q", got)
+	}
+}
+
+func TestLostWorkerWakesSleepers(t *testing.T) {
+	_, addr := startServer(t, nil)
+
+	client := dial(t, addr)
+	handle := client.submit(SUBMIT_JOB_BG, "resize", "", "a")
+
+	lost := dial(t, addr)
+	lost.send(CAN_DO, "resize")
+	lost.grab()
+
+	sleeper := dial(t, addr)
+	sleeper.send(CAN_DO, "resize")
+	sleeper.send(PRE_SLEEP)
+	sleeper.sync()
+
+	lost.conn.Close()
+	sleeper.expect(NOOP)
+	if job := sleeper.grab(); job == nil || job[0] != handle {
+		t.Errorf("assigned %q, want %v", job, handle)
+	}
+}
@@ -2,13 +2,76 @@ package storage
 
 import (
 	. "common"
+	"errors"
+	"time"
 )
 
+// ErrDuplicateUnique is returned by PushJob when the backend already holds
+// a job of the function with the same unique id, one the server does not
+// know of, such as a job another server sharing the backend runs.
+var ErrDuplicateUnique = errors.New("job of the unique id exists")
+
+// Names of the queues the server keeps beside the one of a function, for
+// its dead letters and scheduled jobs. A backend shared with other gearman
+// servers may keep them apart.
+const (
+	DeadQueuePrefix  = "dead:"
+	SchedQueuePrefix = "sched:"
+)
+
+// JobQueue keeps the waiting jobs of one function.
+// PopJob must always return a job of the highest priority present
+// (PRIORITY_HIGH, then PRIORITY_NORMAL, then PRIORITY_LOW), and jobs of
+// the same priority must be returned in the order they were pushed.
+// PushJobFront puts a job back ahead of the others of its priority, it is
+// used for jobs taken back from a worker.
+// A method returning an error has not changed the queue. PopJob, Peek and
+// the lookups return a nil job and no error when there is none.
 type JobQueue interface {
-	Initial(name string)
-	PushJob(job *Job)
-	PopJob() *Job
-	RemoveJob(handle string) *Job
+	Initial(name string) error
+	PushJob(job *Job) error
+	PushJobFront(job *Job) error
+	PopJob() (*Job, error)
+	Peek() (*Job, error) //the job PopJob would return
+	RemoveJob(handle string) (*Job, error)
+	GetJob(handle string) (*Job, error)
+	GetJobByUnique(id string) (*Job, error)
+	Jobs(offset, limit int) ([]*Job, error) //a page of jobs in pop order, limit < 0 for all
 	Length() int
-	Show() string
+	Stats() Stats
+	Close() error
+}
+
+// JobDataReader is implemented by queues whose Jobs leaves out the data of
+// some jobs, JobData reads the data of one queued job.
+type JobDataReader interface {
+	JobData(handle string) ([]byte, error)
+}
+
+// SpillStatsReader is implemented by queues keeping the data of some jobs
+// on disk.
+type SpillStatsReader interface {
+	SpillStats() SpillStats
+}
+
+// Waker is implemented by queues whose PopJob does not wait for a remote
+// store, it may return no job and fetch one in the background. The queue
+// calls wake, from any goroutine, once the fetch is done.
+type Waker interface {
+	SetWaker(wake func())
+}
+
+type Stats struct {
+	Count     int
+	Bytes     int64         //size of the job data
+	OldestAge time.Duration //since the oldest job was created
+}
+
+// SpillStats tells how much of a queue is on disk.
+type SpillStats struct {
+	Jobs     int   //jobs having their data on disk
+	Bytes    int64 //size of that data
+	Segments int
+	Spilled  int64 //jobs written to disk since the queue was opened
+	PagedIn  int64 //jobs read back since the queue was opened
 }
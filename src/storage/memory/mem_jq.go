@@ -2,67 +2,185 @@ package memory
 
 import (
 	. "common"
-	"bytes"
-	"fmt"
 	"container/list"
+	"storage"
+	"time"
 )
 
+// MemJobQueue keeps one FIFO list per priority level, with the job count
+// and data size of each level kept on push and pop for Stats.
 type MemJobQueue struct {
-	name  string
-	queue *list.List
+	name    string
+	queues  [PRIORITY_LEVELS]*list.List
+	handles map[string]*list.Element
+	uniques map[string]*list.Element
+	counts  [PRIORITY_LEVELS]int
+	bytes   [PRIORITY_LEVELS]int64
 }
 
-func (m *MemJobQueue) Initial(name string) {
+func (m *MemJobQueue) Initial(name string) error {
 
 	m.name = name
-	m.queue = list.New()
+	for i := range m.queues {
+		m.queues[i] = list.New()
+	}
+	m.handles = make(map[string]*list.Element)
+	m.uniques = make(map[string]*list.Element)
+	m.counts = [PRIORITY_LEVELS]int{}
+	m.bytes = [PRIORITY_LEVELS]int64{}
 
+	return nil
 }
 
-func (m *MemJobQueue) PushJob(job *Job) {
+func levelOf(priority int) int {
 
-	if job != nil {
-		m.queue.PushBack(job)
+	if priority < PRIORITY_LOW {
+		return PRIORITY_LOW
+	} else if priority > PRIORITY_HIGH {
+		return PRIORITY_HIGH
+	}
+	return priority
+}
+
+func (m *MemJobQueue) queueOf(priority int) *list.List {
+	return m.queues[levelOf(priority)]
+}
+
+func (m *MemJobQueue) index(element *list.Element) {
+
+	job := element.Value.(*Job)
+	m.handles[job.Handle] = element
+	if len(job.Id) > 0 {
+		m.uniques[job.Id] = element
 	}
+	level := levelOf(job.Priority)
+	m.counts[level]++
+	m.bytes[level] += int64(len(job.Data))
 }
 
-func (m *MemJobQueue) PopJob() *Job {
+func (m *MemJobQueue) remove(element *list.Element) *Job {
 
-	element := m.queue.Back()
-	if element != nil {
-		job := element.Value.(*Job)
-		m.queue.Remove(element)
-		return job
+	job := element.Value.(*Job)
+	m.queueOf(job.Priority).Remove(element)
+	delete(m.handles, job.Handle)
+	if m.uniques[job.Id] == element {
+		delete(m.uniques, job.Id)
+	}
+	level := levelOf(job.Priority)
+	m.counts[level]--
+	m.bytes[level] -= int64(len(job.Data))
+
+	return job
+}
+
+func (m *MemJobQueue) PushJob(job *Job) error {
+
+	if job != nil {
+		m.index(m.queueOf(job.Priority).PushBack(job))
 	}
 	return nil
 }
 
-func (m *MemJobQueue) RemoveJob(handle string) *Job {
+func (m *MemJobQueue) PushJobFront(job *Job) error {
+
+	if job != nil {
+		m.index(m.queueOf(job.Priority).PushFront(job))
+	}
+	return nil
+}
 
-	var job *Job = nil
+func (m *MemJobQueue) front() *list.Element {
 
-	for e := m.queue.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Job).Handle == handle {
-			job = e.Value.(*Job)
-			m.queue.Remove(e)
-			break
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW; p-- {
+		if element := m.queues[p].Front(); element != nil {
+			return element
 		}
 	}
+	return nil
+}
 
-	return job
+func (m *MemJobQueue) PopJob() (*Job, error) {
+
+	if element := m.front(); element != nil {
+		return m.remove(element), nil
+	}
+	return nil, nil
+}
+
+func (m *MemJobQueue) Peek() (*Job, error) {
+
+	if element := m.front(); element != nil {
+		return element.Value.(*Job), nil
+	}
+	return nil, nil
 }
 
-func (m *MemJobQueue) Show() string{
+func (m *MemJobQueue) RemoveJob(handle string) (*Job, error) {
 
-	var buffer bytes.Buffer
+	if element, ok := m.handles[handle]; ok {
+		return m.remove(element), nil
+	}
+	return nil, nil
+}
+
+func (m *MemJobQueue) GetJob(handle string) (*Job, error) {
 
-	for e := m.queue.Front(); e != nil; e = e.Next() {
-		buffer.WriteString(fmt.Sprintf("%v\n", e))
+	if element, ok := m.handles[handle]; ok {
+		return element.Value.(*Job), nil
 	}
+	return nil, nil
+}
 
-	return buffer.String()
+func (m *MemJobQueue) GetJobByUnique(id string) (*Job, error) {
+
+	if element, ok := m.uniques[id]; ok {
+		return element.Value.(*Job), nil
+	}
+	return nil, nil
+}
+
+func (m *MemJobQueue) Jobs(offset, limit int) ([]*Job, error) {
+
+	if limit < 0 || limit > len(m.handles) {
+		limit = len(m.handles)
+	}
+
+	jobs := make([]*Job, 0, limit)
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW && len(jobs) < limit; p-- {
+		for e := m.queues[p].Front(); e != nil && len(jobs) < limit; e = e.Next() {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			jobs = append(jobs, e.Value.(*Job))
+		}
+	}
+
+	return jobs, nil
 }
 
 func (m *MemJobQueue) Length() int {
-	return m.queue.Len()
+	return len(m.handles)
+}
+
+func (m *MemJobQueue) Stats() storage.Stats {
+
+	var stats storage.Stats
+
+	//a list is in push order, a job put back behind its front is not seen
+	for p := range m.queues {
+		stats.Count += m.counts[p]
+		stats.Bytes += m.bytes[p]
+		if front := m.queues[p].Front(); front != nil {
+			if age := time.Since(front.Value.(*Job).CreateAt); age > stats.OldestAge {
+				stats.OldestAge = age
+			}
+		}
+	}
+
+	return stats
+}
+
+func (m *MemJobQueue) Close() error {
+	return nil
 }
@@ -0,0 +1,181 @@
+package memory
+
+import (
+	. "common"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func popAll(t *testing.T, m *MemJobQueue) []string {
+	var handles []string
+	for {
+		j, err := m.PopJob()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j == nil {
+			return handles
+		}
+		handles = append(handles, j.Handle)
+	}
+}
+
+func TestPopOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  []*Job
+		front []*Job
+		want  []string
+	}{
+		{
+			name: "fifo",
+			jobs: []*Job{{Handle: "a"}, {Handle: "b"}, {Handle: "c"}},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "priorities",
+			jobs: []*Job{
+				{Handle: "low", Priority: PRIORITY_LOW},
+				{Handle: "normal1", Priority: PRIORITY_NORMAL},
+				{Handle: "high1", Priority: PRIORITY_HIGH},
+				{Handle: "normal2", Priority: PRIORITY_NORMAL},
+				{Handle: "high2", Priority: PRIORITY_HIGH},
+			},
+			want: []string{"high1", "high2", "normal1", "normal2", "low"},
+		},
+		{
+			name: "front",
+			jobs: []*Job{
+				{Handle: "a", Priority: PRIORITY_NORMAL},
+				{Handle: "b", Priority: PRIORITY_NORMAL},
+				{Handle: "low", Priority: PRIORITY_LOW},
+			},
+			front: []*Job{
+				{Handle: "requeued", Priority: PRIORITY_NORMAL},
+				{Handle: "requeued-low", Priority: PRIORITY_LOW},
+			},
+			want: []string{"requeued", "a", "b", "requeued-low", "low"},
+		},
+		{
+			name: "out of range priorities",
+			jobs: []*Job{{Handle: "below", Priority: -1}, {Handle: "above", Priority: 7}},
+			want: []string{"above", "below"},
+		},
+	}
+
+	for _, tt := range tests {
+		m := &MemJobQueue{}
+		m.Initial("f")
+		for _, j := range tt.jobs {
+			m.PushJob(j)
+		}
+		for _, j := range tt.front {
+			m.PushJobFront(j)
+		}
+
+		if n := m.Length(); n != len(tt.want) {
+			t.Errorf("%v: length %v, want %v", tt.name, n, len(tt.want))
+		}
+		if peek, _ := m.Peek(); peek == nil || peek.Handle != tt.want[0] {
+			t.Errorf("%v: peek %v, want %v", tt.name, peek, tt.want[0])
+		}
+		if got := popAll(t, m); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: popped %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLookupsAndRemove(t *testing.T) {
+	m := &MemJobQueue{}
+	m.Initial("f")
+	m.PushJob(&Job{Handle: "a", Id: "ua", Data: []byte("12345")})
+	m.PushJob(&Job{Handle: "b", Data: []byte("123")})
+	m.PushJob(&Job{Handle: "c", Id: "uc", Priority: PRIORITY_HIGH})
+
+	if j, _ := m.GetJob("b"); j == nil || j.Handle != "b" {
+		t.Errorf("get b: %v", j)
+	}
+	if j, _ := m.GetJobByUnique("ua"); j == nil || j.Handle != "a" {
+		t.Errorf("get unique ua: %v", j)
+	}
+	if stats := m.Stats(); stats.Count != 3 || stats.Bytes != 8 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	if j, _ := m.RemoveJob("a"); j == nil || j.Handle != "a" {
+		t.Errorf("remove a: %v", j)
+	}
+	if j, _ := m.RemoveJob("a"); j != nil {
+		t.Errorf("remove a twice: %v", j)
+	}
+	if j, _ := m.GetJobByUnique("ua"); j != nil {
+		t.Errorf("unique ua after remove: %v", j)
+	}
+	if stats := m.Stats(); stats.Count != 2 || stats.Bytes != 3 {
+		t.Errorf("stats after remove %+v", stats)
+	}
+
+	if got := popAll(t, m); !reflect.DeepEqual(got, []string{"c", "b"}) {
+		t.Errorf("popped %v", got)
+	}
+}
+
+func TestStatsPerPriority(t *testing.T) {
+	m := &MemJobQueue{}
+	m.Initial("f")
+	now := time.Now()
+	m.PushJob(&Job{Handle: "n1", Data: []byte("12"), Priority: PRIORITY_NORMAL, CreateAt: now.Add(-time.Minute)})
+	m.PushJob(&Job{Handle: "h1", Data: []byte("1"), Priority: PRIORITY_HIGH, CreateAt: now})
+	m.PushJob(&Job{Handle: "l1", Data: []byte("123"), Priority: PRIORITY_LOW, CreateAt: now.Add(-time.Hour)})
+	m.PushJobFront(&Job{Handle: "n0", Data: []byte("1234"), Priority: PRIORITY_NORMAL, CreateAt: now.Add(-2 * time.Hour)})
+
+	if m.counts != [PRIORITY_LEVELS]int{1, 2, 1} || m.bytes != [PRIORITY_LEVELS]int64{3, 6, 1} {
+		t.Errorf("counts %v bytes %v", m.counts, m.bytes)
+	}
+	if stats := m.Stats(); stats.Count != 4 || stats.Bytes != 10 || stats.OldestAge < 2*time.Hour {
+		t.Errorf("stats %+v", stats)
+	}
+
+	m.PopJob()
+	m.PopJob()
+	m.RemoveJob("l1")
+	if stats := m.Stats(); stats.Count != 1 || stats.Bytes != 2 || stats.OldestAge < time.Minute ||
+		stats.OldestAge >= time.Hour {
+		t.Errorf("stats after pop %+v", stats)
+	}
+}
+
+func TestJobsPaging(t *testing.T) {
+	m := &MemJobQueue{}
+	m.Initial("f")
+	m.PushJob(&Job{Handle: "n1", Priority: PRIORITY_NORMAL})
+	m.PushJob(&Job{Handle: "h1", Priority: PRIORITY_HIGH})
+	m.PushJob(&Job{Handle: "n2", Priority: PRIORITY_NORMAL})
+	m.PushJob(&Job{Handle: "l1", Priority: PRIORITY_LOW})
+
+	tests := []struct {
+		offset, limit int
+		want          []string
+	}{
+		{0, -1, []string{"h1", "n1", "n2", "l1"}},
+		{0, 2, []string{"h1", "n1"}},
+		{1, 2, []string{"n1", "n2"}},
+		{3, 5, []string{"l1"}},
+		{4, 1, []string{}},
+	}
+
+	for _, tt := range tests {
+		jobs, err := m.Jobs(tt.offset, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, j := range jobs {
+			got = append(got, j.Handle)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Jobs(%v, %v) = %v, want %v", tt.offset, tt.limit, got, tt.want)
+		}
+	}
+}
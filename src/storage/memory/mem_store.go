@@ -0,0 +1,29 @@
+package memory
+
+import (
+	"storage"
+)
+
+func init() {
+	storage.Register("memory", func(options map[string]string) (storage.Backend, error) {
+		if len(options) > 0 {
+			return nil, storage.ErrInvalidOption
+		}
+		return &MemStore{}, nil
+	})
+}
+
+// MemStore is the default backend, its jobs are lost when the server stops.
+type MemStore struct{}
+
+func (s *MemStore) Queue(name string) (storage.JobQueue, error) {
+	queue := &MemJobQueue{}
+	if err := queue.Initial(name); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+func (s *MemStore) Names() ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,311 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utils/logger"
+)
+
+const (
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+	maxPipeline       = 256
+	requestQueueSize  = 4096
+)
+
+var (
+	unavailable = errors.New("redis unavailable")
+	busy        = errors.New("redis request queue full")
+	timedOut    = errors.New("redis request timed out")
+)
+
+type request struct {
+	cmds     [][]string
+	replies  []interface{}
+	err      error
+	deadline time.Time     //zero for requests nobody waits for
+	done     chan *request //nil for requests nobody waits for
+	then     func([]interface{}, error)
+}
+
+func (req *request) finish(replies []interface{}, err error) {
+	req.replies, req.err = replies, err
+	if req.done != nil {
+		req.done <- req
+		return
+	}
+	if err == nil {
+		err = replyError(replies)
+	}
+	if req.then != nil {
+		req.then(replies, err)
+		return
+	}
+	if err != nil {
+		logger.Logger().E("redis %v: %v", req.cmds[0][0], err)
+	}
+}
+
+// client owns one connection to redis. The event loop only queues requests,
+// dialing, writing and reading are done by the connection goroutine, which
+// sends everything queued meanwhile in one pipeline.
+type client struct {
+	opts      *Options
+	reqCh     chan *request
+	connected int32
+	up        chan bool //closed on the first connect
+
+	lock sync.Mutex
+	conn net.Conn //served by the connection goroutine, nil while it reconnects
+}
+
+func newClient(opts *Options) *client {
+	c := &client{opts: opts, reqCh: make(chan *request, requestQueueSize), up: make(chan bool)}
+	go c.loop()
+	return c
+}
+
+// do sends the commands in one pipeline and waits for their replies, it
+// fails at once while redis is unreachable. After a timeout the commands
+// may still run, see uncertain.
+func (c *client) do(cmds ...[]string) ([]interface{}, error) {
+	if atomic.LoadInt32(&c.connected) == 0 {
+		return nil, unavailable
+	}
+
+	req := &request{cmds: cmds, deadline: time.Now().Add(c.opts.Timeout), done: make(chan *request, 1)}
+	select {
+	case c.reqCh <- req:
+	default:
+		return nil, busy
+	}
+
+	timer := time.NewTimer(c.opts.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-req.done:
+		if req.err != nil {
+			return nil, req.err
+		}
+		return req.replies, replyError(req.replies)
+	case <-timer.C:
+		//a redis that is this slow is as good as gone, the requests queued
+		//behind this one fail too instead of waiting for it
+		c.drop()
+		return nil, timedOut
+	}
+}
+
+// uncertain tells if the commands of a failed request may have run anyway.
+func uncertain(err error) bool {
+	if _, ok := err.(redisError); ok {
+		return false
+	}
+	return err != nil && err != unavailable && err != busy
+}
+
+// drop closes the connection, the connection goroutine fails what it has
+// sent and connects again.
+func (c *client) drop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *client) setConn(conn net.Conn) {
+	c.lock.Lock()
+	c.conn = conn
+	c.lock.Unlock()
+}
+
+// send queues the commands without waiting, they are sent once redis is
+// back if it is unreachable, failures are only logged.
+func (c *client) send(cmds ...[]string) {
+	select {
+	case c.reqCh <- &request{cmds: cmds}:
+	default:
+		logger.Logger().E("redis %v: %v", cmds[0][0], busy)
+	}
+}
+
+// async queues the commands without waiting, then gets their replies or
+// the failure on the connection goroutine, or at once if they could not be
+// queued. It fails at once while redis is unreachable.
+func (c *client) async(then func([]interface{}, error), cmds ...[]string) {
+	if atomic.LoadInt32(&c.connected) == 0 {
+		then(nil, unavailable)
+		return
+	}
+
+	select {
+	case c.reqCh <- &request{cmds: cmds, then: then}:
+	default:
+		then(nil, busy)
+	}
+}
+
+func (c *client) waitConnected(timeout time.Duration) bool {
+	select {
+	case <-c.up:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (c *client) loop() {
+	delay := minReconnectDelay
+	first := true
+
+	for {
+		conn, err := c.dial()
+		if err != nil {
+			logger.Logger().W("redis %v: %v, retry in %v", c.opts.Addr, err, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+
+		delay = minReconnectDelay
+		c.setConn(conn)
+		atomic.StoreInt32(&c.connected, 1)
+		logger.Logger().I("redis %v connected", c.opts.Addr)
+		if first {
+			first = false
+			close(c.up)
+		}
+
+		err = c.serve(conn)
+		atomic.StoreInt32(&c.connected, 0)
+		c.setConn(nil)
+		conn.Close()
+		logger.Logger().E("redis %v lost: %v", c.opts.Addr, err)
+	}
+}
+
+func (c *client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.opts.Addr, maxReconnectDelay)
+	if err != nil {
+		return nil, err
+	}
+
+	var setup [][]string
+	if c.opts.Password != "" {
+		setup = append(setup, []string{"AUTH", c.opts.Password})
+	}
+	if c.opts.Db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.opts.Db)})
+	}
+	if len(setup) == 0 {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(maxReconnectDelay))
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for _, cmd := range setup {
+		writeCommand(w, cmd)
+	}
+	if err = w.Flush(); err == nil {
+		for range setup {
+			var reply interface{}
+			if reply, err = readReply(r); err == nil {
+				err = replyError([]interface{}{reply})
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (c *client) serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		batch := []*request{<-c.reqCh}
+	collect:
+		for len(batch) < maxPipeline {
+			select {
+			case req := <-c.reqCh:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+
+		now := time.Now()
+		live := batch[:0]
+		for _, req := range batch {
+			if !req.deadline.IsZero() && now.After(req.deadline) {
+				req.finish(nil, timedOut)
+				continue
+			}
+			for _, cmd := range req.cmds {
+				writeCommand(w, cmd)
+			}
+			live = append(live, req)
+		}
+
+		if err := w.Flush(); err != nil {
+			c.fail(live, err)
+			return err
+		}
+
+		//a redis that stops answering must not hold the requests forever
+		conn.SetReadDeadline(time.Now().Add(maxReconnectDelay))
+		for i, req := range live {
+			replies := make([]interface{}, len(req.cmds))
+			for j := range replies {
+				reply, err := readReply(r)
+				if err != nil {
+					c.fail(live[i:], err)
+					return err
+				}
+				replies[j] = reply
+			}
+			req.finish(replies, nil)
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *client) fail(reqs []*request, err error) {
+	for _, req := range reqs {
+		req.finish(nil, err)
+	}
+}
+
+// replyError returns the first error reply, also inside an EXEC reply.
+func replyError(replies []interface{}) error {
+	for _, reply := range replies {
+		switch v := reply.(type) {
+		case redisError:
+			return v
+		case []interface{}:
+			if err := replyError(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeServer speaks enough of the redis protocol for this backend and keeps
+// everything in memory, it stands in for a redis-server.
+type fakeServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	strings  map[string]string
+	lists    map[string][]string //index 0 is the left end
+	hashes   map[string]map[string]string
+	sets     map[string]map[string]bool
+	delay    time.Duration //before replies are sent, the commands have run
+}
+
+// newFakeServer listens on addr, such as 127.0.0.1:0.
+func newFakeServer(addr string) (*fakeServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fakeServer{
+		listener: listener,
+		strings:  make(map[string]string),
+		lists:    make(map[string][]string),
+		hashes:   make(map[string]map[string]string),
+		sets:     make(map[string]map[string]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *fakeServer) setDelay(delay time.Duration) {
+	s.lock.Lock()
+	s.delay = delay
+	s.lock.Unlock()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var queued [][]string
+	inMulti := false
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply interface{}
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			inMulti, queued = true, nil
+			reply = "OK"
+		case cmd == "DISCARD":
+			inMulti, queued = false, nil
+			reply = "OK"
+		case cmd == "EXEC":
+			if !inMulti {
+				reply = redisError("ERR EXEC without MULTI")
+				break
+			}
+			s.lock.Lock()
+			replies := make([]interface{}, len(queued))
+			for i, q := range queued {
+				replies[i] = s.exec(q)
+			}
+			s.lock.Unlock()
+			inMulti, queued = false, nil
+			reply = replies
+		case inMulti:
+			queued = append(queued, args)
+			reply = "QUEUED"
+		default:
+			s.lock.Lock()
+			reply = s.exec(args)
+			s.lock.Unlock()
+		}
+
+		writeReply(w, reply)
+		if r.Buffered() == 0 {
+			s.lock.Lock()
+			delay := s.delay
+			s.lock.Unlock()
+			time.Sleep(delay)
+
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func wrongArgs(cmd string) redisError {
+	return redisError("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+// index turns a redis list index, negative from the right, into a slice one
+func index(i, length int) int {
+	if i < 0 {
+		i += length
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func (s *fakeServer) exec(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	argc := map[string]int{
+		"PING": 1, "AUTH": 2, "SELECT": 2, "FLUSHALL": 1, "GET": 2, "SET": 3, "DEL": 2,
+		"INCRBY": 3, "DECRBY": 3, "LPUSH": 3, "RPUSH": 3, "RPOPLPUSH": 3, "LREM": 4,
+		"LLEN": 2, "LRANGE": 4, "LINDEX": 3, "HSET": 4, "HGET": 3, "HDEL": 3, "HMGET": 3,
+		"HLEN": 2, "HGETALL": 2, "HSCAN": 3, "SADD": 3, "SREM": 3, "SMEMBERS": 2,
+	}
+	need, ok := argc[cmd]
+	if !ok {
+		return redisError("ERR unknown command '" + args[0] + "'")
+	}
+	if len(args) < need {
+		return wrongArgs(cmd)
+	}
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+
+	switch cmd {
+	case "PING":
+		return "PONG"
+	case "AUTH", "SELECT":
+		return "OK"
+	case "FLUSHALL":
+		s.strings = make(map[string]string)
+		s.lists = make(map[string][]string)
+		s.hashes = make(map[string]map[string]string)
+		s.sets = make(map[string]map[string]bool)
+		return "OK"
+	case "GET":
+		if v, ok := s.strings[key]; ok {
+			return []byte(v)
+		}
+		return nil
+	case "SET":
+		s.strings[key] = args[2]
+		return "OK"
+	case "DEL":
+		n := int64(0)
+		for _, k := range args[1:] {
+			_, a := s.strings[k]
+			_, b := s.lists[k]
+			_, c := s.hashes[k]
+			_, d := s.sets[k]
+			if a || b || c || d {
+				n++
+			}
+			delete(s.strings, k)
+			delete(s.lists, k)
+			delete(s.hashes, k)
+			delete(s.sets, k)
+		}
+		return n
+	case "INCRBY", "DECRBY":
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		v, _ := strconv.ParseInt(s.strings[key], 10, 64)
+		if cmd == "DECRBY" {
+			by = -by
+		}
+		v += by
+		s.strings[key] = strconv.FormatInt(v, 10)
+		return v
+	case "LPUSH":
+		for _, v := range args[2:] {
+			s.lists[key] = append([]string{v}, s.lists[key]...)
+		}
+		return int64(len(s.lists[key]))
+	case "RPUSH":
+		s.lists[key] = append(s.lists[key], args[2:]...)
+		return int64(len(s.lists[key]))
+	case "RPOPLPUSH":
+		list := s.lists[key]
+		if len(list) == 0 {
+			return nil
+		}
+		v := list[len(list)-1]
+		s.setList(key, list[:len(list)-1])
+		s.lists[args[2]] = append([]string{v}, s.lists[args[2]]...)
+		return []byte(v)
+	case "LREM":
+		count, err := strconv.Atoi(args[2])
+		if err != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		return s.lrem(key, count, args[3])
+	case "LLEN":
+		return int64(len(s.lists[key]))
+	case "LRANGE":
+		list := s.lists[key]
+		start, err1 := strconv.Atoi(args[2])
+		stop, err2 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		start, stop = index(start, len(list)), index(stop, len(list))
+		if stop >= len(list) {
+			stop = len(list) - 1
+		}
+		values := make([]interface{}, 0)
+		for i := start; i <= stop; i++ {
+			values = append(values, []byte(list[i]))
+		}
+		return values
+	case "LINDEX":
+		list := s.lists[key]
+		i, err := strconv.Atoi(args[2])
+		if err != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		if i < 0 {
+			i += len(list)
+		}
+		if i < 0 || i >= len(list) {
+			return nil
+		}
+		return []byte(list[i])
+	case "HSET":
+		if len(args)%2 != 0 {
+			return wrongArgs(cmd)
+		}
+		hash, ok := s.hashes[key]
+		if !ok {
+			hash = make(map[string]string)
+			s.hashes[key] = hash
+		}
+		n := int64(0)
+		for i := 2; i < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				n++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return n
+	case "HGET":
+		if v, ok := s.hashes[key][args[2]]; ok {
+			return []byte(v)
+		}
+		return nil
+	case "HDEL":
+		n := int64(0)
+		for _, field := range args[2:] {
+			if _, ok := s.hashes[key][field]; ok {
+				delete(s.hashes[key], field)
+				n++
+			}
+		}
+		if len(s.hashes[key]) == 0 {
+			delete(s.hashes, key)
+		}
+		return n
+	case "HMGET":
+		values := make([]interface{}, 0, len(args)-2)
+		for _, field := range args[2:] {
+			if v, ok := s.hashes[key][field]; ok {
+				values = append(values, []byte(v))
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "HLEN":
+		return int64(len(s.hashes[key]))
+	case "HGETALL":
+		values := make([]interface{}, 0, 2*len(s.hashes[key]))
+		for field, v := range s.hashes[key] {
+			values = append(values, []byte(field), []byte(v))
+		}
+		return values
+	case "HSCAN":
+		//the cursor is an offset into the sorted fields
+		cursor, err := strconv.Atoi(args[2])
+		if err != nil || cursor < 0 {
+			return redisError("ERR invalid cursor")
+		}
+		count := 10
+		for i := 3; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "COUNT" {
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+		fields := make([]string, 0, len(s.hashes[key]))
+		for field := range s.hashes[key] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		values := make([]interface{}, 0, 2*count)
+		next := cursor
+		for ; next < len(fields) && next < cursor+count; next++ {
+			values = append(values, []byte(fields[next]), []byte(s.hashes[key][fields[next]]))
+		}
+		if next >= len(fields) {
+			next = 0
+		}
+		return []interface{}{[]byte(strconv.Itoa(next)), values}
+	case "SADD":
+		set, ok := s.sets[key]
+		if !ok {
+			set = make(map[string]bool)
+			s.sets[key] = set
+		}
+		n := int64(0)
+		for _, m := range args[2:] {
+			if !set[m] {
+				set[m] = true
+				n++
+			}
+		}
+		return n
+	case "SREM":
+		n := int64(0)
+		for _, m := range args[2:] {
+			if s.sets[key][m] {
+				delete(s.sets[key], m)
+				n++
+			}
+		}
+		return n
+	case "SMEMBERS":
+		values := make([]interface{}, 0, len(s.sets[key]))
+		for m := range s.sets[key] {
+			values = append(values, []byte(m))
+		}
+		return values
+	}
+
+	return redisError("ERR unknown command '" + args[0] + "'")
+}
+
+func (s *fakeServer) setList(key string, list []string) {
+	if len(list) == 0 {
+		delete(s.lists, key)
+		return
+	}
+	s.lists[key] = list
+}
+
+// lrem removes count values from the left, -count from the right, all for 0
+func (s *fakeServer) lrem(key string, count int, value string) int64 {
+	list := s.lists[key]
+	removed := int64(0)
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+
+	kept := make([]string, 0, len(list))
+	if count >= 0 {
+		for _, v := range list {
+			if v == value && (limit == 0 || removed < int64(limit)) {
+				removed++
+				continue
+			}
+			kept = append(kept, v)
+		}
+	} else {
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i] == value && removed < int64(limit) {
+				removed++
+				continue
+			}
+			kept = append([]string{list[i]}, kept...)
+		}
+	}
+
+	s.setList(key, kept)
+	return removed
+}
+
+// readCommand reads a command as sent by writeCommand.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, protocolError
+	}
+
+	args := make([]string, len(values))
+	for i, v := range values {
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, protocolError
+		}
+		args[i] = string(b)
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		w.WriteString("+" + v + "\r\n")
+	case redisError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case error:
+		w.WriteString("-" + v.Error() + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
@@ -0,0 +1,905 @@
+package redis
+
+import (
+	. "common"
+	"encoding/json"
+	"storage"
+	"storage/memory"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utils/logger"
+)
+
+const (
+	pruneBatch = 512 //handles checked by one HMGET
+)
+
+/*
+The keys of a queue, all starting with the store prefix
+
+queue:<name>:<priority>  - list of handles, pushed on the left and popped
+                           from the right into the pending list
+jobs:<name>              - hash of handle to json job
+unique:<name>            - hash of unique id to handle
+bytes:<name>             - size of the job data of the queued and running jobs
+pending:<name>:<node>    - list of the handles a server popped, a server
+                           queues its pending jobs again when it starts
+queues                   - set of the queue names
+
+Only background jobs go to redis, any server sharing the prefix may run
+them. The clients of other jobs are connected to this server, so they stay
+in memory here.
+
+A request without an answer may have run in redis. A pop of it may have
+left a handle in the pending list that no worker got, a push of it may
+have queued a job its submitter was told failed. The queue settles both
+before its next push or pop, see reconcile.
+
+A pop does not wait for redis either, a claim moves the next job to the
+pending list in the background and the job waits there for the next pop,
+see PopJob.
+*/
+
+// RedisJobQueue is driven by the event loop, only the counters, the handle
+// index and the claimed job are shared with the connection goroutine and
+// the refresh loop.
+type RedisJobQueue struct {
+	name    string
+	store   *Store
+	client  *client
+	local   *memory.MemJobQueue
+	pending map[string]*Job //popped by this server, not removed yet
+	unsure  map[string]*Job //pushes without an answer from redis
+
+	lock     sync.Mutex
+	known    map[string]*Job   //jobs queued in redis this server knows of, without data
+	uniques  map[string]string //handles of the known jobs by unique id
+	ready    *Job              //claimed for this server, in the pending list until popped
+	readyAt  time.Time
+	claiming bool   //a claim or a release runs, the pending list is not settled
+	stranded bool   //a pop without an answer, the pending list may hold more than pending
+	wake     func() //tells the server a claim is done
+
+	count  int64 //jobs queued in redis, read again by refresh
+	bytes  int64
+	oldest int64 //CreateAt of the oldest job in redis in unix nano, 0 if none
+}
+
+func (q *RedisJobQueue) key(parts ...string) string {
+	key := q.store.opts.Prefix
+	for i, part := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += part
+	}
+	return key
+}
+
+func (q *RedisJobQueue) listKey(priority int) string {
+	if priority < PRIORITY_LOW {
+		priority = PRIORITY_LOW
+	} else if priority > PRIORITY_HIGH {
+		priority = PRIORITY_HIGH
+	}
+	return q.key("queue", q.name, strconv.Itoa(priority))
+}
+
+func (q *RedisJobQueue) jobsKey() string {
+	return q.key("jobs", q.name)
+}
+
+func (q *RedisJobQueue) uniqueKey() string {
+	return q.key("unique", q.name)
+}
+
+func (q *RedisJobQueue) bytesKey() string {
+	return q.key("bytes", q.name)
+}
+
+func (q *RedisJobQueue) pendingKey() string {
+	return q.key("pending", q.name, q.store.opts.Node)
+}
+
+// Initial queues the jobs this server ran when it stopped again, ahead of
+// the others and in the order they were popped.
+func (q *RedisJobQueue) Initial(name string) error {
+	q.name = name
+	q.client = q.store.client
+	q.local = &memory.MemJobQueue{}
+	q.local.Initial(name)
+	q.pending = make(map[string]*Job)
+	q.unsure = make(map[string]*Job)
+	q.known = make(map[string]*Job)
+	q.uniques = make(map[string]string)
+	q.stranded = true
+
+	if _, err := q.client.do([]string{"SADD", q.store.queuesKey(), name}); err != nil {
+		return err
+	}
+	if err := q.reconcile(); err != nil {
+		return err
+	}
+	if err := q.refresh(); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := q.index(); err != nil {
+			logger.Logger().W("redis queue %v: index %v", name, err)
+		}
+	}()
+	q.store.register(q)
+	return nil
+}
+
+// SetWaker is called by the server, wake may be called from any goroutine.
+func (q *RedisJobQueue) SetWaker(wake func()) {
+	q.lock.Lock()
+	q.wake = wake
+	q.lock.Unlock()
+}
+
+// reconcile queues the handles of the pending list no worker of this
+// server got again, and takes the jobs of unanswered pushes out of redis.
+func (q *RedisJobQueue) reconcile() error {
+	q.lock.Lock()
+	stranded, ready := q.stranded && !q.claiming, q.ready
+	q.lock.Unlock()
+
+	if stranded {
+		replies, err := q.client.do([]string{"LRANGE", q.pendingKey(), "0", "-1"})
+		if err != nil {
+			return err
+		}
+
+		//newest first, the oldest ends up next to pop
+		handles, _ := replies[0].([]interface{})
+		requeued := 0
+		for _, h := range handles {
+			handle := string(h.([]byte))
+			if _, ok := q.pending[handle]; ok {
+				continue
+			}
+			if ready != nil && ready.Handle == handle {
+				continue
+			}
+			j, err := q.fetch(handle)
+			if err != nil {
+				return err
+			}
+
+			cmds := [][]string{{"LREM", q.pendingKey(), "1", handle}}
+			if j != nil {
+				cmds = append(cmds, []string{"RPUSH", q.listKey(j.Priority), handle})
+			}
+			if _, err := q.client.do(transaction(cmds...)...); err != nil {
+				return err
+			}
+			if j != nil {
+				atomic.AddInt64(&q.count, 1)
+				q.setKnown(j)
+				requeued++
+			}
+		}
+
+		q.lock.Lock()
+		q.stranded = false
+		q.lock.Unlock()
+		if requeued > 0 {
+			logger.Logger().I("redis queue %v: %v popped jobs queued again", q.name, requeued)
+		}
+	}
+
+	for handle, j := range q.unsure {
+		replies, err := q.client.do([]string{"LREM", q.listKey(j.Priority), "1", handle})
+		if err != nil {
+			return err
+		}
+		//not queued, or already running on some server
+		if n, _ := replies[0].(int64); n == 1 {
+			logger.Logger().W("redis queue %v: failed push of %v taken back", q.name, handle)
+			if _, err := q.client.do(transaction(q.forget(j)...)...); err != nil {
+				return err
+			}
+		}
+		delete(q.unsure, handle)
+	}
+
+	return nil
+}
+
+// settle reconciles after a request without an answer, the pending list
+// waits for the claim running.
+func (q *RedisJobQueue) settle() error {
+	q.lock.Lock()
+	stranded := q.stranded && !q.claiming
+	q.lock.Unlock()
+
+	if !stranded && len(q.unsure) == 0 {
+		return nil
+	}
+	return q.reconcile()
+}
+
+func (q *RedisJobQueue) strand() {
+	q.lock.Lock()
+	q.stranded = true
+	q.lock.Unlock()
+}
+
+// index adds the jobs queued in redis when the server starts, so GetJob
+// finds them without asking redis. It runs in the background and reads
+// the handles of the lists and the unique ids only, never the job data,
+// the jobs indexed meanwhile are kept.
+func (q *RedisJobQueue) index() error {
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW; p-- {
+		for start := 0; ; start += pruneBatch {
+			replies, err := q.client.do([]string{"LRANGE", q.listKey(p),
+				strconv.Itoa(start), strconv.Itoa(start + pruneBatch - 1)})
+			if err != nil {
+				return err
+			}
+
+			handles, _ := replies[0].([]interface{})
+			q.lock.Lock()
+			for _, h := range handles {
+				handle := string(asBytes(h))
+				if _, ok := q.known[handle]; !ok {
+					q.known[handle] = &Job{Handle: handle, FuncName: q.name, Priority: p, IsBackGround: true}
+				}
+			}
+			q.lock.Unlock()
+			if len(handles) < pruneBatch {
+				break
+			}
+		}
+	}
+
+	//the running jobs with a unique id too
+	for cursor := "0"; ; {
+		replies, err := q.client.do([]string{"HSCAN", q.uniqueKey(), cursor, "COUNT", strconv.Itoa(pruneBatch)})
+		if err != nil {
+			return err
+		}
+
+		scan, _ := replies[0].([]interface{})
+		if len(scan) != 2 {
+			return nil
+		}
+		fields, _ := scan[1].([]interface{})
+		q.lock.Lock()
+		for i := 1; i < len(fields); i += 2 {
+			id, handle := string(asBytes(fields[i-1])), string(asBytes(fields[i]))
+			if j, ok := q.known[handle]; !ok {
+				q.known[handle] = &Job{Handle: handle, Id: id, FuncName: q.name, IsBackGround: true}
+			} else if j.Id == "" {
+				j.Id = id
+			}
+			if _, ok := q.uniques[id]; !ok {
+				q.uniques[id] = handle
+			}
+		}
+		q.lock.Unlock()
+
+		if cursor = string(asBytes(scan[0])); cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// setKnown indexes a job without its data.
+func (q *RedisJobQueue) setKnown(j *Job) {
+	known := *j
+	known.Data = nil
+
+	q.lock.Lock()
+	q.known[j.Handle] = &known
+	if len(j.Id) > 0 {
+		q.uniques[j.Id] = j.Handle
+	}
+	q.lock.Unlock()
+}
+
+func (q *RedisJobQueue) forgetKnown(handle string) {
+	q.lock.Lock()
+	q.dropKnown(handle)
+	q.lock.Unlock()
+}
+
+// dropKnown must be called with the lock held.
+func (q *RedisJobQueue) dropKnown(handle string) {
+	if j, ok := q.known[handle]; ok && len(j.Id) > 0 && q.uniques[j.Id] == handle {
+		delete(q.uniques, j.Id)
+	}
+	delete(q.known, handle)
+}
+
+func transaction(cmds ...[]string) [][]string {
+	tx := make([][]string, 0, len(cmds)+2)
+	tx = append(tx, []string{"MULTI"})
+	tx = append(tx, cmds...)
+	return append(tx, []string{"EXEC"})
+}
+
+func (q *RedisJobQueue) fetch(handle string) (*Job, error) {
+	replies, err := q.client.do([]string{"HGET", q.jobsKey(), handle})
+	if err != nil {
+		return nil, err
+	}
+	return decodeJob(replies[0])
+}
+
+func decodeJob(reply interface{}) (*Job, error) {
+	body, ok := reply.([]byte)
+	if !ok {
+		return nil, nil
+	}
+
+	j := &Job{}
+	if err := json.Unmarshal(body, j); err != nil {
+		return nil, err
+	}
+	//the clients coalesced onto it are sessions of the server that pushed it
+	j.Attached = nil
+	return j, nil
+}
+
+func (q *RedisJobQueue) push(job *Job, cmd string) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	cmds := [][]string{
+		{"HSET", q.jobsKey(), job.Handle, string(body)},
+		{"INCRBY", q.bytesKey(), strconv.Itoa(len(job.Data))},
+		{cmd, q.listKey(job.Priority), job.Handle},
+	}
+	if _, ok := q.pending[job.Handle]; ok {
+		//taken back from a worker, so it was counted already
+		cmds[1] = []string{"LREM", q.pendingKey(), "1", job.Handle}
+	}
+	if len(job.Id) > 0 {
+		cmds = append(cmds, []string{"HSET", q.uniqueKey(), job.Id, job.Handle})
+	}
+
+	if _, err := q.client.do(transaction(cmds...)...); err != nil {
+		if _, ok := q.pending[job.Handle]; ok {
+			//the caller drops the job, it runs again from the pending list
+			delete(q.pending, job.Handle)
+			q.strand()
+		} else if uncertain(err) {
+			q.unsure[job.Handle] = job
+		}
+		return err
+	}
+
+	delete(q.pending, job.Handle)
+	atomic.AddInt64(&q.count, 1)
+	q.setKnown(job)
+	return nil
+}
+
+func (q *RedisJobQueue) PushJob(job *Job) error {
+	if job == nil {
+		return nil
+	}
+	if !job.IsBackGround {
+		return q.local.PushJob(job)
+	}
+	if err := q.settle(); err != nil {
+		return err
+	}
+	return q.push(job, "LPUSH")
+}
+
+func (q *RedisJobQueue) PushJobFront(job *Job) error {
+	if job == nil {
+		return nil
+	}
+	if !job.IsBackGround {
+		return q.local.PushJobFront(job)
+	}
+	if err := q.settle(); err != nil {
+		return err
+	}
+	return q.push(job, "RPUSH")
+}
+
+// PopJob does not wait for redis. It returns the job a claim fetched or a
+// local one, the local jobs first within a priority. Unless the local job
+// is of the highest priority or redis is empty, it returns no job before
+// some job was claimed, it starts a claim and the server is woken once the
+// claim is done. A job pushed to redis after the claim waits for the next
+// one, whatever its priority.
+func (q *RedisJobQueue) PopJob() (*Job, error) {
+	if err := q.settle(); err != nil {
+		return nil, err
+	}
+
+	j, claimed := q.next()
+	if j == nil {
+		if atomic.LoadInt64(&q.count) > 0 {
+			q.claim()
+		}
+		return nil, nil
+	}
+	if !claimed {
+		return q.local.PopJob()
+	}
+
+	q.lock.Lock()
+	released := q.ready != j
+	if !released {
+		q.ready = nil
+	}
+	q.lock.Unlock()
+	if released {
+		return nil, nil
+	}
+
+	q.pending[j.Handle] = j
+	q.forgetKnown(j.Handle)
+	return j, nil
+}
+
+// Peek returns the job PopJob would return, without starting a claim.
+func (q *RedisJobQueue) Peek() (*Job, error) {
+	j, _ := q.next()
+	return j, nil
+}
+
+// next picks the claimed job or a local one, none while redis may hold a
+// job of a higher priority than the local one.
+func (q *RedisJobQueue) next() (j *Job, claimed bool) {
+	local, _ := q.local.Peek()
+	q.lock.Lock()
+	ready := q.ready
+	q.lock.Unlock()
+
+	if ready != nil && (local == nil || ready.Priority > local.Priority) {
+		return ready, true
+	}
+	if local != nil && (ready != nil || local.Priority >= PRIORITY_HIGH || atomic.LoadInt64(&q.count) == 0) {
+		return local, false
+	}
+	return nil, false
+}
+
+// claim moves the next job queued in redis to the pending list of this
+// server in the background, one claim at a time.
+func (q *RedisJobQueue) claim() {
+	q.lock.Lock()
+	if q.claiming || q.ready != nil {
+		q.lock.Unlock()
+		return
+	}
+	q.claiming = true
+	q.lock.Unlock()
+
+	q.claimFrom(PRIORITY_HIGH, atomic.LoadInt64(&q.count))
+}
+
+// claimFrom pops the lists from priority p down, seen is the count of the
+// jobs in redis when it started. The callbacks run on the connection
+// goroutine.
+func (q *RedisJobQueue) claimFrom(p int, seen int64) {
+	if p < PRIORITY_LOW {
+		//redis is empty, unless some server pushed meanwhile
+		atomic.CompareAndSwapInt64(&q.count, seen, 0)
+		q.claimed(nil, false, nil)
+		return
+	}
+
+	q.client.async(func(replies []interface{}, err error) {
+		if err != nil {
+			q.claimed(nil, uncertain(err), err)
+			return
+		}
+		h, ok := replies[0].([]byte)
+		if !ok {
+			q.claimFrom(p-1, seen)
+			return
+		}
+
+		if c := atomic.AddInt64(&q.count, -1); c < 0 {
+			atomic.CompareAndSwapInt64(&q.count, c, 0)
+		}
+		q.claimHandle(p, string(h))
+	}, []string{"RPOPLPUSH", q.listKey(p), q.pendingKey()})
+}
+
+func (q *RedisJobQueue) claimHandle(p int, handle string) {
+	q.client.async(func(replies []interface{}, err error) {
+		var j *Job
+		if err == nil {
+			j, err = decodeJob(replies[0])
+		}
+		if err != nil {
+			//the handle is in the pending list, no worker gets it
+			q.claimed(nil, true, err)
+			return
+		}
+		if j == nil {
+			logger.Logger().W("redis queue %v: job %v has no body", q.name, handle)
+			q.client.send([]string{"LREM", q.pendingKey(), "1", handle})
+			q.forgetKnown(handle)
+			q.claimFrom(p, atomic.LoadInt64(&q.count))
+			return
+		}
+		q.claimed(j, false, nil)
+	}, []string{"HGET", q.jobsKey(), handle})
+}
+
+// claimed ends a claim, the server is woken with a job claimed or without,
+// a local job may wait for it.
+func (q *RedisJobQueue) claimed(j *Job, stranded bool, err error) {
+	if err != nil {
+		logger.Logger().W("redis queue %v: claim %v", q.name, err)
+	}
+
+	q.lock.Lock()
+	q.ready, q.readyAt = j, time.Now()
+	q.claiming = false
+	if stranded {
+		q.stranded = true
+	}
+	wake := q.wake
+	q.lock.Unlock()
+
+	if wake != nil {
+		wake()
+	}
+}
+
+// release queues a claimed job no worker popped within a refresh again,
+// ahead of the others of its priority, so another server may run it.
+func (q *RedisJobQueue) release() error {
+	q.lock.Lock()
+	j := q.ready
+	if j == nil || q.claiming || time.Since(q.readyAt) < q.store.opts.Refresh {
+		q.lock.Unlock()
+		return nil
+	}
+	q.ready, q.claiming = nil, true
+	q.lock.Unlock()
+
+	_, err := q.client.do(transaction(
+		[]string{"LREM", q.pendingKey(), "1", j.Handle},
+		[]string{"RPUSH", q.listKey(j.Priority), j.Handle})...)
+
+	q.lock.Lock()
+	q.claiming = false
+	if err != nil {
+		q.stranded = true
+	}
+	q.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&q.count, 1)
+	q.setKnown(j)
+	return nil
+}
+
+func (q *RedisJobQueue) forget(j *Job) [][]string {
+	cmds := [][]string{
+		{"HDEL", q.jobsKey(), j.Handle},
+		{"DECRBY", q.bytesKey(), strconv.Itoa(len(j.Data))},
+	}
+	if len(j.Id) > 0 {
+		cmds = append(cmds, []string{"HDEL", q.uniqueKey(), j.Id})
+	}
+	return cmds
+}
+
+// RemoveJob returns the job if it was still queued, a job this server
+// popped is only deleted, without waiting for redis. Only the jobs GetJob
+// finds are looked for in redis.
+func (q *RedisJobQueue) RemoveJob(handle string) (*Job, error) {
+	if j, _ := q.local.RemoveJob(handle); j != nil {
+		return j, nil
+	}
+
+	if j, ok := q.pending[handle]; ok {
+		delete(q.pending, handle)
+		cmds := append([][]string{{"LREM", q.pendingKey(), "1", handle}}, q.forget(j)...)
+		q.client.send(transaction(cmds...)...)
+		return nil, nil
+	}
+
+	q.lock.Lock()
+	ready := q.ready
+	if ready != nil && ready.Handle == handle {
+		q.ready = nil
+	} else {
+		ready = nil
+	}
+	q.lock.Unlock()
+	if ready != nil {
+		cmds := append([][]string{{"LREM", q.pendingKey(), "1", handle}}, q.forget(ready)...)
+		q.client.send(transaction(cmds...)...)
+		q.forgetKnown(handle)
+		return ready, nil
+	}
+
+	if known, _ := q.GetJob(handle); known == nil {
+		return nil, nil
+	}
+	j, err := q.fetch(handle)
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		q.forgetKnown(handle)
+		return nil, nil
+	}
+
+	replies, err := q.client.do([]string{"LREM", q.listKey(j.Priority), "1", handle})
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := replies[0].(int64); n == 0 {
+		return nil, nil //running on some server
+	}
+
+	atomic.AddInt64(&q.count, -1)
+	q.forgetKnown(handle)
+	q.client.send(transaction(q.forget(j)...)...)
+	return j, nil
+}
+
+// GetJob does not wait for redis, it finds the jobs this server pushed or
+// found queued when it started, without their data, until some server has
+// finished them. A job another server runs is still returned as queued.
+func (q *RedisJobQueue) GetJob(handle string) (*Job, error) {
+	if j, _ := q.local.GetJob(handle); j != nil {
+		return j, nil
+	}
+	if j, ok := q.pending[handle]; ok {
+		return j, nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.ready != nil && q.ready.Handle == handle {
+		return q.ready, nil
+	}
+	return q.known[handle], nil
+}
+
+// GetJobByUnique does not wait for redis either, it finds the jobs GetJob
+// finds.
+func (q *RedisJobQueue) GetJobByUnique(id string) (*Job, error) {
+	if j, _ := q.local.GetJobByUnique(id); j != nil {
+		return j, nil
+	}
+	for _, j := range q.pending {
+		if j.Id == id {
+			return j, nil
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.ready != nil && q.ready.Id == id {
+		return q.ready, nil
+	}
+	if handle, ok := q.uniques[id]; ok {
+		return q.known[handle], nil
+	}
+	return nil, nil
+}
+
+// Jobs lists every priority in pop order, the local jobs and the claimed
+// one first.
+func (q *RedisJobQueue) Jobs(offset, limit int) ([]*Job, error) {
+	local, _ := q.local.Jobs(0, -1)
+	q.lock.Lock()
+	if q.ready != nil {
+		local = append(local, q.ready)
+	}
+	q.lock.Unlock()
+
+	lengths, err := q.client.do(
+		[]string{"LLEN", q.listKey(PRIORITY_HIGH)},
+		[]string{"LLEN", q.listKey(PRIORITY_NORMAL)},
+		[]string{"LLEN", q.listKey(PRIORITY_LOW)})
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0)
+	full := func() bool { return limit >= 0 && len(jobs) >= limit }
+
+	for i, p := 0, PRIORITY_HIGH; p >= PRIORITY_LOW; i, p = i+1, p-1 {
+		for _, j := range local {
+			if j.Priority != p {
+				continue
+			}
+			if full() {
+				return jobs, nil
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			jobs = append(jobs, j)
+		}
+
+		n := int(lengths[i].(int64))
+		if offset >= n {
+			offset -= n
+			continue
+		}
+		want := n - offset
+		if limit >= 0 && want > limit-len(jobs) {
+			want = limit - len(jobs)
+		}
+		if want <= 0 {
+			return jobs, nil
+		}
+
+		//pop order is right to left
+		replies, err := q.client.do([]string{"LRANGE", q.listKey(p),
+			strconv.Itoa(-(offset + want)), strconv.Itoa(-(offset + 1))})
+		if err != nil {
+			return nil, err
+		}
+		offset = 0
+
+		handles, _ := replies[0].([]interface{})
+		if len(handles) == 0 {
+			continue
+		}
+		cmd := []string{"HMGET", q.jobsKey()}
+		for k := len(handles) - 1; k >= 0; k-- {
+			cmd = append(cmd, string(handles[k].([]byte)))
+		}
+		replies, err = q.client.do(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		bodies, _ := replies[0].([]interface{})
+		for _, body := range bodies {
+			if j, err := decodeJob(body); err == nil && j != nil {
+				jobs = append(jobs, j)
+			}
+		}
+	}
+
+	return jobs, nil
+}
+
+// Length leaves out the jobs in redis while a claim runs, a worker asking
+// meanwhile gets none and the claim wakes the server.
+func (q *RedisJobQueue) Length() int {
+	n := q.local.Length()
+	q.lock.Lock()
+	if q.ready != nil {
+		n++
+	}
+	claiming := q.claiming
+	q.lock.Unlock()
+
+	if !claiming {
+		n += int(atomic.LoadInt64(&q.count))
+	}
+	return n
+}
+
+// Stats counts the bytes of the jobs running on any server too.
+func (q *RedisJobQueue) Stats() storage.Stats {
+	stats := q.local.Stats()
+	stats.Count += int(atomic.LoadInt64(&q.count))
+	q.lock.Lock()
+	if q.ready != nil {
+		stats.Count++
+	}
+	q.lock.Unlock()
+	stats.Bytes += atomic.LoadInt64(&q.bytes)
+
+	if oldest := atomic.LoadInt64(&q.oldest); oldest != 0 {
+		if age := time.Since(time.Unix(0, oldest)); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
+
+// refresh reads the counters, the oldest job is the oldest one next to pop
+// of every priority.
+func (q *RedisJobQueue) refresh() error {
+	cmds := [][]string{{"GET", q.bytesKey()}}
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW; p-- {
+		cmds = append(cmds, []string{"LLEN", q.listKey(p)}, []string{"LINDEX", q.listKey(p), "-1"})
+	}
+	replies, err := q.client.do(cmds...)
+	if err != nil {
+		return err
+	}
+
+	bytes, _ := strconv.ParseInt(string(asBytes(replies[0])), 10, 64)
+	count := int64(0)
+	fronts := []string{"HMGET", q.jobsKey()}
+	for i := 1; i < len(replies); i += 2 {
+		n, _ := replies[i].(int64)
+		count += n
+		if h, ok := replies[i+1].([]byte); ok {
+			fronts = append(fronts, string(h))
+		}
+	}
+
+	oldest := int64(0)
+	if len(fronts) > 2 {
+		replies, err := q.client.do(fronts)
+		if err != nil {
+			return err
+		}
+		bodies, _ := replies[0].([]interface{})
+		for _, body := range bodies {
+			if j, err := decodeJob(body); err == nil && j != nil {
+				if createAt := j.CreateAt.UnixNano(); oldest == 0 || createAt < oldest {
+					oldest = createAt
+				}
+			}
+		}
+	}
+
+	atomic.StoreInt64(&q.count, count)
+	atomic.StoreInt64(&q.bytes, bytes)
+	atomic.StoreInt64(&q.oldest, oldest)
+	return q.prune()
+}
+
+// prune drops the jobs some server finished from the handle index.
+func (q *RedisJobQueue) prune() error {
+	q.lock.Lock()
+	handles := make([]string, 0, len(q.known))
+	jobs := make([]*Job, 0, len(q.known))
+	for handle, j := range q.known {
+		handles = append(handles, handle)
+		jobs = append(jobs, j)
+	}
+	q.lock.Unlock()
+
+	for len(handles) > 0 {
+		n := len(handles)
+		if n > pruneBatch {
+			n = pruneBatch
+		}
+		cmd := append([]string{"HMGET", q.jobsKey()}, handles[:n]...)
+		replies, err := q.client.do(cmd)
+		if err != nil {
+			return err
+		}
+
+		bodies, _ := replies[0].([]interface{})
+		q.lock.Lock()
+		for i, body := range bodies {
+			//unless it was pushed again meanwhile
+			if body == nil && q.known[handles[i]] == jobs[i] {
+				q.dropKnown(handles[i])
+			}
+		}
+		q.lock.Unlock()
+		handles, jobs = handles[n:], jobs[n:]
+	}
+	return nil
+}
+
+func asBytes(reply interface{}) []byte {
+	b, _ := reply.([]byte)
+	return b
+}
+
+// Close leaves the pending jobs to the next start of this server.
+func (q *RedisJobQueue) Close() error {
+	q.store.unregister(q)
+	return nil
+}
@@ -0,0 +1,419 @@
+package redis
+
+import (
+	. "common"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "redis-test")
+	if err != nil {
+		panic(err)
+	}
+	logger.Initialize("test", "error", dir+"/")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func startFake(t *testing.T) *fakeServer {
+	fake, err := newFakeServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+	return fake
+}
+
+// openQueue opens the queue of function f as server node, the refresh loop
+// is left to the test
+func openQueue(t *testing.T, fake *fakeServer, node string) *RedisJobQueue {
+	s, err := Open(Options{Addr: fake.Addr(), Node: node, Timeout: 100 * time.Millisecond, Refresh: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := s.Queue("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.(*RedisJobQueue)
+}
+
+// waitConnected waits for the client to connect again after a dropped
+// connection
+func waitConnected(t *testing.T, q *RedisJobQueue) {
+	time.Sleep(2 * minReconnectDelay)
+	for i := 0; atomic.LoadInt32(&q.client.connected) == 0; i++ {
+		if i == 100 {
+			t.Fatal("not connected again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func bgJob(handle string, priority int) *Job {
+	return &Job{Handle: handle, FuncName: "f", Data: []byte(handle), Priority: priority, IsBackGround: true}
+}
+
+// waitClaimed waits for the claim a pop started
+func waitClaimed(t *testing.T, q *RedisJobQueue) {
+	for i := 0; ; i++ {
+		q.lock.Lock()
+		claiming := q.claiming
+		q.lock.Unlock()
+		if !claiming {
+			return
+		}
+		if i == 300 {
+			t.Fatal("claim not done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pop pops again after the claim a pop without a job started
+func pop(t *testing.T, q *RedisJobQueue) *Job {
+	j, err := q.PopJob()
+	if err == nil && j == nil {
+		waitClaimed(t, q)
+		j, err = q.PopJob()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func popAll(t *testing.T, q *RedisJobQueue) []string {
+	var handles []string
+	for {
+		j := pop(t, q)
+		if j == nil {
+			return handles
+		}
+		handles = append(handles, j.Handle)
+	}
+}
+
+func TestPushPopOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  []*Job
+		front []*Job
+		want  []string
+	}{
+		{
+			name: "fifo",
+			jobs: []*Job{bgJob("a", PRIORITY_NORMAL), bgJob("b", PRIORITY_NORMAL), bgJob("c", PRIORITY_NORMAL)},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "priorities",
+			jobs: []*Job{bgJob("low", PRIORITY_LOW), bgJob("normal", PRIORITY_NORMAL), bgJob("high", PRIORITY_HIGH)},
+			want: []string{"high", "normal", "low"},
+		},
+		{
+			name:  "front",
+			jobs:  []*Job{bgJob("a", PRIORITY_NORMAL), bgJob("b", PRIORITY_NORMAL)},
+			front: []*Job{bgJob("requeued", PRIORITY_NORMAL)},
+			want:  []string{"requeued", "a", "b"},
+		},
+		{
+			name: "local jobs first within a priority",
+			jobs: []*Job{bgJob("redis", PRIORITY_NORMAL), {Handle: "local", Priority: PRIORITY_NORMAL},
+				bgJob("redis-high", PRIORITY_HIGH)},
+			want: []string{"redis-high", "local", "redis"},
+		},
+	}
+
+	for _, tt := range tests {
+		q := openQueue(t, startFake(t), "n1")
+		for _, j := range tt.jobs {
+			if err := q.PushJob(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, j := range tt.front {
+			if err := q.PushJobFront(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := q.Length(); n != len(tt.want) {
+			t.Errorf("%v: length %v, want %v", tt.name, n, len(tt.want))
+		}
+		if got := popAll(t, q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: popped %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveJob(t *testing.T) {
+	fake := startFake(t)
+	q := openQueue(t, fake, "n1")
+	q.PushJob(bgJob("a", PRIORITY_NORMAL))
+	unique := bgJob("b", PRIORITY_NORMAL)
+	unique.Id = "ub"
+	q.PushJob(unique)
+
+	if j, _ := q.GetJobByUnique("ub"); j == nil || j.Handle != "b" {
+		t.Errorf("get unique ub: %v", j)
+	}
+	if j, _ := q.RemoveJob("b"); j == nil || string(j.Data) != "b" {
+		t.Errorf("remove b: %v", j)
+	}
+	if j, _ := q.RemoveJob("b"); j != nil {
+		t.Errorf("remove b twice: %v", j)
+	}
+	if j, _ := q.GetJob("b"); j != nil {
+		t.Errorf("get b after remove: %v", j)
+	}
+
+	//a popped job is only deleted
+	if j := pop(t, q); j == nil || j.Handle != "a" {
+		t.Fatalf("pop a: %v", j)
+	}
+	if j, _ := q.RemoveJob("a"); j != nil {
+		t.Errorf("remove running a: %v", j)
+	}
+
+	q.refresh()
+	fake.lock.Lock()
+	left := len(fake.hashes[q.jobsKey()]) + len(fake.hashes[q.uniqueKey()]) + len(fake.lists[q.pendingKey()])
+	bytes := fake.strings[q.bytesKey()]
+	fake.lock.Unlock()
+	if left != 0 || bytes != "0" || q.Length() != 0 {
+		t.Errorf("left %v keys, %v bytes, length %v", left, bytes, q.Length())
+	}
+}
+
+func TestPendingRecovery(t *testing.T) {
+	fake := startFake(t)
+	q := openQueue(t, fake, "n1")
+	for _, h := range []string{"a", "b", "c"} {
+		q.PushJob(bgJob(h, PRIORITY_NORMAL))
+	}
+	pop(t, q)
+	pop(t, q)
+
+	//another server does not take the running jobs of n1
+	other := openQueue(t, fake, "n2")
+	if n := other.Length(); n != 1 {
+		t.Errorf("length on n2 %v, want 1", n)
+	}
+
+	//n1 starts again
+	restarted := openQueue(t, fake, "n1")
+	if n := restarted.Length(); n != 3 {
+		t.Errorf("length after restart %v, want 3", n)
+	}
+	if j, _ := restarted.GetJob("a"); j == nil || j.Data != nil {
+		t.Errorf("indexed a: %v", j)
+	}
+	if got := popAll(t, restarted); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("popped %v", got)
+	}
+}
+
+func TestSharedQueue(t *testing.T) {
+	fake := startFake(t)
+	n1 := openQueue(t, fake, "n1")
+	n2 := openQueue(t, fake, "n2")
+
+	n1.PushJob(bgJob("a", PRIORITY_NORMAL))
+	n1.PushJob(bgJob("b", PRIORITY_NORMAL))
+
+	//n2 learns of them on its refresh
+	if err := n2.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if j := pop(t, n2); j == nil || j.Handle != "a" {
+		t.Fatalf("n2 popped %v", j)
+	}
+	if j := pop(t, n1); j == nil || j.Handle != "b" {
+		t.Fatalf("n1 popped %v", j)
+	}
+	if j := pop(t, n1); j != nil {
+		t.Errorf("popped %v twice", j.Handle)
+	}
+
+	//n1 still reports a as queued until n2 finished it
+	if j, _ := n1.GetJob("a"); j == nil {
+		t.Errorf("a not known on n1")
+	}
+	n2.RemoveJob("a")
+	time.Sleep(50 * time.Millisecond) //the delete is not waited for
+	if err := n1.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := n1.GetJob("a"); j != nil {
+		t.Errorf("finished a still known on n1: %v", j)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		running bool //a is popped before redis gets slow
+		op      func(q *RedisJobQueue, running *Job) error
+		want    error
+	}{
+		{
+			//does not wait, the claim gets a later
+			name: "pop",
+			op: func(q *RedisJobQueue, running *Job) error {
+				j, err := q.PopJob()
+				if j != nil {
+					t.Errorf("pop: popped %v at once", j.Handle)
+				}
+				return err
+			},
+		},
+		{
+			name: "push",
+			op: func(q *RedisJobQueue, running *Job) error {
+				return q.PushJob(bgJob("b", PRIORITY_NORMAL))
+			},
+			want: timedOut,
+		},
+		{
+			name:    "push of a running job",
+			running: true,
+			op: func(q *RedisJobQueue, running *Job) error {
+				return q.PushJobFront(running)
+			},
+			want: timedOut,
+		},
+	}
+
+	for _, tt := range tests {
+		fake := startFake(t)
+		q := openQueue(t, fake, "n1")
+		//the first pop finds a
+		q.PushJob(bgJob("a", PRIORITY_HIGH))
+		var running *Job
+		if tt.running {
+			running = pop(t, q)
+		}
+
+		//the commands run, their replies come too late
+		fake.setDelay(time.Second)
+		start := time.Now()
+		if err := tt.op(q, running); err != tt.want {
+			t.Errorf("%v: err %v, want %v", tt.name, err, tt.want)
+		}
+		if waited := time.Since(start); waited > 2*q.store.opts.Timeout {
+			t.Errorf("%v: waited %v", tt.name, waited)
+		}
+		fake.setDelay(0)
+		waitConnected(t, q)
+		//the refresh loop counts what the failed request queued
+		if err := q.refresh(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := popAll(t, q); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("%v: popped %v, want [a]", tt.name, got)
+		}
+		if j, _ := q.GetJob("b"); j != nil {
+			t.Errorf("%v: failed push known: %v", tt.name, j)
+		}
+	}
+}
+
+func TestOpenNeedsNode(t *testing.T) {
+	fake := startFake(t)
+	if _, err := Open(Options{Addr: fake.Addr()}); err != missingNode {
+		t.Errorf("err %v, want %v", err, missingNode)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	fake := startFake(t)
+	n1 := openQueue(t, fake, "n1")
+	for i := 0; i < 3*pruneBatch; i++ {
+		j := bgJob("h"+strconv.Itoa(i), i%(PRIORITY_HIGH+1))
+		j.Id = "u" + strconv.Itoa(i)
+		n1.PushJob(j)
+	}
+	running := pop(t, n1)
+
+	n2 := openQueue(t, fake, "n2")
+	if err := n2.index(); err != nil {
+		t.Fatal(err)
+	}
+	n2.lock.Lock()
+	if len(n2.known) != 3*pruneBatch {
+		t.Errorf("%v jobs indexed, want %v", len(n2.known), 3*pruneBatch)
+	}
+	for handle, j := range n2.known {
+		if j.Data != nil || j.Handle != handle || "h"+j.Id[1:] != handle {
+			t.Errorf("indexed %v as %+v", handle, j)
+			break
+		}
+	}
+	if j := n2.known[running.Handle]; j == nil {
+		t.Errorf("running %v not indexed", running.Handle)
+	}
+	n2.lock.Unlock()
+
+	//the unique ids are looked up without asking redis
+	fake.setDelay(time.Second)
+	if j, _ := n2.GetJobByUnique("u1"); j == nil || j.Handle != "h1" {
+		t.Errorf("get unique u1: %v", j)
+	}
+	if j, _ := n2.GetJobByUnique(running.Id); j == nil || j.Handle != running.Handle {
+		t.Errorf("get unique of running %v: %v", running.Handle, j)
+	}
+	fake.setDelay(0)
+
+	n1.RemoveJob(running.Handle)
+	n1.refresh()
+	n2.prune()
+	if j, _ := n2.GetJobByUnique(running.Id); j != nil {
+		t.Errorf("get unique of finished %v: %v", running.Handle, j)
+	}
+}
+
+func TestClaimWakes(t *testing.T) {
+	fake := startFake(t)
+	n1 := openQueue(t, fake, "n1")
+	woken := make(chan bool, 10)
+	n1.SetWaker(func() { woken <- true })
+	n1.PushJob(bgJob("a", PRIORITY_NORMAL))
+
+	if j, _ := n1.PopJob(); j != nil {
+		t.Fatalf("popped %v without a claim", j.Handle)
+	}
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Fatal("not woken")
+	}
+	if n := n1.Length(); n != 1 {
+		t.Errorf("length %v after the claim, want 1", n)
+	}
+
+	//a claimed job no worker took goes back to the others
+	n1.lock.Lock()
+	n1.readyAt = time.Now().Add(-time.Hour)
+	n1.lock.Unlock()
+	if err := n1.release(); err != nil {
+		t.Fatal(err)
+	}
+	n2 := openQueue(t, fake, "n2")
+	if j := pop(t, n2); j == nil || j.Handle != "a" {
+		t.Errorf("n2 popped %v, want a", j)
+	}
+	if j := pop(t, n1); j != nil {
+		t.Errorf("n1 popped %v after the release", j.Handle)
+	}
+}
@@ -0,0 +1,103 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+)
+
+/*
+The RESP subset spoken to redis, a command is an array of bulk strings and
+a reply is one of
+
++simple string   - string
+-error           - redisError
+:integer         - int64
+$bulk string     - []byte, nil for $-1
+*array           - []interface{}, nil for *-1
+*/
+
+var (
+	protocolError = errors.New("redis protocol error")
+)
+
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func writeCommand(w *bufio.Writer, args []string) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(len(args)))
+	w.WriteString("\r\n")
+	for _, arg := range args {
+		w.WriteByte('$')
+		w.WriteString(strconv.Itoa(len(arg)))
+		w.WriteString("\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", protocolError
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, protocolError
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < -1 {
+			return nil, protocolError
+		}
+		if size == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, protocolError
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, protocolError
+}
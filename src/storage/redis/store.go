@@ -0,0 +1,174 @@
+package redis
+
+import (
+	"errors"
+	"storage"
+	"strconv"
+	"sync"
+	"time"
+	"utils/logger"
+)
+
+const (
+	DefaultAddr    = "127.0.0.1:6379"
+	DefaultPrefix  = "gearman:"
+	DefaultTimeout = 200 * time.Millisecond
+	DefaultRefresh = time.Second
+)
+
+var (
+	invalidOption = errors.New("invalid redis option")
+	missingNode   = errors.New("redis node option missing")
+	unreachable   = errors.New("redis unreachable")
+)
+
+type Options struct {
+	Addr     string
+	Password string
+	Db       int
+	Prefix   string        //of all keys, servers sharing a backlog use the same
+	Node     string        //names the list of the jobs this server runs, unique per server
+	Timeout  time.Duration //of a request sent from the event loop
+	Refresh  time.Duration //queue lengths and stats are read again this often
+}
+
+func init() {
+	storage.Register("redis", openBackend)
+}
+
+// openBackend takes the options addr, password, db, prefix, node, timeout
+// and refresh, node is required.
+func openBackend(options map[string]string) (storage.Backend, error) {
+	opts := Options{}
+	for key, value := range options {
+		var err error
+		switch key {
+		case "addr":
+			opts.Addr = value
+		case "password":
+			opts.Password = value
+		case "db":
+			opts.Db, err = strconv.Atoi(value)
+		case "prefix":
+			opts.Prefix = value
+		case "node":
+			opts.Node = value
+		case "timeout":
+			opts.Timeout, err = time.ParseDuration(value)
+		case "refresh":
+			opts.Refresh, err = time.ParseDuration(value)
+		default:
+			return nil, storage.ErrInvalidOption
+		}
+		if err != nil {
+			return nil, invalidOption
+		}
+	}
+
+	return Open(opts)
+}
+
+// Store keeps the queues of all functions in one redis, see RedisJobQueue
+// for the keys.
+type Store struct {
+	opts   Options
+	client *client
+	lock   sync.Mutex
+	queues []*RedisJobQueue
+}
+
+// Open waits for the first connection, later reconnects happen in the
+// background. Two servers with the same Node would take each other's
+// running jobs for their own, the server passes its node id.
+func Open(opts Options) (*Store, error) {
+	if opts.Node == "" {
+		return nil, missingNode
+	}
+	if opts.Addr == "" {
+		opts.Addr = DefaultAddr
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Refresh <= 0 {
+		opts.Refresh = DefaultRefresh
+	}
+
+	s := &Store{opts: opts}
+	s.client = newClient(&s.opts)
+	if !s.client.waitConnected(maxReconnectDelay) {
+		return nil, unreachable
+	}
+
+	go s.refreshLoop()
+	return s, nil
+}
+
+func (s *Store) queuesKey() string {
+	return s.opts.Prefix + "queues"
+}
+
+// Names returns the queues any server sharing the prefix created.
+func (s *Store) Names() ([]string, error) {
+	replies, err := s.client.do([]string{"SMEMBERS", s.queuesKey()})
+	if err != nil {
+		return nil, err
+	}
+
+	members, _ := replies[0].([]interface{})
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		if b, ok := m.([]byte); ok {
+			names = append(names, string(b))
+		}
+	}
+	return names, nil
+}
+
+func (s *Store) Queue(name string) (storage.JobQueue, error) {
+	q := &RedisJobQueue{store: s}
+	if err := q.Initial(name); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (s *Store) register(q *RedisJobQueue) {
+	s.lock.Lock()
+	s.queues = append(s.queues, q)
+	s.lock.Unlock()
+}
+
+func (s *Store) unregister(q *RedisJobQueue) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, registered := range s.queues {
+		if registered == q {
+			s.queues = append(s.queues[:i], s.queues[i+1:]...)
+			return
+		}
+	}
+}
+
+// refreshLoop reads what other servers sharing the backlog changed.
+func (s *Store) refreshLoop() {
+	tick := time.NewTicker(s.opts.Refresh)
+	for range tick.C {
+		s.lock.Lock()
+		queues := append([]*RedisJobQueue(nil), s.queues...)
+		s.lock.Unlock()
+
+		for _, q := range queues {
+			if err := q.release(); err != nil && err != unavailable {
+				logger.Logger().W("redis queue %v: release %v", q.name, err)
+			}
+			if err := q.refresh(); err != nil && err != unavailable {
+				logger.Logger().W("redis queue %v: refresh %v", q.name, err)
+			}
+		}
+	}
+}
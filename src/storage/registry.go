@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownBackend = errors.New("unknown storage backend")
+	ErrInvalidOption  = errors.New("invalid storage option")
+
+	backendsLock sync.Mutex
+	backends     = make(map[string]Factory)
+)
+
+// Backend creates the queues of one storage, Names lists the queues it
+// still has jobs of from a previous run.
+type Backend interface {
+	Queue(name string) (JobQueue, error)
+	Names() ([]string, error)
+}
+
+// Factory opens a backend with its options, unknown options should return
+// ErrInvalidOption.
+type Factory func(options map[string]string) (Backend, error)
+
+// Register makes a backend available by name, it is usually called from the
+// init function of the backend package.
+func Register(name string, factory Factory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if _, ok := backends[name]; ok {
+		panic("storage backend registered twice: " + name)
+	}
+	backends[name] = factory
+}
+
+func Open(name string, options map[string]string) (Backend, error) {
+	backendsLock.Lock()
+	factory, ok := backends[name]
+	backendsLock.Unlock()
+
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+	if options == nil {
+		options = make(map[string]string)
+	}
+	return factory(options)
+}
+
+// Backends returns the registered backend names.
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseOptions reads "backend.key=value,..." into the options of every
+// backend, e.g. "wal.dir=/var/lib/gearmand,wal.sync=always".
+func ParseOptions(spec string) (map[string]map[string]string, error) {
+	options := make(map[string]map[string]string)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		eq := strings.IndexByte(entry, '=')
+		dot := strings.IndexByte(entry, '.')
+		if eq < 0 || dot <= 0 || dot > eq-2 {
+			return nil, ErrInvalidOption
+		}
+
+		backend := entry[:dot]
+		if options[backend] == nil {
+			options[backend] = make(map[string]string)
+		}
+		options[backend][entry[dot+1:eq]] = entry[eq+1:]
+	}
+
+	return options, nil
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+type nopBackend struct {
+	options map[string]string
+}
+
+func (b *nopBackend) Queue(name string) (JobQueue, error) { return nil, nil }
+func (b *nopBackend) Names() ([]string, error)            { return nil, nil }
+
+// useRegistry gives the test an empty registry, the backends of the
+// package are back once it is done
+func useRegistry(t *testing.T) {
+	backendsLock.Lock()
+	saved := backends
+	backends = make(map[string]Factory)
+	backendsLock.Unlock()
+
+	t.Cleanup(func() {
+		backendsLock.Lock()
+		backends = saved
+		backendsLock.Unlock()
+	})
+}
+
+func TestRegisterAndOpen(t *testing.T) {
+	useRegistry(t)
+	Register("test-nop", func(options map[string]string) (Backend, error) {
+		if options["bad"] != "" {
+			return nil, ErrInvalidOption
+		}
+		return &nopBackend{options: options}, nil
+	})
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		err     error
+	}{
+		{"test-nop", nil, nil},
+		{"test-nop", map[string]string{"dir": "/tmp"}, nil},
+		{"test-nop", map[string]string{"bad": "1"}, ErrInvalidOption},
+		{"test-none", nil, ErrUnknownBackend},
+	}
+	for _, tt := range tests {
+		b, err := Open(tt.name, tt.options)
+		if err != tt.err {
+			t.Errorf("%v %v: err %v, want %v", tt.name, tt.options, err, tt.err)
+			continue
+		}
+		if err == nil && b.(*nopBackend).options == nil {
+			t.Errorf("%v %v: factory got nil options", tt.name, tt.options)
+		}
+	}
+
+	if names := Backends(); !reflect.DeepEqual(names, []string{"test-nop"}) {
+		t.Errorf("backends %v", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a name twice did not panic")
+		}
+	}()
+	Register("test-nop", nil)
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]map[string]string
+		ok   bool
+	}{
+		{"", map[string]map[string]string{}, true},
+		{"wal.dir=/var/lib/gearmand, wal.sync=always,redis.addr=h:6379", map[string]map[string]string{
+			"wal":   {"dir": "/var/lib/gearmand", "sync": "always"},
+			"redis": {"addr": "h:6379"},
+		}, true},
+		{"sql.dsn=user:pw@/db?a=b", map[string]map[string]string{"sql": {"dsn": "user:pw@/db?a=b"}}, true},
+		{"wal.dir=", map[string]map[string]string{"wal": {"dir": ""}}, true},
+		{"wal.dir", nil, false},
+		{"dir=/tmp", nil, false},
+		{".dir=/tmp", nil, false},
+		{"wal.=/tmp", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOptions(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err %v", tt.spec, err)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
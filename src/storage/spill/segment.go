@@ -0,0 +1,136 @@
+package spill
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "common"
+)
+
+/*
+The spilled jobs of one priority have their data in a chain of segment
+files named <priority>-<seq>.spill, appended to in push order. Only the
+tail segment is written, a segment is deleted once all its jobs were paged
+in or removed.
+*/
+
+type segment struct {
+	path string
+	size int64
+	live int //jobs not paged in or removed yet
+}
+
+// entry is a spilled job, the job stays in memory without its data so the
+// server may keep pointing at it
+type entry struct {
+	job    *Job
+	seg    *segment
+	offset int64
+	bytes  int
+}
+
+type chain struct {
+	dir      string
+	priority int
+	entries  *list.List //*entry in pop order
+	tail     *segment
+	tailFile *os.File
+	readSeg  *segment
+	readFile *os.File
+	segments int
+	bytes    int64
+}
+
+func newChain(dir string, priority int) *chain {
+	return &chain{dir: dir, priority: priority, entries: list.New()}
+}
+
+// append writes the data of j to the tail segment and drops it from j.
+func (c *chain) append(j *Job, seq uint64, segmentSize int64) (*list.Element, error) {
+	if c.tail == nil {
+		seg := &segment{path: filepath.Join(c.dir, fmt.Sprintf("%d-%016d.spill", c.priority, seq))}
+		f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		c.tail, c.tailFile = seg, f
+		c.segments++
+	}
+
+	if _, err := c.tailFile.Write(j.Data); err != nil {
+		c.tailFile.Truncate(c.tail.size)
+		return nil, err
+	}
+
+	e := &entry{job: j, seg: c.tail, offset: c.tail.size, bytes: len(j.Data)}
+	c.tail.size += int64(e.bytes)
+	c.tail.live++
+	c.bytes += int64(e.bytes)
+	j.Data = nil
+
+	if c.tail.size >= segmentSize {
+		c.tailFile.Close()
+		c.tail, c.tailFile = nil, nil
+	}
+
+	return c.entries.PushBack(e), nil
+}
+
+// read returns the data of a spilled job.
+func (c *chain) read(e *entry) ([]byte, error) {
+	if e.bytes == 0 {
+		return []byte{}, nil
+	}
+
+	if c.readSeg != e.seg {
+		if c.readFile != nil {
+			c.readFile.Close()
+			c.readSeg, c.readFile = nil, nil
+		}
+		f, err := os.Open(e.seg.path)
+		if err != nil {
+			return nil, err
+		}
+		c.readSeg, c.readFile = e.seg, f
+	}
+
+	data := make([]byte, e.bytes)
+	if _, err := c.readFile.ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// release forgets a spilled job, deleting its segment when it was the last
+// one there.
+func (c *chain) release(element *list.Element) {
+	e := c.entries.Remove(element).(*entry)
+	c.bytes -= int64(e.bytes)
+
+	seg := e.seg
+	if seg.live--; seg.live > 0 {
+		return
+	}
+
+	if seg == c.tail {
+		c.tailFile.Close()
+		c.tail, c.tailFile = nil, nil
+	}
+	if seg == c.readSeg {
+		c.readFile.Close()
+		c.readSeg, c.readFile = nil, nil
+	}
+	os.Remove(seg.path)
+	c.segments--
+}
+
+func (c *chain) close() {
+	if c.tailFile != nil {
+		c.tailFile.Close()
+	}
+	if c.readFile != nil {
+		c.readFile.Close()
+	}
+}
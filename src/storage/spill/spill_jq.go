@@ -0,0 +1,342 @@
+package spill
+
+import (
+	. "common"
+	"container/list"
+	"os"
+	"path/filepath"
+	"storage"
+	"time"
+)
+
+// SpillJobQueue keeps the head of every priority in an inner queue. Once the
+// inner queue holds Options.Threshold bytes of job data, the data of later
+// jobs is written to segment files and read back as workers drain the head.
+// Spilled jobs keep their place in the queue, GetJob and GetJobByUnique
+// return them without their data. Spill files are scratch space, they do
+// not survive a restart.
+type SpillJobQueue struct {
+	name     string
+	dir      string
+	opts     Options
+	inner    storage.JobQueue
+	chains   [PRIORITY_LEVELS]*chain
+	handles  map[string]*list.Element //spilled jobs only
+	uniques  map[string]*list.Element
+	memCount [PRIORITY_LEVELS]int
+	memBytes int64
+	seq      uint64
+	spilled  int64
+	pagedIn  int64
+}
+
+// Wrap returns a queue spilling to dir in front of inner, Initial
+// initialises both.
+func Wrap(inner storage.JobQueue, dir string, opts Options) *SpillJobQueue {
+	return &SpillJobQueue{inner: inner, dir: dir, opts: opts.withDefaults()}
+}
+
+func (q *SpillJobQueue) Initial(name string) error {
+	if err := q.inner.Initial(name); err != nil {
+		return err
+	}
+
+	q.name = name
+	q.handles = make(map[string]*list.Element)
+	q.uniques = make(map[string]*list.Element)
+	q.memCount = [PRIORITY_LEVELS]int{}
+	q.memBytes = 0
+
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+	if err := q.removeSegments(); err != nil {
+		return err
+	}
+	for p := range q.chains {
+		q.chains[p] = newChain(q.dir, p)
+	}
+
+	return nil
+}
+
+// removeSegments deletes what an earlier run left behind
+func (q *SpillJobQueue) removeSegments() error {
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*.spill"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func priorityOf(job *Job) int {
+	if job.Priority < PRIORITY_LOW {
+		return PRIORITY_LOW
+	} else if job.Priority > PRIORITY_HIGH {
+		return PRIORITY_HIGH
+	}
+	return job.Priority
+}
+
+func (q *SpillJobQueue) added(job *Job) {
+	q.memCount[priorityOf(job)]++
+	q.memBytes += int64(len(job.Data))
+}
+
+func (q *SpillJobQueue) removed(job *Job) {
+	q.memCount[priorityOf(job)]--
+	q.memBytes -= int64(len(job.Data))
+}
+
+func (q *SpillJobQueue) unindex(job *Job, element *list.Element) {
+	delete(q.handles, job.Handle)
+	if q.uniques[job.Id] == element {
+		delete(q.uniques, job.Id)
+	}
+}
+
+func (q *SpillJobQueue) PushJob(job *Job) error {
+	if job == nil {
+		return nil
+	}
+
+	//once a priority spills, its later jobs follow until it is paged in again
+	p := priorityOf(job)
+	c := q.chains[p]
+	if c.entries.Len() == 0 && (q.memCount[p] == 0 || q.memBytes+int64(len(job.Data)) <= q.opts.Threshold) {
+		if err := q.inner.PushJob(job); err != nil {
+			return err
+		}
+		q.added(job)
+		return nil
+	}
+
+	q.seq++
+	element, err := c.append(job, q.seq, q.opts.SegmentSize)
+	if err != nil {
+		return err
+	}
+	q.handles[job.Handle] = element
+	if len(job.Id) > 0 {
+		q.uniques[job.Id] = element
+	}
+	q.spilled++
+
+	return nil
+}
+
+func (q *SpillJobQueue) PushJobFront(job *Job) error {
+	if job == nil {
+		return nil
+	}
+
+	if err := q.inner.PushJobFront(job); err != nil {
+		return err
+	}
+	q.added(job)
+	return nil
+}
+
+// pageIn moves the first spilled job of c to the back of the inner queue.
+func (q *SpillJobQueue) pageIn(c *chain) error {
+	element := c.entries.Front()
+	e := element.Value.(*entry)
+
+	data, err := c.read(e)
+	if err != nil {
+		return err
+	}
+	e.job.Data = data
+	if err := q.inner.PushJob(e.job); err != nil {
+		e.job.Data = nil
+		return err
+	}
+
+	q.unindex(e.job, element)
+	c.release(element)
+	q.added(e.job)
+	q.pagedIn++
+	return nil
+}
+
+// fill pages in spilled jobs while the inner queue is under the threshold,
+// and at least the head of every priority.
+func (q *SpillJobQueue) fill() error {
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW; p-- {
+		c := q.chains[p]
+		for c.entries.Len() > 0 {
+			e := c.entries.Front().Value.(*entry)
+			if q.memCount[p] > 0 && q.memBytes+int64(e.bytes) > q.opts.Threshold {
+				break
+			}
+			if err := q.pageIn(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (q *SpillJobQueue) PopJob() (*Job, error) {
+	if err := q.fill(); err != nil {
+		return nil, err
+	}
+
+	job, err := q.inner.PopJob()
+	if job != nil && err == nil {
+		q.removed(job)
+	}
+	return job, err
+}
+
+func (q *SpillJobQueue) Peek() (*Job, error) {
+	if err := q.fill(); err != nil {
+		return nil, err
+	}
+	return q.inner.Peek()
+}
+
+func (q *SpillJobQueue) RemoveJob(handle string) (*Job, error) {
+	if element, ok := q.handles[handle]; ok {
+		e := element.Value.(*entry)
+		c := q.chains[priorityOf(e.job)]
+		data, err := c.read(e)
+		if err != nil {
+			return nil, err
+		}
+
+		e.job.Data = data
+		q.unindex(e.job, element)
+		c.release(element)
+		return e.job, nil
+	}
+
+	//the inner queue may also know popped jobs, which are not counted
+	queued, err := q.inner.GetJob(handle)
+	if err != nil {
+		return nil, err
+	}
+	job, err := q.inner.RemoveJob(handle)
+	if err != nil {
+		return nil, err
+	}
+	if queued != nil {
+		q.removed(queued)
+	}
+	return job, nil
+}
+
+func (q *SpillJobQueue) GetJob(handle string) (*Job, error) {
+	if element, ok := q.handles[handle]; ok {
+		return element.Value.(*entry).job, nil
+	}
+	return q.inner.GetJob(handle)
+}
+
+func (q *SpillJobQueue) GetJobByUnique(id string) (*Job, error) {
+	if element, ok := q.uniques[id]; ok {
+		return element.Value.(*entry).job, nil
+	}
+	return q.inner.GetJobByUnique(id)
+}
+
+// Jobs does not read the disk, the spilled jobs are returned without their
+// data, see JobData.
+func (q *SpillJobQueue) Jobs(offset, limit int) ([]*Job, error) {
+	memJobs, err := q.inner.Jobs(0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(memJobs) + len(q.handles)
+	if limit < 0 || limit > total {
+		limit = total
+	}
+
+	jobs := make([]*Job, 0, limit)
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW && len(jobs) < limit; p-- {
+		for _, job := range memJobs {
+			if priorityOf(job) != p || len(jobs) >= limit {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+
+		c := q.chains[p]
+		for element := c.entries.Front(); element != nil && len(jobs) < limit; element = element.Next() {
+			if offset > 0 {
+				offset--
+				continue
+			}
+
+			jobs = append(jobs, element.Value.(*entry).job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// JobData returns the data of a queued job, it reads the disk for a
+// spilled one.
+func (q *SpillJobQueue) JobData(handle string) ([]byte, error) {
+	if element, ok := q.handles[handle]; ok {
+		e := element.Value.(*entry)
+		return q.chains[priorityOf(e.job)].read(e)
+	}
+
+	job, err := q.inner.GetJob(handle)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	return job.Data, nil
+}
+
+func (q *SpillJobQueue) Length() int {
+	return q.inner.Length() + len(q.handles)
+}
+
+func (q *SpillJobQueue) Stats() storage.Stats {
+	stats := q.inner.Stats()
+	stats.Count += len(q.handles)
+
+	//a chain is in push order, a retry spilled behind its front is not seen
+	for _, c := range q.chains {
+		stats.Bytes += c.bytes
+		if front := c.entries.Front(); front != nil {
+			if age := time.Since(front.Value.(*entry).job.CreateAt); age > stats.OldestAge {
+				stats.OldestAge = age
+			}
+		}
+	}
+
+	return stats
+}
+
+func (q *SpillJobQueue) SpillStats() storage.SpillStats {
+	stats := storage.SpillStats{Jobs: len(q.handles), Spilled: q.spilled, PagedIn: q.pagedIn}
+	for _, c := range q.chains {
+		stats.Bytes += c.bytes
+		stats.Segments += c.segments
+	}
+	return stats
+}
+
+func (q *SpillJobQueue) Close() error {
+	for _, c := range q.chains {
+		if c != nil {
+			c.close()
+		}
+	}
+	q.removeSegments()
+
+	return q.inner.Close()
+}
@@ -0,0 +1,223 @@
+package spill
+
+import (
+	. "common"
+	"os"
+	"path/filepath"
+	"reflect"
+	"storage/memory"
+	"testing"
+	"time"
+)
+
+func openQueue(t *testing.T, threshold, segmentSize int64) (*SpillJobQueue, string) {
+	dir := filepath.Join(t.TempDir(), "f")
+	q := Wrap(&memory.MemJobQueue{}, dir, Options{Threshold: threshold, SegmentSize: segmentSize})
+	if err := q.Initial("f"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q, dir
+}
+
+// job has 4 bytes of data
+func job(handle string, priority int) *Job {
+	return &Job{Handle: handle, Data: []byte(handle + "----")[:4], Priority: priority, CreateAt: time.Now()}
+}
+
+func segments(t *testing.T, dir string) int {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(paths)
+}
+
+func TestSpillThreshold(t *testing.T) {
+	q, dir := openQueue(t, 10, 1024)
+
+	tests := []struct {
+		handle  string
+		spilled int
+	}{
+		{"a", 0},
+		{"b", 0},
+		{"c", 1}, //12 bytes would be over the threshold
+		{"d", 2},
+	}
+	for _, tt := range tests {
+		if err := q.PushJob(job(tt.handle, PRIORITY_NORMAL)); err != nil {
+			t.Fatal(err)
+		}
+		if stats := q.SpillStats(); stats.Jobs != tt.spilled || stats.Bytes != int64(4*tt.spilled) {
+			t.Errorf("after %v: spill stats %+v", tt.handle, stats)
+		}
+	}
+
+	if n := segments(t, dir); n != 1 {
+		t.Errorf("%v segments, want 1", n)
+	}
+	if stats := q.Stats(); stats.Count != 4 || stats.Bytes != 16 {
+		t.Errorf("stats %+v", stats)
+	}
+	if j, _ := q.GetJob("c"); j == nil || j.Data != nil {
+		t.Errorf("spilled c: %v", j)
+	}
+
+	//pops page the spilled jobs in again as the memory drains
+	for _, want := range []string{"a", "b", "c"} {
+		if j, _ := q.PopJob(); j == nil || j.Handle != want {
+			t.Fatalf("popped %v, want %v", j, want)
+		}
+	}
+	if stats := q.SpillStats(); stats.Jobs != 0 || stats.PagedIn != 2 || stats.Segments != 0 {
+		t.Errorf("spill stats after pops %+v", stats)
+	}
+	if n := segments(t, dir); n != 0 {
+		t.Errorf("%v segments left", n)
+	}
+}
+
+func TestSpillOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  []*Job
+		front []*Job
+		want  []string
+	}{
+		{
+			name: "fifo",
+			jobs: []*Job{job("a", PRIORITY_NORMAL), job("b", PRIORITY_NORMAL), job("c", PRIORITY_NORMAL),
+				job("d", PRIORITY_NORMAL), job("e", PRIORITY_NORMAL)},
+			want: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name: "per priority",
+			jobs: []*Job{job("n1", PRIORITY_NORMAL), job("l1", PRIORITY_LOW), job("n2", PRIORITY_NORMAL),
+				job("h1", PRIORITY_HIGH), job("l2", PRIORITY_LOW), job("h2", PRIORITY_HIGH), job("n3", PRIORITY_NORMAL)},
+			want: []string{"h1", "h2", "n1", "n2", "n3", "l1", "l2"},
+		},
+		{
+			name:  "front",
+			jobs:  []*Job{job("a", PRIORITY_NORMAL), job("b", PRIORITY_NORMAL), job("c", PRIORITY_NORMAL)},
+			front: []*Job{job("r", PRIORITY_NORMAL)},
+			want:  []string{"r", "a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		//two jobs fit in memory, every spilled job gets a segment
+		q, _ := openQueue(t, 8, 1)
+		for _, j := range tt.jobs {
+			if err := q.PushJob(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, j := range tt.front {
+			q.PushJobFront(j)
+		}
+		if q.SpillStats().Jobs == 0 {
+			t.Errorf("%v: nothing spilled", tt.name)
+		}
+
+		var got []string
+		for {
+			j, err := q.PopJob()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j == nil {
+				break
+			}
+			if string(j.Data) != (j.Handle + "----")[:4] {
+				t.Errorf("%v: %v data %q", tt.name, j.Handle, j.Data)
+			}
+			got = append(got, j.Handle)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: popped %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveSpilledJob(t *testing.T) {
+	q, dir := openQueue(t, 4, 1)
+	q.PushJob(job("a", PRIORITY_NORMAL))
+	q.PushJob(job("b", PRIORITY_NORMAL))
+	spilled := job("c", PRIORITY_NORMAL)
+	spilled.Id = "uc"
+	q.PushJob(spilled)
+	if n := segments(t, dir); n != 2 {
+		t.Fatalf("%v segments, want 2", n)
+	}
+
+	j, err := q.RemoveJob("c")
+	if err != nil || j == nil || string(j.Data) != "c---" {
+		t.Fatalf("remove c: %v %v", j, err)
+	}
+	if n := segments(t, dir); n != 1 {
+		t.Errorf("%v segments after remove, want 1", n)
+	}
+	if j, _ := q.GetJobByUnique("uc"); j != nil {
+		t.Errorf("removed c found by unique id")
+	}
+	if n := q.Length(); n != 2 {
+		t.Errorf("length %v, want 2", n)
+	}
+}
+
+func TestJobsWithoutData(t *testing.T) {
+	q, _ := openQueue(t, 4, 1024)
+	q.PushJob(job("a", PRIORITY_NORMAL))
+	q.PushJob(job("b", PRIORITY_NORMAL))
+
+	jobs, err := q.Jobs(0, -1)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("jobs %v %v", jobs, err)
+	}
+	if string(jobs[0].Data) != "a---" || jobs[1].Data != nil {
+		t.Errorf("listed data %q and %q", jobs[0].Data, jobs[1].Data)
+	}
+
+	for _, handle := range []string{"a", "b"} {
+		if data, err := q.JobData(handle); err != nil || string(data) != handle+"---" {
+			t.Errorf("data of %v: %q %v", handle, data, err)
+		}
+	}
+}
+
+func TestStatsOldestFront(t *testing.T) {
+	q, _ := openQueue(t, 4, 1024)
+	q.PushJob(job("a", PRIORITY_LOW))
+	old := job("old", PRIORITY_LOW)
+	old.CreateAt = time.Now().Add(-time.Hour)
+	q.PushJob(old)
+	q.PushJob(job("b", PRIORITY_LOW))
+	if n := q.SpillStats().Jobs; n != 2 {
+		t.Fatalf("%v jobs spilled, want 2", n)
+	}
+
+	if age := q.Stats().OldestAge; age < time.Hour {
+		t.Errorf("oldest age %v", age)
+	}
+}
+
+func TestFailedSegmentWrite(t *testing.T) {
+	q, dir := openQueue(t, 4, 1024)
+	q.PushJob(job("a", PRIORITY_NORMAL))
+	os.RemoveAll(dir)
+
+	j := job("b", PRIORITY_NORMAL)
+	if err := q.PushJob(j); err == nil {
+		t.Fatal("push with no spill dir succeeded")
+	}
+	if string(j.Data) != "b---" {
+		t.Errorf("failed push lost the data: %q", j.Data)
+	}
+	if got, _ := q.GetJob("b"); got != nil || q.Length() != 1 {
+		t.Errorf("failed push queued: %v, length %v", got, q.Length())
+	}
+	if stats := q.SpillStats(); stats.Jobs != 0 || stats.Segments != 0 {
+		t.Errorf("spill stats %+v", stats)
+	}
+}
@@ -0,0 +1,98 @@
+package spill
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"storage"
+	"storage/memory"
+	"strconv"
+)
+
+func init() {
+	storage.Register("spill", openBackend)
+}
+
+const (
+	DefaultThreshold   = 1024 * 1024 * 64
+	DefaultSegmentSize = 1024 * 1024 * 16
+)
+
+var (
+	missingDir = errors.New("spill dir option missing")
+)
+
+type Options struct {
+	Threshold   int64 //bytes of job data a queue keeps in memory before it spills
+	SegmentSize int64
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultThreshold
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	return opts
+}
+
+// openBackend takes the options dir, threshold (bytes) and segment (bytes),
+// dir is required.
+func openBackend(options map[string]string) (storage.Backend, error) {
+	var opts Options
+	dir := ""
+
+	for key, value := range options {
+		switch key {
+		case "dir":
+			dir = value
+		case "threshold", "segment":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size <= 0 {
+				return nil, storage.ErrInvalidOption
+			}
+			if key == "threshold" {
+				opts.Threshold = size
+			} else {
+				opts.SegmentSize = size
+			}
+		default:
+			return nil, storage.ErrInvalidOption
+		}
+	}
+
+	if dir == "" {
+		return nil, missingDir
+	}
+	return Open(dir, opts)
+}
+
+// Store spills memory queues under one directory, one sub directory per
+// queue. The queues it opens spill memory queues only, so like the memory
+// backend its jobs are lost when the server stops, Wrap spills in front of
+// the queue of another backend.
+type Store struct {
+	dir  string
+	opts Options
+}
+
+func Open(dir string, opts Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, opts: opts.withDefaults()}, nil
+}
+
+func (s *Store) Queue(name string) (storage.JobQueue, error) {
+	q := Wrap(&memory.MemJobQueue{}, filepath.Join(s.dir, url.PathEscape(name)), s.opts)
+	if err := q.Initial(name); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (s *Store) Names() ([]string, error) {
+	return nil, nil
+}
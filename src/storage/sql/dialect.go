@@ -0,0 +1,142 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+The table extends the one of the libgearman queue plugins, a table they
+created is migrated by adding the missing columns, and they can still read
+the table. The dead letter and scheduled queues of the server are kept in
+a second table of the same columns, named with the suffix _server.
+
+unique_key     - the unique id, the handle for jobs without one
+function_name  -
+priority       - libgearman order, 0 is high and 2 is low
+data           -
+when_to_run    - unix seconds, 0 to run at once
+handle         - our columns from here
+attempts       -
+seq            - order of the jobs of the same priority
+running        - 1 once popped, until removed
+created_at     - unix nano
+schedule       - cron fields of a recurring job
+node           - the server that popped a running job
+*/
+
+type dialect struct {
+	name        string
+	createSQL   string
+	columnSQL   map[string]string //the added columns
+	indexSQL    string            //table, index name and columns, run after the table is created or migrated
+	hasIndexSQL string            //counts the indexes of table and name, for a dialect without IF NOT EXISTS
+	lengthFunc  string
+	dollar      bool //postgres placeholders
+}
+
+type index struct {
+	name    string
+	columns string
+}
+
+var (
+	dialects = map[string]*dialect{
+		"sqlite": {
+			name: "sqlite",
+			createSQL: `CREATE TABLE IF NOT EXISTS %s (
+unique_key TEXT, function_name TEXT, priority INTEGER, data BLOB, when_to_run INTEGER,
+handle TEXT, attempts INTEGER DEFAULT 0, seq INTEGER DEFAULT 0, running INTEGER DEFAULT 0, created_at INTEGER DEFAULT 0, schedule TEXT, node TEXT,
+PRIMARY KEY (unique_key, function_name))`,
+			columnSQL: map[string]string{
+				"handle":     "TEXT",
+				"attempts":   "INTEGER DEFAULT 0",
+				"seq":        "INTEGER DEFAULT 0",
+				"running":    "INTEGER DEFAULT 0",
+				"created_at": "INTEGER DEFAULT 0",
+				"schedule":   "TEXT",
+				"node":       "TEXT",
+			},
+			lengthFunc: "LENGTH",
+			indexSQL:   "CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (%[3]s)",
+		},
+		"mysql": {
+			name: "mysql",
+			createSQL: `CREATE TABLE IF NOT EXISTS %s (
+unique_key VARCHAR(255), function_name VARCHAR(255), priority INT, data LONGBLOB, when_to_run INT,
+handle VARCHAR(255), attempts INT DEFAULT 0, seq BIGINT DEFAULT 0, running INT DEFAULT 0, created_at BIGINT DEFAULT 0, schedule VARCHAR(255), node VARCHAR(255),
+UNIQUE KEY (unique_key, function_name))`,
+			columnSQL: map[string]string{
+				"handle":     "VARCHAR(255)",
+				"attempts":   "INT DEFAULT 0",
+				"seq":        "BIGINT DEFAULT 0",
+				"running":    "INT DEFAULT 0",
+				"created_at": "BIGINT DEFAULT 0",
+				"schedule":   "VARCHAR(255)",
+				"node":       "VARCHAR(255)",
+			},
+			lengthFunc:  "OCTET_LENGTH",
+			indexSQL:    "CREATE INDEX %[2]s ON %[1]s (%[3]s)",
+			hasIndexSQL: "SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+		},
+		"postgres": {
+			name: "postgres",
+			createSQL: `CREATE TABLE IF NOT EXISTS %s (
+unique_key VARCHAR(255), function_name VARCHAR(255), priority INTEGER, data BYTEA, when_to_run INTEGER,
+handle VARCHAR(255), attempts INTEGER DEFAULT 0, seq BIGINT DEFAULT 0, running INTEGER DEFAULT 0, created_at BIGINT DEFAULT 0, schedule VARCHAR(255), node VARCHAR(255),
+UNIQUE (unique_key, function_name))`,
+			columnSQL: map[string]string{
+				"handle":     "VARCHAR(255)",
+				"attempts":   "INTEGER DEFAULT 0",
+				"seq":        "BIGINT DEFAULT 0",
+				"running":    "INTEGER DEFAULT 0",
+				"created_at": "BIGINT DEFAULT 0",
+				"schedule":   "VARCHAR(255)",
+				"node":       "VARCHAR(255)",
+			},
+			lengthFunc: "OCTET_LENGTH",
+			indexSQL:   "CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (%[3]s)",
+			dollar:     true,
+		},
+	}
+
+	addedColumns = []string{"handle", "attempts", "seq", "running", "created_at", "schedule", "node"}
+
+	//named after the table, for pops and handle lookups
+	indexes = []index{
+		{"pop", "function_name, running, priority, seq"},
+		{"handle", "handle"},
+	}
+)
+
+// dialectOf guesses the dialect from the driver name.
+func dialectOf(driver string) *dialect {
+	switch {
+	case strings.Contains(driver, "sqlite"):
+		return dialects["sqlite"]
+	case strings.Contains(driver, "mysql"):
+		return dialects["mysql"]
+	case strings.Contains(driver, "postgres"), driver == "pgx", driver == "pq":
+		return dialects["postgres"]
+	}
+	return nil
+}
+
+// rebind turns the ? placeholders into $n ones for postgres.
+func (d *dialect) rebind(query string) string {
+	if !d.dollar {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
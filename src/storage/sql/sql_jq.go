@@ -0,0 +1,417 @@
+package sql
+
+import (
+	. "common"
+	dbsql "database/sql"
+	"storage"
+	"storage/memory"
+	"time"
+	"utils/logger"
+)
+
+const (
+	jobColumns = "handle, unique_key, priority, data, when_to_run, attempts, created_at, schedule"
+	dueSQL     = "(when_to_run IS NULL OR when_to_run <= ?)"
+
+	//how long the count is trusted, servers sharing the table push and pop
+	//behind its back
+	recountInterval = time.Second
+)
+
+// SqlJobQueue runs on the event loop, every method is one statement or
+// transaction. Popped jobs stay in the table marked running until removed,
+// Initial queues them again.
+type SqlJobQueue struct {
+	name    string
+	store   *Store
+	table   string
+	local   *memory.MemJobQueue
+	pending map[string]bool //popped by this queue, not removed yet
+	count   int             //due jobs in the table
+	counted time.Time       //when count was read from the table
+	later   int64           //when_to_run of the next job not due yet, 0 if none
+}
+
+func (q *SqlJobQueue) Initial(name string) error {
+	q.name = name
+	q.local = &memory.MemJobQueue{}
+	q.local.Initial(name)
+	q.pending = make(map[string]bool)
+
+	//the jobs of this server, or of one older than the node column
+	res, err := q.store.db.Exec(q.query("UPDATE %s SET running = 0 WHERE function_name = ? AND running = 1 AND (node = ? OR node IS NULL)"),
+		name, q.store.node)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Logger().I("sql queue %v: %v jobs were running", name, n)
+	}
+
+	return q.recount()
+}
+
+func (q *SqlJobQueue) query(query string) string {
+	return q.store.tableQuery(q.table, query)
+}
+
+// recount counts the jobs that are due, and finds when the next job
+// libgearman scheduled is.
+func (q *SqlJobQueue) recount() error {
+	now := time.Now().Unix()
+	row := q.store.db.QueryRow(q.query("SELECT COUNT(*) FROM %s WHERE function_name = ? AND running = 0 AND "+dueSQL), q.name, now)
+	if err := row.Scan(&q.count); err != nil {
+		return err
+	}
+
+	var later dbsql.NullInt64
+	row = q.store.db.QueryRow(q.query("SELECT MIN(when_to_run) FROM %s WHERE function_name = ? AND running = 0 AND when_to_run > ?"), q.name, now)
+	if err := row.Scan(&later); err != nil {
+		return err
+	}
+	q.later = later.Int64
+	q.counted = time.Now()
+	return nil
+}
+
+// catchUp counts the jobs again once the next scheduled one is due, or
+// the count is older than recountInterval. The server asks for the Length
+// on every tick, so workers wake up for the jobs other servers push.
+func (q *SqlJobQueue) catchUp() {
+	now := time.Now()
+	if (q.later == 0 || now.Unix() < q.later) && now.Sub(q.counted) < recountInterval {
+		return
+	}
+	if err := q.recount(); err != nil {
+		logger.Logger().E("sql queue %v: count %v", q.name, err)
+	}
+}
+
+// dbPriority converts to the libgearman order and back.
+func dbPriority(priority int) int {
+	return PRIORITY_HIGH - priority
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (q *SqlJobQueue) scanJob(row scanner) (*Job, error) {
+	var (
+		handle, unique    string
+		priority          int
+		data              []byte
+		whenToRun         dbsql.NullInt64
+		attempts, created dbsql.NullInt64
+		schedule          dbsql.NullString
+	)
+	if err := row.Scan(&handle, &unique, &priority, &data, &whenToRun, &attempts, &created, &schedule); err != nil {
+		return nil, err
+	}
+
+	j := &Job{Handle: handle, Data: data, FuncName: q.name, IsBackGround: true,
+		Priority: dbPriority(priority), Attempts: int(attempts.Int64), Schedule: schedule.String}
+	if unique != handle {
+		j.Id = unique
+	}
+	if whenToRun.Int64 > 0 {
+		j.WhenToRun = time.Unix(whenToRun.Int64, 0)
+	}
+	if created.Int64 > 0 {
+		j.CreateAt = time.Unix(0, created.Int64)
+	} else {
+		j.CreateAt = time.Now()
+	}
+	return j, nil
+}
+
+func (q *SqlJobQueue) queryJob(query string, args ...interface{}) (*Job, error) {
+	j, err := q.scanJob(q.store.db.QueryRow(q.query(query), args...))
+	if err == dbsql.ErrNoRows {
+		return nil, nil
+	}
+	return j, err
+}
+
+func (q *SqlJobQueue) push(job *Job, front bool) error {
+	seq := q.store.back + 1
+	if front {
+		seq = q.store.front - 1
+	}
+	whenToRun := int64(0)
+	if !job.WhenToRun.IsZero() {
+		whenToRun = job.WhenToRun.Unix()
+	}
+
+	if q.pending[job.Handle] {
+		//taken back from a worker, the row is still there
+		_, err := q.store.db.Exec(q.query("UPDATE %s SET running = 0, seq = ?, attempts = ? WHERE handle = ? AND function_name = ?"),
+			seq, job.Attempts, job.Handle, q.name)
+		if err != nil {
+			return err
+		}
+		delete(q.pending, job.Handle)
+	} else {
+		unique := job.Id
+		if unique == "" {
+			unique = job.Handle
+		}
+
+		_, err := q.store.db.Exec(q.query("INSERT INTO %s (unique_key, function_name, priority, data, when_to_run, handle, attempts, seq, running, created_at, schedule) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)"),
+			unique, q.name, dbPriority(job.Priority), job.Data, whenToRun, job.Handle, job.Attempts, seq, job.CreateAt.UnixNano(), job.Schedule)
+		if err != nil {
+			//the drivers differ in how they report a constraint
+			var n int
+			row := q.store.db.QueryRow(q.query("SELECT COUNT(*) FROM %s WHERE unique_key = ? AND function_name = ?"), unique, q.name)
+			if row.Scan(&n) == nil && n > 0 {
+				return storage.ErrDuplicateUnique
+			}
+			return err
+		}
+	}
+
+	if front {
+		q.store.front = seq
+	} else {
+		q.store.back = seq
+	}
+	if whenToRun > time.Now().Unix() {
+		if q.later == 0 || whenToRun < q.later {
+			q.later = whenToRun
+		}
+	} else {
+		q.count++
+	}
+	return nil
+}
+
+func (q *SqlJobQueue) PushJob(job *Job) error {
+	if job == nil {
+		return nil
+	}
+	if !job.IsBackGround {
+		return q.local.PushJob(job)
+	}
+	return q.push(job, false)
+}
+
+func (q *SqlJobQueue) PushJobFront(job *Job) error {
+	if job == nil {
+		return nil
+	}
+	if !job.IsBackGround {
+		return q.local.PushJobFront(job)
+	}
+	return q.push(job, true)
+}
+
+// first returns the job to pop next from the table, jobs libgearman
+// scheduled wait for their time.
+func (q *SqlJobQueue) first() (*Job, error) {
+	return q.queryJob("SELECT "+jobColumns+" FROM %s WHERE function_name = ? AND running = 0 AND "+dueSQL+" ORDER BY priority, seq LIMIT 1",
+		q.name, time.Now().Unix())
+}
+
+// claim marks the job running on this node, false if another server
+// sharing the table claimed it first.
+func (q *SqlJobQueue) claim(j *Job) (bool, error) {
+	res, err := q.store.db.Exec(q.query("UPDATE %s SET running = 1, node = ?, attempts = attempts + 1 WHERE handle = ? AND function_name = ? AND running = 0"),
+		q.store.node, j.Handle, q.name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// PopJob prefers the local jobs over the table ones of the same priority,
+// a job another server claimed first is passed over for the next one.
+func (q *SqlJobQueue) PopJob() (*Job, error) {
+	q.catchUp()
+	for {
+		local, _ := q.local.Peek()
+		if local != nil && local.Priority == PRIORITY_HIGH || q.count == 0 {
+			return q.local.PopJob()
+		}
+
+		j, err := q.first()
+		if err != nil {
+			return nil, err
+		}
+		if j == nil {
+			//other servers popped the due jobs
+			q.count = 0
+			return q.local.PopJob()
+		}
+		if local != nil && local.Priority >= j.Priority {
+			return q.local.PopJob()
+		}
+
+		ok, err := q.claim(j)
+		if err != nil {
+			return nil, err
+		}
+		q.count--
+		if ok {
+			q.pending[j.Handle] = true
+			return j, nil
+		}
+	}
+}
+
+func (q *SqlJobQueue) Peek() (*Job, error) {
+	q.catchUp()
+	local, _ := q.local.Peek()
+	if local != nil && local.Priority == PRIORITY_HIGH || q.count == 0 {
+		return local, nil
+	}
+
+	j, err := q.first()
+	if err != nil {
+		return nil, err
+	}
+	if j == nil || local != nil && local.Priority >= j.Priority {
+		return local, nil
+	}
+	return j, nil
+}
+
+// RemoveJob returns the job if it was still queued.
+func (q *SqlJobQueue) RemoveJob(handle string) (*Job, error) {
+	if j, _ := q.local.RemoveJob(handle); j != nil {
+		return j, nil
+	}
+
+	if q.pending[handle] {
+		_, err := q.store.db.Exec(q.query("DELETE FROM %s WHERE handle = ? AND function_name = ?"), handle, q.name)
+		if err != nil {
+			return nil, err
+		}
+		delete(q.pending, handle)
+		return nil, nil
+	}
+
+	tx, err := q.store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	j, err := q.scanJob(tx.QueryRow(q.query("SELECT "+jobColumns+" FROM %s WHERE handle = ? AND function_name = ? AND running = 0"),
+		handle, q.name))
+	if err == dbsql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(q.query("DELETE FROM %s WHERE handle = ? AND function_name = ?"), handle, q.name); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if j.WhenToRun.Unix() <= time.Now().Unix() {
+		q.count--
+	}
+	return j, nil
+}
+
+func (q *SqlJobQueue) GetJob(handle string) (*Job, error) {
+	if j, _ := q.local.GetJob(handle); j != nil {
+		return j, nil
+	}
+	return q.queryJob("SELECT "+jobColumns+" FROM %s WHERE handle = ? AND function_name = ? AND running = 0", handle, q.name)
+}
+
+func (q *SqlJobQueue) GetJobByUnique(id string) (*Job, error) {
+	if j, _ := q.local.GetJobByUnique(id); j != nil {
+		return j, nil
+	}
+	return q.queryJob("SELECT "+jobColumns+" FROM %s WHERE unique_key = ? AND function_name = ? AND running = 0", id, q.name)
+}
+
+// Jobs merges the local jobs, the local ones first for the same priority.
+func (q *SqlJobQueue) Jobs(offset, limit int) ([]*Job, error) {
+	local, _ := q.local.Jobs(0, -1)
+
+	query := "SELECT " + jobColumns + " FROM %s WHERE function_name = ? AND running = 0 ORDER BY priority, seq"
+	args := []interface{}{q.name}
+	if limit >= 0 {
+		query += " LIMIT ?"
+		args = append(args, offset+limit)
+	}
+
+	rows, err := q.store.db.Query(q.query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stored []*Job
+	for rows.Next() {
+		j, err := q.scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, len(local)+len(stored))
+	for len(local) > 0 || len(stored) > 0 {
+		if len(stored) == 0 || len(local) > 0 && local[0].Priority >= stored[0].Priority {
+			jobs, local = append(jobs, local[0]), local[1:]
+		} else {
+			jobs, stored = append(jobs, stored[0]), stored[1:]
+		}
+	}
+
+	if offset >= len(jobs) {
+		return []*Job{}, nil
+	}
+	jobs = jobs[offset:]
+	if limit >= 0 && limit < len(jobs) {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+// Length leaves out the jobs libgearman scheduled until they are due.
+func (q *SqlJobQueue) Length() int {
+	q.catchUp()
+	return q.local.Length() + q.count
+}
+
+func (q *SqlJobQueue) Stats() storage.Stats {
+	stats := q.local.Stats()
+
+	var count int
+	var bytes, oldest dbsql.NullInt64
+	row := q.store.db.QueryRow(q.query("SELECT COUNT(*), SUM("+q.store.dialect.lengthFunc+"(data)), MIN(created_at) FROM %s WHERE function_name = ? AND running = 0 AND "+dueSQL),
+		q.name, time.Now().Unix())
+	if err := row.Scan(&count, &bytes, &oldest); err != nil {
+		logger.Logger().E("sql queue %v: stats %v", q.name, err)
+		stats.Count += q.count
+		return stats
+	}
+
+	stats.Count += count
+	stats.Bytes += bytes.Int64
+	if oldest.Int64 > 0 {
+		if age := time.Since(time.Unix(0, oldest.Int64)); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
+
+// Close leaves the table to the other queues, the running jobs are queued
+// again by the next Initial of the same node.
+func (q *SqlJobQueue) Close() error {
+	return nil
+}
@@ -0,0 +1,339 @@
+package sql
+
+import (
+	. "common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"storage"
+	"testing"
+	"time"
+	"utils/logger"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sql-test")
+	if err != nil {
+		panic(err)
+	}
+	logger.Initialize("test", "error", dir+"/")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// openStore opens the sqlite file of the test, a second call is a restart
+func openStore(t *testing.T, dir string) *Store {
+	return openNode(t, dir, "n1")
+}
+
+// openNode opens the sqlite file as another server sharing it
+func openNode(t *testing.T, dir, node string) *Store {
+	s, err := Open("sqlite3", filepath.Join(dir, "queue.db"), DefaultTable, "", node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+func openQueue(t *testing.T, s *Store) *SqlJobQueue {
+	q, err := s.Queue("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.(*SqlJobQueue)
+}
+
+func bgJob(handle string, priority int) *Job {
+	return &Job{Handle: handle, FuncName: "f", Data: []byte(handle), Priority: priority,
+		IsBackGround: true, CreateAt: time.Now()}
+}
+
+func popAll(t *testing.T, q *SqlJobQueue) []string {
+	var handles []string
+	for {
+		j, err := q.PopJob()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j == nil {
+			return handles
+		}
+		handles = append(handles, j.Handle)
+	}
+}
+
+func TestPushPopOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobs  []*Job
+		front []*Job
+		want  []string
+	}{
+		{
+			name: "fifo",
+			jobs: []*Job{bgJob("a", PRIORITY_NORMAL), bgJob("b", PRIORITY_NORMAL), bgJob("c", PRIORITY_NORMAL)},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "priorities",
+			jobs: []*Job{bgJob("low", PRIORITY_LOW), bgJob("normal", PRIORITY_NORMAL), bgJob("high", PRIORITY_HIGH)},
+			want: []string{"high", "normal", "low"},
+		},
+		{
+			name:  "front",
+			jobs:  []*Job{bgJob("a", PRIORITY_NORMAL), bgJob("b", PRIORITY_NORMAL)},
+			front: []*Job{bgJob("requeued", PRIORITY_NORMAL)},
+			want:  []string{"requeued", "a", "b"},
+		},
+		{
+			name: "local jobs first within a priority",
+			jobs: []*Job{bgJob("table", PRIORITY_NORMAL), {Handle: "local", Priority: PRIORITY_NORMAL},
+				bgJob("table-high", PRIORITY_HIGH)},
+			want: []string{"table-high", "local", "table"},
+		},
+	}
+
+	for _, tt := range tests {
+		q := openQueue(t, openStore(t, t.TempDir()))
+		for _, j := range tt.jobs {
+			if err := q.PushJob(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, j := range tt.front {
+			if err := q.PushJobFront(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := q.Length(); n != len(tt.want) {
+			t.Errorf("%v: length %v, want %v", tt.name, n, len(tt.want))
+		}
+		if got := popAll(t, q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: popped %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRestartRecovery(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, openStore(t, dir))
+	for _, h := range []string{"a", "b", "c"} {
+		q.PushJob(bgJob(h, PRIORITY_NORMAL))
+	}
+	if j, _ := q.PopJob(); j == nil || j.Handle != "a" {
+		t.Fatalf("popped %v", j)
+	}
+	q.PopJob()
+	q.RemoveJob("b")
+
+	s := openStore(t, dir)
+	if names, err := s.Names(); err != nil || !reflect.DeepEqual(names, []string{"f"}) {
+		t.Errorf("names %v %v", names, err)
+	}
+	restarted := openQueue(t, s)
+	if n := restarted.Length(); n != 2 {
+		t.Errorf("length after restart %v, want 2", n)
+	}
+	j, _ := restarted.PopJob()
+	if j == nil || j.Handle != "a" || string(j.Data) != "a" || j.Attempts != 1 {
+		t.Errorf("first after restart %+v", j)
+	}
+	if got := popAll(t, restarted); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("popped %v", got)
+	}
+}
+
+func TestRestartKeepsOtherNodes(t *testing.T) {
+	dir := t.TempDir()
+	n1 := openQueue(t, openNode(t, dir, "n1"))
+	n1.PushJob(bgJob("a", PRIORITY_NORMAL))
+	n1.PushJob(bgJob("b", PRIORITY_NORMAL))
+	n2 := openQueue(t, openNode(t, dir, "n2"))
+	if j, _ := n1.PopJob(); j == nil || j.Handle != "a" {
+		t.Fatalf("n1 popped %v", j)
+	}
+	if j, _ := n2.PopJob(); j == nil || j.Handle != "b" {
+		t.Fatalf("n2 popped %v", j)
+	}
+
+	//n1 starts again, b still runs on n2
+	restarted := openQueue(t, openNode(t, dir, "n1"))
+	if got := popAll(t, restarted); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("popped %v after the restart of n1, want [a]", got)
+	}
+}
+
+func TestSharedCount(t *testing.T) {
+	dir := t.TempDir()
+	n1 := openQueue(t, openNode(t, dir, "n1"))
+	n2 := openQueue(t, openNode(t, dir, "n2"))
+	n2.PushJob(bgJob("a", PRIORITY_NORMAL))
+	n2.PushJob(bgJob("b", PRIORITY_NORMAL))
+
+	n1.counted = time.Now().Add(-recountInterval)
+	if n := n1.Length(); n != 2 {
+		t.Errorf("length %v of the jobs n2 pushed, want 2", n)
+	}
+
+	n2.PopJob()
+	n1.counted = time.Now().Add(-recountInterval)
+	if n := n1.Length(); n != 1 {
+		t.Errorf("length %v after n2 popped, want 1", n)
+	}
+}
+
+func TestClaimedByOtherNode(t *testing.T) {
+	dir := t.TempDir()
+	n1 := openQueue(t, openNode(t, dir, "n1"))
+	n1.PushJob(bgJob("a", PRIORITY_NORMAL))
+	n1.PushJob(bgJob("b", PRIORITY_NORMAL))
+	n2 := openQueue(t, openNode(t, dir, "n2"))
+
+	a, _ := n2.PopJob()
+	if ok, err := n1.claim(a); ok || err != nil {
+		t.Errorf("claimed the job n2 runs: %v %v", ok, err)
+	}
+
+	//n1 still counts a
+	if got := popAll(t, n1); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("popped %v, want [b]", got)
+	}
+	if n := n1.Length(); n != 0 {
+		t.Errorf("length %v, want 0", n)
+	}
+}
+
+func TestServerQueuesApart(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+	dead, err := s.Queue(storage.DeadQueuePrefix + "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.PushJob(bgJob("a", PRIORITY_NORMAL))
+
+	//libgearman reads every row of its table
+	var n int
+	if err := s.db.QueryRow(s.query("SELECT COUNT(*) FROM %s")).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%v rows in the libgearman table, %v", n, err)
+	}
+
+	s = openStore(t, dir)
+	if names, _ := s.Names(); !reflect.DeepEqual(names, []string{storage.DeadQueuePrefix + "f"}) {
+		t.Errorf("names %v", names)
+	}
+	dead, _ = s.Queue(storage.DeadQueuePrefix + "f")
+	if j, _ := dead.PopJob(); j == nil || j.Handle != "a" {
+		t.Errorf("popped %v from the dead letter queue", j)
+	}
+}
+
+func TestUniqueLookups(t *testing.T) {
+	q := openQueue(t, openStore(t, t.TempDir()))
+	j := bgJob("a", PRIORITY_NORMAL)
+	j.Id = "ua"
+	q.PushJob(j)
+	q.PushJob(bgJob("b", PRIORITY_NORMAL))
+
+	if got, _ := q.GetJobByUnique("ua"); got == nil || got.Handle != "a" || got.Id != "ua" {
+		t.Errorf("get unique ua: %v", got)
+	}
+	if got, _ := q.GetJob("b"); got == nil || got.Id != "" {
+		t.Errorf("get b: %v", got)
+	}
+
+	again := bgJob("a2", PRIORITY_NORMAL)
+	again.Id = "ua"
+	if err := q.PushJob(again); err != storage.ErrDuplicateUnique {
+		t.Errorf("queued unique id: err %v", err)
+	}
+
+	//a running job keeps its unique id
+	q.PopJob()
+	if got, _ := q.GetJobByUnique("ua"); got != nil {
+		t.Errorf("running ua found: %v", got)
+	}
+	if err := q.PushJob(again); err != storage.ErrDuplicateUnique {
+		t.Errorf("running unique id: err %v", err)
+	}
+
+	q.RemoveJob("a")
+	if err := q.PushJob(again); err != nil {
+		t.Errorf("unique id after remove: %v", err)
+	}
+	if n := q.Length(); n != 2 {
+		t.Errorf("length %v, want 2", n)
+	}
+}
+
+func TestScheduledRows(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+
+	//rows libgearman scheduled, they get handles on the next open
+	now := time.Now().Unix()
+	insert := s.query("INSERT INTO %s (unique_key, function_name, priority, data, when_to_run) VALUES (?, 'f', 1, 'x', ?)")
+	for _, row := range []struct {
+		unique    string
+		whenToRun int64
+	}{{"due", now - 10}, {"soon", now + 1}, {"later", now + 3600}} {
+		if _, err := s.db.Exec(insert, row.unique, row.whenToRun); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := openQueue(t, openStore(t, dir))
+	if n := q.Length(); n != 1 {
+		t.Errorf("length %v, want 1", n)
+	}
+	if stats := q.Stats(); stats.Count != 1 || stats.Bytes != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	time.Sleep(time.Until(time.Unix(q.later, 0)))
+	if n := q.Length(); n != 2 {
+		t.Errorf("length once due %v, want 2", n)
+	}
+
+	var got []string
+	for {
+		j, err := q.PopJob()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j == nil {
+			break
+		}
+		got = append(got, j.Id)
+	}
+	if !reflect.DeepEqual(got, []string{"due", "soon"}) || q.Length() != 0 {
+		t.Errorf("popped %v, length %v", got, q.Length())
+	}
+}
+
+func TestScheduleKept(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, openStore(t, dir))
+
+	j := bgJob("cron", PRIORITY_NORMAL)
+	j.Id, j.Schedule, j.WhenToRun = "daily", "0 3 * * *", time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := q.PushJob(j); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, openStore(t, dir))
+	got, err := q.GetJob("cron")
+	if err != nil || got == nil {
+		t.Fatalf("get %v %v", got, err)
+	}
+	if got.Schedule != j.Schedule || !got.WhenToRun.Equal(j.WhenToRun) || got.Id != "daily" {
+		t.Errorf("restored %v", got)
+	}
+}
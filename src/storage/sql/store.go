@@ -0,0 +1,253 @@
+package sql
+
+import (
+	. "common"
+	dbsql "database/sql"
+	"errors"
+	"fmt"
+	"storage"
+	"strings"
+	"utils/logger"
+)
+
+const (
+	DefaultTable = "gearman_queue"
+
+	//the table of the dead letter and scheduled queues, libgearman would
+	//run their rows as jobs of functions named so
+	serverTableSuffix = "_server"
+)
+
+var (
+	unknownDialect = errors.New("unknown sql dialect, set the dialect option")
+	missingDriver  = errors.New("sql driver option missing")
+	missingNode    = errors.New("sql node option missing")
+)
+
+func init() {
+	storage.Register("sql", openBackend)
+}
+
+// openBackend takes the options driver, dsn, table, dialect (sqlite, mysql
+// or postgres, guessed from the driver by default) and node, driver and
+// node are required. The driver must be linked into the server, see the
+// build tags in gearman.
+func openBackend(options map[string]string) (storage.Backend, error) {
+	driver, dsn, table, dialectName, node := "", "", DefaultTable, "", ""
+	for key, value := range options {
+		switch key {
+		case "driver":
+			driver = value
+		case "dsn":
+			dsn = value
+		case "table":
+			table = value
+		case "dialect":
+			dialectName = value
+		case "node":
+			node = value
+		default:
+			return nil, storage.ErrInvalidOption
+		}
+	}
+
+	if driver == "" {
+		return nil, missingDriver
+	}
+	return Open(driver, dsn, table, dialectName, node)
+}
+
+// Store keeps the background jobs of all functions in one table, and the
+// dead letter and scheduled ones in another. The foreground ones stay in
+// memory as their clients are connected here.
+type Store struct {
+	db      *dbsql.DB
+	dialect *dialect
+	table   string
+	node    string //marks the jobs this server runs
+	front   int64  //seq of the job in front of all others
+	back    int64  //seq of the last job
+}
+
+// Open connects to the table, servers sharing it must use different nodes,
+// a server queues the jobs of its node that were running when it stopped
+// again. The server passes its node id.
+func Open(driver, dsn, table, dialectName, node string) (*Store, error) {
+	if node == "" {
+		return nil, missingNode
+	}
+	d := dialectOf(driver)
+	if dialectName != "" {
+		d = dialects[dialectName]
+	}
+	if d == nil {
+		return nil, unknownDialect
+	}
+
+	db, err := dbsql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &Store{db: db, dialect: d, table: table, node: node}
+	if err := s.createSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) query(query string) string {
+	return s.tableQuery(s.table, query)
+}
+
+func (s *Store) tableQuery(table, query string) string {
+	return s.dialect.rebind(fmt.Sprintf(query, table))
+}
+
+// tableOf returns the table of a queue, the server keeps its dead letter
+// and scheduled queues out of the table libgearman reads.
+func (s *Store) tableOf(name string) string {
+	if strings.HasPrefix(name, storage.DeadQueuePrefix) || strings.HasPrefix(name, storage.SchedQueuePrefix) {
+		return s.table + serverTableSuffix
+	}
+	return s.table
+}
+
+// createSchema creates the tables, or adds our columns to one created by
+// libgearman and gives its jobs handles.
+func (s *Store) createSchema() error {
+	tables := []string{s.table, s.table + serverTableSuffix}
+	for _, table := range tables {
+		if err := s.createTable(table); err != nil {
+			return err
+		}
+	}
+
+	if err := s.migrateHandles(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		var front, back dbsql.NullInt64
+		row := s.db.QueryRow(s.tableQuery(table, "SELECT MIN(seq), MAX(seq) FROM %s"))
+		if err := row.Scan(&front, &back); err != nil {
+			return err
+		}
+		if front.Int64 < s.front {
+			s.front = front.Int64
+		}
+		if back.Int64 > s.back {
+			s.back = back.Int64
+		}
+	}
+	return nil
+}
+
+func (s *Store) createTable(table string) error {
+	if _, err := s.db.Exec(fmt.Sprintf(s.dialect.createSQL, table)); err != nil {
+		return err
+	}
+
+	for _, column := range addedColumns {
+		if _, err := s.db.Exec(s.tableQuery(table, "SELECT "+column+" FROM %s WHERE 1=0")); err == nil {
+			continue
+		}
+		logger.Logger().I("sql table %v: add column %v", table, column)
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, s.dialect.columnSQL[column])
+		if _, err := s.db.Exec(alter); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range indexes {
+		name := table + "_" + index.name
+		if s.dialect.hasIndexSQL != "" {
+			var n int
+			if err := s.db.QueryRow(s.dialect.rebind(s.dialect.hasIndexSQL), table, name).Scan(&n); err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+		}
+		if _, err := s.db.Exec(fmt.Sprintf(s.dialect.indexSQL, table, name, index.columns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateHandles names the jobs libgearman queued, the unique key is
+// unique per function already.
+func (s *Store) migrateHandles() error {
+	rows, err := s.db.Query(s.query("SELECT unique_key, function_name FROM %s WHERE handle IS NULL OR handle = ''"))
+	if err != nil {
+		return err
+	}
+
+	type key struct{ unique, funcName string }
+	var keys []key
+	for rows.Next() {
+		var k key
+		if err := rows.Scan(&k.unique, &k.funcName); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		handle := fmt.Sprintf("%smigrated:%s:%s", JobPrefix, k.funcName, k.unique)
+		_, err := s.db.Exec(s.query("UPDATE %s SET handle = ?, attempts = 0, running = 0 WHERE unique_key = ? AND function_name = ?"),
+			handle, k.unique, k.funcName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(keys) > 0 {
+		logger.Logger().I("sql table %v: migrated %v jobs", s.table, len(keys))
+	}
+	return nil
+}
+
+func (s *Store) Names() ([]string, error) {
+	var names []string
+	for _, table := range []string{s.table, s.table + serverTableSuffix} {
+		rows, err := s.db.Query(s.tableQuery(table, "SELECT DISTINCT function_name FROM %s"))
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+func (s *Store) Queue(name string) (storage.JobQueue, error) {
+	q := &SqlJobQueue{store: s, table: s.tableOf(name)}
+	if err := q.Initial(name); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
@@ -0,0 +1,145 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+A queue log is a directory of segment files named <seq>.wal, replayed in
+sequence order. Every record is
+
+4 byte size  - big-endian size of type and body
+4 byte crc   - big-endian crc32 (IEEE) of type and body
+1 byte type  - one of the rec* values
+body         - the json job of a push, the handle of a pop or remove
+
+A segment written by a checkpoint starts with a reset record followed by
+the whole state of the queue, so the segments before it can be deleted.
+A torn or corrupt record ends the replay of its segment.
+*/
+
+const (
+	recPush      = 1
+	recPushFront = 2
+	recPop       = 3
+	recRemove    = 4
+	recReset     = 5
+
+	segmentSuffix   = ".wal"
+	recHeaderLength = 8
+	maxRecordSize   = 1 << 30
+)
+
+var (
+	corruptRecord = errors.New("corrupt wal record")
+)
+
+type record struct {
+	tp   byte
+	body []byte
+}
+
+func segmentName(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, segmentSuffix))
+}
+
+// listSegments returns the segment sequence numbers of dir in order.
+func listSegments(dir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func encodeRecord(tp byte, body []byte) []byte {
+	buf := make([]byte, recHeaderLength+1+len(body))
+	buf[recHeaderLength] = tp
+	copy(buf[recHeaderLength+1:], body)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[recHeaderLength:]))
+	return buf
+}
+
+func readRecord(r *bufio.Reader) (*record, error) {
+	header := make([]byte, recHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, corruptRecord
+		}
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size == 0 || size > maxRecordSize {
+		return nil, corruptRecord
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, corruptRecord
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, corruptRecord
+	}
+
+	return &record{tp: payload[0], body: payload[1:]}, nil
+}
+
+// replaySegment calls apply for every intact record of a segment.
+func replaySegment(path string, apply func(*record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		apply(rec)
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
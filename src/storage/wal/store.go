@@ -0,0 +1,204 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"storage"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	storage.Register("wal", openBackend)
+}
+
+// fsync policies of a Store
+const (
+	SyncAlways   = iota // fsync after every record
+	SyncInterval        // fsync the written queues every Options.SyncInterval
+	SyncNone            // leave it to the OS, survives a killed process but not a crashed host
+)
+
+const (
+	DefaultSegmentSize  = 1024 * 1024 * 64
+	DefaultSyncInterval = time.Second
+)
+
+var (
+	invalidSync = errors.New("invalid wal sync policy")
+	missingDir  = errors.New("wal dir option missing")
+	queueClosed = errors.New("wal queue closed")
+)
+
+type Options struct {
+	Sync         int
+	SyncInterval time.Duration
+	SegmentSize  int64 //a queue log over this size is compacted into a new segment
+}
+
+// ParseSync reads "always", "none" or a sync interval such as "200ms".
+func ParseSync(spec string) (int, time.Duration, error) {
+	switch spec {
+	case "always":
+		return SyncAlways, 0, nil
+	case "none":
+		return SyncNone, 0, nil
+	}
+
+	interval, err := time.ParseDuration(spec)
+	if err != nil || interval <= 0 {
+		return 0, 0, invalidSync
+	}
+	return SyncInterval, interval, nil
+}
+
+// openBackend takes the options dir, sync (see ParseSync) and segment
+// (bytes), dir is required.
+func openBackend(options map[string]string) (storage.Backend, error) {
+	opts := Options{Sync: SyncInterval}
+	dir := ""
+
+	for key, value := range options {
+		switch key {
+		case "dir":
+			dir = value
+		case "sync":
+			sync, interval, err := ParseSync(value)
+			if err != nil {
+				return nil, err
+			}
+			opts.Sync, opts.SyncInterval = sync, interval
+		case "segment":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size <= 0 {
+				return nil, storage.ErrInvalidOption
+			}
+			opts.SegmentSize = size
+		default:
+			return nil, storage.ErrInvalidOption
+		}
+	}
+
+	if dir == "" {
+		return nil, missingDir
+	}
+	return Open(dir, opts)
+}
+
+// Store keeps the logs of all queues under one directory, one sub
+// directory per queue.
+type Store struct {
+	dir    string
+	opts   Options
+	lock   sync.Mutex
+	queues []*WalJobQueue
+}
+
+func Open(dir string, opts Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.Sync == SyncInterval && opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	s := &Store{dir: dir, opts: opts}
+	if opts.Sync == SyncInterval {
+		go s.syncLoop()
+	}
+
+	return s, nil
+}
+
+// Names returns the names of the queues having a log in the store.
+func (s *Store) Names() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(info.Name())
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Queue opens the queue of name, replaying its log.
+func (s *Store) Queue(name string) (storage.JobQueue, error) {
+	q := &WalJobQueue{store: s}
+	if err := q.Initial(name); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (s *Store) queueDir(name string) string {
+	return filepath.Join(s.dir, escapeName(name))
+}
+
+func (s *Store) register(q *WalJobQueue) {
+	s.lock.Lock()
+	s.queues = append(s.queues, q)
+	s.lock.Unlock()
+}
+
+func (s *Store) unregister(q *WalJobQueue) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, registered := range s.queues {
+		if registered == q {
+			s.queues = append(s.queues[:i], s.queues[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Store) syncLoop() {
+	tick := time.NewTicker(s.opts.SyncInterval)
+	for range tick.C {
+		s.lock.Lock()
+		queues := append([]*WalJobQueue(nil), s.queues...)
+		s.lock.Unlock()
+
+		for _, q := range queues {
+			q.sync()
+		}
+	}
+}
+
+// escapeName keeps letters, digits, '-' and '_', so any function name is
+// a valid directory name on every platform.
+func escapeName(name string) string {
+	escaped := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	if len(escaped) == 0 {
+		return "%"
+	}
+	return string(escaped)
+}
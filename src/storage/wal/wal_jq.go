@@ -0,0 +1,382 @@
+package wal
+
+import (
+	"bytes"
+	. "common"
+	"encoding/json"
+	"os"
+	"sort"
+	"storage"
+	"storage/memory"
+	"sync"
+	"utils/logger"
+)
+
+type pendingJob struct {
+	job *Job
+	seq uint64
+}
+
+// WalJobQueue keeps its jobs in memory and logs every change of background
+// jobs before it is applied. A popped job stays pending in the log until it
+// is removed, so jobs running when the server died are queued again.
+type WalJobQueue struct {
+	name    string
+	dir     string
+	store   *Store
+	mem     *memory.MemJobQueue
+	pending map[string]*pendingJob
+	popSeq  uint64
+
+	lock     sync.Mutex //guards the segment file against the sync loop
+	file     *os.File
+	seq      uint64
+	size     int64
+	rollSize int64
+	dirty    bool
+}
+
+func (q *WalJobQueue) Initial(name string) error {
+	q.name = name
+	q.dir = q.store.queueDir(name)
+	q.reset()
+
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+
+	if err := q.recover(); err != nil {
+		return err
+	}
+	q.store.register(q)
+	return nil
+}
+
+func (q *WalJobQueue) reset() {
+	q.mem = &memory.MemJobQueue{}
+	q.mem.Initial(q.name)
+	q.pending = make(map[string]*pendingJob)
+}
+
+func (q *WalJobQueue) recover() error {
+	seqs, err := listSegments(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range seqs {
+		err := replaySegment(segmentName(q.dir, seq), q.apply)
+		if err == corruptRecord {
+			logger.Logger().W("wal queue %v: torn record in segment %v", q.name, seq)
+		} else if err != nil {
+			return err
+		}
+		q.seq = seq
+	}
+
+	//jobs workers had when the server stopped run again first, in the order
+	//they were popped
+	pending := q.pendingJobs()
+	for i := len(pending) - 1; i >= 0; i-- {
+		q.mem.PushJobFront(pending[i])
+	}
+	q.pending = make(map[string]*pendingJob)
+
+	logger.Logger().I("wal queue %v: recovered %v jobs, %v were running", q.name, q.mem.Length(), len(pending))
+	return q.checkpoint()
+}
+
+func (q *WalJobQueue) apply(rec *record) {
+	switch rec.tp {
+	case recPush, recPushFront:
+		j := &Job{}
+		if err := json.Unmarshal(rec.body, j); err != nil {
+			logger.Logger().W("wal queue %v: bad job record: %v", q.name, err)
+			return
+		}
+		//the clients coalesced onto it were sessions of another process
+		j.Attached = nil
+		q.mem.RemoveJob(j.Handle)
+		delete(q.pending, j.Handle)
+		if rec.tp == recPush {
+			q.mem.PushJob(j)
+		} else {
+			q.mem.PushJobFront(j)
+		}
+	case recPop:
+		if j, _ := q.mem.RemoveJob(string(rec.body)); j != nil {
+			q.addPending(j)
+		}
+	case recRemove:
+		q.mem.RemoveJob(string(rec.body))
+		delete(q.pending, string(rec.body))
+	case recReset:
+		q.reset()
+	}
+}
+
+func (q *WalJobQueue) addPending(j *Job) {
+	q.popSeq++
+	q.pending[j.Handle] = &pendingJob{job: j, seq: q.popSeq}
+}
+
+// pendingJobs returns the popped but not removed jobs in pop order.
+func (q *WalJobQueue) pendingJobs() []*Job {
+	pending := make([]*pendingJob, 0, len(q.pending))
+	for _, p := range q.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+
+	jobs := make([]*Job, len(pending))
+	for i, p := range pending {
+		jobs[i] = p.job
+	}
+	return jobs
+}
+
+// checkpoint writes the state of the queue to a new segment and deletes
+// the segments before it.
+func (q *WalJobQueue) checkpoint() error {
+	var buffer bytes.Buffer
+	buffer.Write(encodeRecord(recReset, nil))
+	jobs, _ := q.mem.Jobs(0, -1)
+	for _, j := range jobs {
+		if j.IsBackGround {
+			if err := writeJob(&buffer, recPush, j); err != nil {
+				return err
+			}
+		}
+	}
+	for _, j := range q.pendingJobs() {
+		if err := writeJob(&buffer, recPush, j); err != nil {
+			return err
+		}
+		buffer.Write(encodeRecord(recPop, []byte(j.Handle)))
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	seq := q.seq + 1
+	f, err := os.OpenFile(segmentName(q.dir, seq), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buffer.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.seq = seq
+	q.size = int64(buffer.Len())
+	q.dirty = false
+	q.rollSize = q.store.opts.SegmentSize
+	if q.rollSize < 2*q.size {
+		q.rollSize = 2 * q.size
+	}
+
+	seqs, err := listSegments(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, old := range seqs {
+		if old < seq {
+			os.Remove(segmentName(q.dir, old))
+		}
+	}
+	return syncDir(q.dir)
+}
+
+func writeJob(buffer *bytes.Buffer, tp byte, j *Job) error {
+	body, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	buffer.Write(encodeRecord(tp, body))
+	return nil
+}
+
+// log appends a record, a record that could not be written completely is
+// cut off again so the records after it can still be replayed.
+func (q *WalJobQueue) log(tp byte, body []byte) error {
+	q.lock.Lock()
+	if q.file == nil {
+		q.lock.Unlock()
+		return queueClosed
+	}
+
+	_, err := q.file.Write(encodeRecord(tp, body))
+	if err == nil && q.store.opts.Sync == SyncAlways {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		q.file.Truncate(q.size)
+		q.lock.Unlock()
+		return err
+	}
+
+	q.size += int64(recHeaderLength + 1 + len(body))
+	q.dirty = q.store.opts.Sync != SyncAlways
+	q.lock.Unlock()
+	return nil
+}
+
+// rollOver checkpoints a full segment, it runs after the logged change is
+// applied to the queue or the checkpoint would leave the change out.
+func (q *WalJobQueue) rollOver() {
+	q.lock.Lock()
+	full := q.file != nil && q.size >= q.rollSize
+	q.lock.Unlock()
+
+	if full {
+		if err := q.checkpoint(); err != nil {
+			logger.Logger().E("wal queue %v: checkpoint %v", q.name, err)
+		}
+	}
+}
+
+func (q *WalJobQueue) logJob(tp byte, j *Job) error {
+	body, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return q.log(tp, body)
+}
+
+func (q *WalJobQueue) sync() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.dirty || q.file == nil {
+		return
+	}
+	if err := q.file.Sync(); err != nil {
+		logger.Logger().E("wal queue %v: %v", q.name, err)
+	}
+	q.dirty = false
+}
+
+func (q *WalJobQueue) PushJob(job *Job) error {
+	if job == nil {
+		return nil
+	}
+	if job.IsBackGround {
+		if err := q.logJob(recPush, job); err != nil {
+			return err
+		}
+	}
+	delete(q.pending, job.Handle)
+	err := q.mem.PushJob(job)
+	q.rollOver()
+	return err
+}
+
+func (q *WalJobQueue) PushJobFront(job *Job) error {
+	if job == nil {
+		return nil
+	}
+	if job.IsBackGround {
+		if err := q.logJob(recPushFront, job); err != nil {
+			return err
+		}
+	}
+	delete(q.pending, job.Handle)
+	err := q.mem.PushJobFront(job)
+	q.rollOver()
+	return err
+}
+
+func (q *WalJobQueue) PopJob() (*Job, error) {
+	job, _ := q.mem.Peek()
+	if job == nil {
+		return nil, nil
+	}
+
+	if job.IsBackGround {
+		if err := q.log(recPop, []byte(job.Handle)); err != nil {
+			return nil, err
+		}
+		q.addPending(job)
+	}
+	job, err := q.mem.RemoveJob(job.Handle)
+	q.rollOver()
+	return job, err
+}
+
+func (q *WalJobQueue) Peek() (*Job, error) {
+	return q.mem.Peek()
+}
+
+// RemoveJob returns the job if it was still queued, removing a popped job
+// only marks it done in the log.
+func (q *WalJobQueue) RemoveJob(handle string) (*Job, error) {
+	if _, ok := q.pending[handle]; ok {
+		if err := q.log(recRemove, []byte(handle)); err != nil {
+			return nil, err
+		}
+		delete(q.pending, handle)
+		q.rollOver()
+		return nil, nil
+	}
+
+	job, _ := q.mem.GetJob(handle)
+	if job == nil {
+		return nil, nil
+	}
+	if job.IsBackGround {
+		if err := q.log(recRemove, []byte(handle)); err != nil {
+			return nil, err
+		}
+	}
+	job, err := q.mem.RemoveJob(handle)
+	q.rollOver()
+	return job, err
+}
+
+func (q *WalJobQueue) GetJob(handle string) (*Job, error) {
+	return q.mem.GetJob(handle)
+}
+
+func (q *WalJobQueue) GetJobByUnique(id string) (*Job, error) {
+	return q.mem.GetJobByUnique(id)
+}
+
+func (q *WalJobQueue) Jobs(offset, limit int) ([]*Job, error) {
+	return q.mem.Jobs(offset, limit)
+}
+
+func (q *WalJobQueue) Length() int {
+	return q.mem.Length()
+}
+
+func (q *WalJobQueue) Stats() storage.Stats {
+	return q.mem.Stats()
+}
+
+// Close syncs and closes the log, the jobs stay in it for the next Open.
+func (q *WalJobQueue) Close() error {
+	q.store.unregister(q)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+
+	err := q.file.Sync()
+	if cerr := q.file.Close(); err == nil {
+		err = cerr
+	}
+	q.file = nil
+	return err
+}
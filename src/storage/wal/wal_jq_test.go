@@ -0,0 +1,267 @@
+package wal
+
+import (
+	. "common"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"storage"
+	"strconv"
+	"testing"
+	"time"
+	"utils/logger"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "wal-test")
+	if err != nil {
+		panic(err)
+	}
+	logger.Initialize("test", "error", dir+"/")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// openQueue opens queue f of a store in dir, as a restarted server would
+func openQueue(t *testing.T, dir string, segmentSize int64) storage.JobQueue {
+	t.Helper()
+	s, err := Open(dir, Options{Sync: SyncAlways, SegmentSize: segmentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := s.Queue("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func bgJob(handle string) *Job {
+	return &Job{Handle: handle, FuncName: "f", Data: []byte("data of " + handle),
+		IsBackGround: true, Priority: PRIORITY_NORMAL}
+}
+
+func handles(t *testing.T, q storage.JobQueue) []string {
+	t.Helper()
+	jobs, err := q.Jobs(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, j := range jobs {
+		got = append(got, j.Handle)
+	}
+	return got
+}
+
+// lastSegment returns the path of the segment the queue appends to
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	qdir := (&Store{dir: dir}).queueDir("f")
+	seqs, err := listSegments(qdir)
+	if err != nil || len(seqs) == 0 {
+		t.Fatalf("segments %v %v", seqs, err)
+	}
+	return segmentName(qdir, seqs[len(seqs)-1])
+}
+
+func TestRecoverAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	q := openQueue(t, dir, 0)
+	q.PushJob(bgJob("a"))
+	q.PushJob(bgJob("b"))
+	q.PushJob(&Job{Handle: "foreground", FuncName: "f", Priority: PRIORITY_NORMAL})
+	q.PushJob(bgJob("c"))
+	high := bgJob("high")
+	high.Priority = PRIORITY_HIGH
+	q.PushJob(high)
+	q.RemoveJob("b")
+	if j, _ := q.PopJob(); j == nil || j.Handle != "high" {
+		t.Fatalf("popped %v", j)
+	}
+	q.RemoveJob("high")
+
+	//no Close, the process died
+	q = openQueue(t, dir, 0)
+	if got := handles(t, q); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("recovered %v", got)
+	}
+	if j, _ := q.GetJob("c"); j == nil || string(j.Data) != "data of c" || !j.IsBackGround {
+		t.Errorf("recovered job %v", j)
+	}
+}
+
+func TestRequeuePoppedJobs(t *testing.T) {
+	dir := t.TempDir()
+
+	q := openQueue(t, dir, 0)
+	for _, h := range []string{"a", "b", "c", "d"} {
+		q.PushJob(bgJob(h))
+	}
+	for i := 0; i < 3; i++ {
+		q.PopJob()
+	}
+	//b finished, a and c were still running
+	q.RemoveJob("b")
+
+	q = openQueue(t, dir, 0)
+	if got := handles(t, q); !reflect.DeepEqual(got, []string{"a", "c", "d"}) {
+		t.Errorf("recovered %v", got)
+	}
+
+	//requeued jobs are queued again, removing them still works
+	q.PopJob()
+	q.RemoveJob("a")
+	q = openQueue(t, dir, 0)
+	if got := handles(t, q); !reflect.DeepEqual(got, []string{"c", "d"}) {
+		t.Errorf("recovered twice %v", got)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{"truncated body", func(data []byte) []byte { return data[:len(data)-3] }},
+		{"truncated header", func(data []byte) []byte { return data[:len(data)-recordSize("b")+4] }},
+		{"bad crc", func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }},
+		{"garbage size", func(data []byte) []byte {
+			return append(data[:len(data)-recordSize("b")], 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, recPush)
+		}},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		q := openQueue(t, dir, 0)
+		q.PushJob(bgJob("a"))
+		q.PushJob(bgJob("b"))
+
+		path := lastSegment(t, dir)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, tt.corrupt(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		q = openQueue(t, dir, 0)
+		if got := handles(t, q); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("%v: recovered %v", tt.name, got)
+		}
+
+		//the torn record is gone for good, later records are kept
+		q.PushJob(bgJob("c"))
+		q = openQueue(t, dir, 0)
+		if got := handles(t, q); !reflect.DeepEqual(got, []string{"a", "c"}) {
+			t.Errorf("%v: recovered after a push %v", tt.name, got)
+		}
+	}
+}
+
+// recordSize is the size of the push record of bgJob(handle)
+func recordSize(handle string) int {
+	body, _ := json.Marshal(bgJob(handle))
+	return len(encodeRecord(recPush, body))
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, 2048)
+
+	var want []string
+	for i := 0; i < 100; i++ {
+		h := "job-" + strconv.Itoa(i)
+		q.PushJob(bgJob(h))
+		if i%10 == 0 {
+			want = append(want, h)
+			continue
+		}
+		q.RemoveJob(h)
+	}
+
+	qdir := (&Store{dir: dir}).queueDir("f")
+	if seqs, _ := listSegments(qdir); len(seqs) != 1 {
+		t.Errorf("segments %v, old ones not deleted", seqs)
+	}
+	//a checkpoint holds the 10 kept jobs and the one just pushed, the
+	//segment rolls at twice its size
+	if info, _ := os.Stat(lastSegment(t, dir)); info.Size() > int64(23*recordSize("job-99")) {
+		t.Errorf("segment of %v bytes not compacted", info.Size())
+	}
+
+	q = openQueue(t, dir, 2048)
+	if got := handles(t, q); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+}
+
+func TestParseSync(t *testing.T) {
+	tests := []struct {
+		spec     string
+		sync     int
+		interval time.Duration
+		ok       bool
+	}{
+		{"always", SyncAlways, 0, true},
+		{"none", SyncNone, 0, true},
+		{"200ms", SyncInterval, 200 * time.Millisecond, true},
+		{"0s", 0, 0, false},
+		{"often", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		sync, interval, err := ParseSync(tt.spec)
+		if (err == nil) != tt.ok || sync != tt.sync || interval != tt.interval {
+			t.Errorf("%q: %v %v %v", tt.spec, sync, interval, err)
+		}
+	}
+}
+
+func TestRollKeepsLoggedChange(t *testing.T) {
+	all := []string{"H:0", "H:1", "H:2"}
+	push := func(q storage.JobQueue, h string) { q.PushJob(bgJob(h)) }
+	pop := func(q storage.JobQueue, h string) { push(q, h); q.PopJob() }
+	remove := func(q storage.JobQueue, h string) { pop(q, h); q.RemoveJob(h) }
+	tests := []struct {
+		name string
+		step func(q storage.JobQueue, h string)
+		want []string
+	}{
+		{"push", push, append([]string{"front"}, all...)},
+		//popped jobs are requeued in front of the ones queued
+		{"pop", pop, append(all, "front")},
+		{"remove", remove, []string{"front"}},
+	}
+
+	for _, tt := range tests {
+		//roll on the last record of the last step, a later roll would
+		//write the right state again
+		scratch := openQueue(t, t.TempDir(), 1<<20)
+		for _, h := range all {
+			tt.step(scratch, h)
+		}
+		segmentSize := scratch.(*WalJobQueue).size
+
+		dir := t.TempDir()
+		q := openQueue(t, dir, segmentSize)
+		seq := q.(*WalJobQueue).seq
+		for _, h := range all {
+			tt.step(q, h)
+		}
+		if q.(*WalJobQueue).seq == seq {
+			t.Fatalf("%v: no segment rolled", tt.name)
+		}
+		q.PushJobFront(bgJob("front"))
+
+		//the server died
+		if got := handles(t, openQueue(t, dir, segmentSize)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: recovered %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}